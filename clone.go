@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// CloneSpec builds a spec for a copy of a running VM: its configuration is
+// the spec hcstool saved when creating it (see readSystemSpec), its disks are rebound to diskDir (which must hold
+// copies, since the source keeps its own disks open), and its ComputeTopology
+// is carried forward with memory and CPU count optionally overridden.
+// Zero overrides keep the source's values.
+func CloneSpec(id, diskDir string, memoryMB, cpus int) (string, error) {
+	spec, err := readSystemSpec(id)
+	if err != nil {
+		return "", err
+	}
+
+	vm := spec.VirtualMachine
+	if len(vm.ComputeTopology) == 0 && (memoryMB == 0 || cpus == 0) {
+		return "", fmt.Errorf("compute system %s did not report its ComputeTopology; pass both --memory and --cpus", id)
+	}
+	vm.ComputeTopology, err = overrideTopology(vm.ComputeTopology, memoryMB, cpus)
+	if err != nil {
+		return "", err
+	}
+
+	var topo computeTopology
+	if json.Unmarshal(vm.ComputeTopology, &topo) == nil {
+		fmt.Fprintf(os.Stderr, "Clone sizing: %d vCPU, %d MB\n", topo.Processor.Count, topo.Memory.SizeInMB)
+	}
+
+	if err := rebindDiskPaths(spec, diskDir); err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize spec: %w", err)
+	}
+	return string(data), nil
+}
+
+// overrideTopology sets Memory.SizeInMB and Processor.Count in a
+// ComputeTopology document when the corresponding value is non-zero. Every
+// other field (NUMA, limits, weights, ...) is preserved verbatim.
+func overrideTopology(raw json.RawMessage, memoryMB, cpus int) (json.RawMessage, error) {
+	topo := map[string]json.RawMessage{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &topo); err != nil {
+			return nil, fmt.Errorf("invalid ComputeTopology: %w", err)
+		}
+	}
+
+	set := func(section, field string, value int) error {
+		if value == 0 {
+			return nil
+		}
+		fields := map[string]json.RawMessage{}
+		if len(topo[section]) > 0 {
+			if err := json.Unmarshal(topo[section], &fields); err != nil {
+				return fmt.Errorf("invalid ComputeTopology.%s: %w", section, err)
+			}
+		}
+		fields[field] = json.RawMessage(fmt.Sprint(value))
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		topo[section] = data
+		return nil
+	}
+	if err := set("Memory", "SizeInMB", memoryMB); err != nil {
+		return nil, err
+	}
+	if err := set("Processor", "Count", cpus); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(topo)
+}
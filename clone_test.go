@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestOverrideTopology(t *testing.T) {
+	src := json.RawMessage(`{
+		"Memory": {"SizeInMB": 2048, "AllowOvercommit": true},
+		"Processor": {"Count": 2, "Weight": 200},
+		"Numa": {"VirtualNodeCount": 1}
+	}`)
+
+	got, err := overrideTopology(src, 4096, 0)
+	if err != nil {
+		t.Fatalf("overrideTopology: %v", err)
+	}
+	want := `{"Memory":{"AllowOvercommit":true,"SizeInMB":4096},"Numa":{"VirtualNodeCount":1},"Processor":{"Count":2,"Weight":200}}`
+	if string(got) != want {
+		t.Errorf("overrideTopology =\n%s\nwant\n%s", got, want)
+	}
+
+	got, err = overrideTopology(nil, 1024, 4)
+	if err != nil {
+		t.Fatalf("overrideTopology(nil): %v", err)
+	}
+	want = `{"Memory":{"SizeInMB":1024},"Processor":{"Count":4}}`
+	if string(got) != want {
+		t.Errorf("overrideTopology(nil) = %s, want %s", got, want)
+	}
+}
+
+func TestCmdCloneFlags(t *testing.T) {
+	fs := flag.NewFlagSet("clone", flag.ContinueOnError)
+	cmdClone(fs) // panics if a flag is registered twice
+
+	if f := fs.Lookup("name"); f == nil || !strings.Contains(f.Usage, "Select the VM") {
+		t.Errorf("--name should select the source VM, got %+v", f)
+	}
+	if fs.Lookup("new-name") == nil {
+		t.Error("--new-name is not registered")
+	}
+}
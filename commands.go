@@ -0,0 +1,1023 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	register(&command{
+		name: "create",
+		usage: "--spec file.json [--expand-env] [--gpu] [--name myvm] [--owner me] [--dry-run [--summary]]\n" +
+			"--spec-dir ./specs [--parallel N] [--gpu] [--owner me]\n" +
+			"--spec-template file.tmpl --set key=value [--set ...] [--gpu] [--name myvm]\n" +
+			"--vhdx boot.vhdx [--vhdx data.vhdx ...] [--scsi-controllers N] [--memory 4G] [--cpus 2] [--gpu] [--name myvm] [--count N]\n" +
+			"--vhdx disk.vhdx --iso setup.iso --boot-order dvd,disk ...\n" +
+			"--kernel vmlinux [--initrd initrd.img] [--cmdline \"console=ttyS0\"] [--vhdx rootfs.vhdx] ...\n" +
+			"... [--share host=C:\\data,name=data,readonly] [--on-reset stop|restart] [--id GUID [--open-existing]] [--sddl O:BAG:BAD:...] [--retry N [--retry-on 0x80370109,...]]",
+		summary:        "Create and start a VM from a JSON spec or VHDX file",
+		needsElevation: true,
+		needsHCS:       true,
+		setup:          cmdCreate,
+	})
+	register(&command{
+		name:     "list",
+		usage:    "[--format '{{.Id}} {{.State}}' | --format wide | --quiet] [--sort name|state|owner|id] [--type VirtualMachine|Container]",
+		summary:  "List all HCS compute systems",
+		needsHCS: true,
+		setup:    cmdList,
+	})
+	register(&command{
+		name:     "inspect",
+		usage:    "<vm-id> [--format '{{.State}}']",
+		summary:  "Show basic properties, guest status and created-with disks of a compute system",
+		needsHCS: true,
+		setup:    cmdInspect,
+	})
+	register(&command{
+		name:     "dump",
+		usage:    "<vm-id> [--out file.json] [--properties basic,stats,memory,devices,guest|all] [--query '{\"PropertyTypes\":[\"GuestConnection\"]}']",
+		summary:  "Dump system properties (memory, stats by default; --properties all for everything)",
+		needsHCS: true,
+		setup:    cmdDump,
+	})
+	register(&command{
+		name:           "stop",
+		usage:          "<vm-id> [--timeout 30] [--hibernate] [--force] [--dry-run] [--wait-stopped [--wait-timeout 60]]",
+		summary:        "Gracefully shut down a compute system",
+		needsElevation: true,
+		needsHCS:       true,
+		setup:          cmdStop,
+	})
+	register(&command{
+		name:     "wait",
+		usage:    "<vm-id> --state Stopped[,Paused...] [--timeout 120] [--async]",
+		summary:  "Block until a compute system reaches one of the given states",
+		needsHCS: true,
+		setup:    cmdWait,
+	})
+	register(&command{
+		name:           "kill",
+		usage:          "<vm-id> [--dry-run] [--wait-stopped [--wait-timeout 60]]",
+		summary:        "Forcibly terminate a compute system",
+		needsElevation: true,
+		needsHCS:       true,
+		setup:          cmdKill,
+	})
+	register(&command{
+		name:           "crash",
+		usage:          "<vm-id>",
+		summary:        "Force a guest crash so it writes a crash dump (guest must have dumps enabled)",
+		needsElevation: true,
+		needsHCS:       true,
+		setup:          cmdCrash,
+	})
+	register(&command{
+		name:     "export",
+		usage:    "<vm-id> [--out spec.json] [--relative]",
+		summary:  "Write the spec hcstool created a system from as a reusable spec",
+		needsHCS: true,
+		setup:    cmdExport,
+	})
+	register(&command{
+		name:           "import",
+		usage:          `--spec spec.json --disk-dir D:\vms [--gpu] [--name myvm]`,
+		summary:        "Create a VM from an exported spec, rebinding disks to a new directory",
+		needsElevation: true,
+		needsHCS:       true,
+		setup:          cmdImport,
+	})
+	register(&command{
+		name:           "clone",
+		usage:          "<vm-id> --disk-dir dir [--memory 4G] [--cpus N] [--gpu] [--new-name myvm] [--owner me] [--dry-run]",
+		summary:        "Create a VM with an hcstool-created system's configuration and copies of its disks",
+		needsElevation: true,
+		needsHCS:       true,
+		setup:          cmdClone,
+	})
+	register(&command{
+		name:     "console",
+		usage:    "<vm-id>",
+		summary:  "Open the VM's video console with vmconnect.exe",
+		needsHCS: true,
+		setup:    cmdConsole,
+	})
+	register(&command{
+		name:     "processes",
+		usage:    "<vm-id>",
+		summary:  "List processes running in the guest (where HCS reports them)",
+		needsHCS: true,
+		setup:    cmdProcesses,
+	})
+	register(&command{
+		name:           "grant",
+		usage:          "<vm-id> <path>...",
+		summary:        "Grant a VM access to host files (disks, ISOs)",
+		needsElevation: true,
+		needsHCS:       true,
+		setup:          cmdGrant(false),
+	})
+	register(&command{
+		name:           "revoke",
+		usage:          "<vm-id> <path>...",
+		summary:        "Revoke a VM's access to host files",
+		needsElevation: true,
+		needsHCS:       true,
+		setup:          cmdGrant(true),
+	})
+	register(&command{
+		name:     "stats",
+		usage:    "<vm-id> [--samples 5] [--interval 1s]",
+		summary:  "Sample CPU utilization and memory usage of a compute system",
+		needsHCS: true,
+		setup:    cmdStats,
+	})
+	register(&command{
+		name:           "attach-disk",
+		usage:          "<vm-id> --path disk.vhdx [--controller Primary] [--slot N] [--dry-run]",
+		summary:        "Hot-add a disk to a running VM, printing the slot it landed in",
+		needsElevation: true,
+		needsHCS:       true,
+		setup:          cmdAttachDisk,
+	})
+	register(&command{
+		name:           "swap-iso",
+		usage:          "<vm-id> [--controller Primary] --slot N (--path new.iso | --eject) [--dry-run]",
+		summary:        "Change or eject the ISO in a running VM's DVD drive",
+		needsElevation: true,
+		needsHCS:       true,
+		setup:          cmdSwapISO,
+	})
+	register(&command{
+		name:    "mkvhd",
+		usage:   "--path new.vhdx --size 40G [--dynamic] [--force]\n--path child.vhdx --parent base.vhdx [--force]",
+		summary: "Create a blank or differencing VHD(X) to use as a VM disk",
+		setup:   cmdMkvhd,
+	})
+	register(&command{
+		name:    "gpu-list",
+		usage:   "[--json] [--detect auto|interface|class]",
+		summary: "List display adapters and whether they look GPU-PV capable",
+		setup:   cmdGpuList,
+	})
+	register(&command{
+		name:    "switches",
+		usage:   "[--json]",
+		summary: "List HNS networks (virtual switches) with their IDs and types",
+		setup:   cmdSwitches,
+	})
+	register(&command{
+		name:           "service-set",
+		usage:          "--json '{...}'",
+		summary:        "Apply global HCS service settings (advanced)",
+		needsElevation: true,
+		needsHCS:       true,
+		setup:          cmdServiceSet,
+	})
+	register(&command{
+		name:     "diff",
+		usage:    "<vm-id-a> <vm-id-b> [--include-stats]",
+		summary:  "Compare the configuration of two compute systems",
+		needsHCS: true,
+		setup:    cmdDiff,
+	})
+	register(&command{
+		name:    "version",
+		usage:   "[--json]",
+		summary: "Print hcstool, Go, Windows and HCS schema versions for bug reports",
+		setup:   cmdVersion,
+	})
+}
+
+func cmdCreate(fs *flag.FlagSet) func(args []string) error {
+	specFile := fs.String("spec", "", "Path to HCS v2 JSON spec file")
+	specDir := fs.String("spec-dir", "", "Create one VM per *.json spec in this directory (named after the files)")
+	parallel := fs.Int("parallel", 1, "With --spec-dir, create up to N VMs concurrently")
+	specTemplate := fs.String("spec-template", "", "Path to a text/template spec rendered with --set values")
+	expandEnv := fs.Bool("expand-env", false, "Expand ${VAR} and %VAR% in --spec/--spec-dir files before parsing")
+	expandEnvAllowEmpty := fs.Bool("expand-env-allow-empty", false, "With --expand-env, expand undefined variables to \"\" instead of failing")
+	relaxed := fs.Bool("relaxed-json", false, "Allow // and /* */ comments and trailing commas in --spec/--spec-dir files")
+	setVars := keyValueFlag{}
+	fs.Var(setVars, "set", "Template value as key=value (repeatable, used with --spec-template)")
+	var vhdxPaths stringListFlag
+	fs.Var(&vhdxPaths, "vhdx", "Path to a VHDX file (quick-create mode, repeatable; the first one boots)")
+	diskType := fs.String("disk-type", "virtual", "Attachment type for --vhdx disks: virtual, physical (\\\\.\\PhysicalDriveN pass-through) or iso")
+	diskReadOnly := fs.Bool("read-only", false, "Attach the --vhdx disks read-only, e.g. a shared base image (quick-create mode)")
+	diskCacheMode := fs.String("cache-mode", "", "Caching for the --vhdx disks: uncached, cached or readonlycached (needs --read-only) (quick-create mode)")
+	var isoPaths stringListFlag
+	fs.Var(&isoPaths, "iso", "ISO to attach as a DVD drive after the --vhdx disks (quick-create mode, repeatable)")
+	bootOrder := fs.String("boot-order", "", "Comma-separated boot device order, e.g. dvd,disk (quick-create mode, default: disk)")
+	kernel := fs.String("kernel", "", "Direct-boot this Linux kernel instead of UEFI (quick-create mode, --vhdx optional)")
+	initrd := fs.String("initrd", "", "Initial ramdisk for --kernel")
+	cmdline := fs.String("cmdline", "", "Kernel command line for --kernel, e.g. \"console=ttyS0\"")
+	schema := fs.String("schema", "", "Spec SchemaVersion, e.g. 2.5 (quick-create mode, default: newest the host supports)")
+	secureBoot := fs.Bool("secure-boot", false, "Enable UEFI secure boot with the Microsoft Windows template (quick-create mode)")
+	tpm := fs.Bool("tpm", false, "Add a virtual TPM (quick-create mode, needs schema 2.4+)")
+	generation := fs.Int("generation", 2, "VM generation (quick-create mode); only 2 (UEFI) is supported, HCS has no legacy BIOS")
+	apic := fs.String("apic", "default", "APIC mode for older guests: default, legacy or x2apic (quick-create mode)")
+	rtc := fs.String("rtc", "local", "Whether the guest's real-time clock runs in local time or utc (quick-create mode)")
+	scsiControllers := fs.Int("scsi-controllers", 1, "Number of SCSI controllers to spread --vhdx disks across (quick-create mode, 1-4)")
+	memory := fs.String("memory", "2048", "Memory size, e.g. 2048, 2048M or 4G (quick-create mode, bare numbers are MB)")
+	ballooning := fs.Bool("memory-ballooning", false, "Enable hot/cold memory hints so the host reclaims memory the guest isn't using (quick-create mode)")
+	memoryBuffer := fs.Int("memory-buffer", 0, "Dynamic memory buffer, 5-2000 percent of the guest's usage kept assigned (quick-create mode, needs --memory-ballooning)")
+	memoryPriority := fs.Int("memory-priority", 0, "Dynamic memory priority, 0-10000; higher keeps memory longer under host pressure (quick-create mode, needs --memory-ballooning)")
+	cpuCount := fs.Int("cpus", 2, "Number of virtual CPUs (quick-create mode); 0 is a sentinel for all host logical processors, not zero CPUs")
+	cpuWeight := fs.Int("cpu-weight", 0, "Relative CPU scheduling weight, 0-10000 (quick-create mode, 0 = HCS default)")
+	cpuLimit := fs.Int("cpu-limit", 0, "CPU cap in 1/1000 of a percent, 0-100000 (quick-create mode, 0 = no limit)")
+	cpuReserve := fs.Int("cpu-reserve", 0, "Reserved CPU in 1/1000 of a percent, 0-100000 (quick-create mode)")
+	onReset := fs.String("on-reset", "", "Action when the guest resets (reboots, or restarts after a crash): stop or restart (default: the spec's StopOnReset; quick-create stops)")
+	var shareFlags stringListFlag
+	fs.Var(&shareFlags, "share", "Share a host directory over Plan9 as host=C:\\data[,name=data][,readonly] (repeatable)")
+	endpoint := fs.String("endpoint", "", "Attach a network adapter to this existing HNS endpoint (GUID); it is not created or deleted")
+	gpu := fs.Bool("gpu", false, "Enable GPU-PV passthrough")
+	gpuHotAdd := fs.Bool("gpu-hotadd", false, "Add GPU-PV adapters with a modify request after the VM starts instead of in the create spec")
+	var gpuInstances stringListFlag
+	fs.Var(&gpuInstances, "gpu-instance", "Assign this display adapter (instance ID from gpu-list) instead of every capable one; repeatable, implies --gpu unless --gpu-hotadd")
+	ignoreMissingGPU := fs.Bool("ignore-missing-gpu", false, "With --gpu or --gpu-hotadd, warn and create the VM without GPU-PV when no capable GPU is found")
+	gpuStrictFlag := fs.Bool("gpu-strict", false, "Fail if any display adapter can't be fully enumerated instead of skipping it")
+	name := fs.String("name", "", "Friendly name for the VM")
+	owner := fs.String("owner", "", "Owner for the VM (default $HCSTOOL_OWNER, then the spec's Owner, then hcstool)")
+	dryRun := fs.Bool("dry-run", false, "Print the generated spec without creating the VM")
+	summary := fs.Bool("summary", false, "With --dry-run, print a one-line summary instead of the spec")
+	count := fs.Int("count", 1, "Number of identical VMs to create (names get -1, -2, ... suffixes)")
+	events := fs.String("events", "text", "Progress output on stderr: text, or json for one lifecycle event object per line")
+	printJSON := fs.Bool("print-json", false, "Print {\"id\",\"name\",\"owner\"} as JSON instead of the bare VM ID")
+	keepACLs := fs.Bool("keep-acls", false, "Don't revoke granted VM access to disks if create fails")
+	id := fs.String("id", "", "Pin the compute system ID (GUID) instead of generating one")
+	postModify := fs.String("post-create-modify", "", "JSON file with a modify request (or an array of them) to apply once the VM has started")
+	onStart := fs.String("on-start", "", "Host command line to run (via cmd.exe) once the VM has started; HCSTOOL_VM_ID holds its ID")
+	onStartRequired := fs.Bool("on-start-required", false, "Fail and undo the create if the --on-start hook fails (default: warn)")
+	replace := fs.Bool("replace", false, "Terminate an existing system with the same --id, or the same --name, and the same owner right before creating (asks first)")
+	yes := fs.Bool("yes", false, "With --replace, don't ask for confirmation")
+	openExisting := fs.Bool("open-existing", false, "With --id, if that system already exists, start it if needed and report it instead of failing (warns if it differs from the spec hcstool saved for it, or was not created by hcstool)")
+	sddl := fs.String("sddl", "", "Security descriptor (SDDL) limiting who can open and control the VM, e.g. \"O:BAG:BAD:(A;;GA;;;BA)\"")
+	retries := fs.Int("retry", 0, "Retry create+start up to N times on transient HCS failures")
+	retryOn := fs.String("retry-on", "", "Comma-separated HRESULTs treated as transient (default: HCS connection/service/timeout errors)")
+
+	return func(args []string) error {
+		sources := 0
+		for _, src := range []string{*specFile, *specDir, *specTemplate, vhdxPaths.String() + *kernel} {
+			if src != "" {
+				sources++
+			}
+		}
+		if sources == 0 {
+			return usageErrorf("specify one of --spec, --spec-dir, --spec-template, --vhdx or --kernel")
+		}
+		if sources > 1 {
+			return fmt.Errorf("--spec, --spec-dir, --spec-template and --vhdx/--kernel are mutually exclusive")
+		}
+		if *specDir != "" && (*name != "" || *id != "" || *count > 1 || *dryRun) {
+			return fmt.Errorf("--spec-dir cannot be combined with --name, --id, --count or --dry-run")
+		}
+		if *gpu && *gpuHotAdd {
+			return fmt.Errorf("--gpu and --gpu-hotadd are mutually exclusive")
+		}
+		if len(gpuInstances) > 0 && !*gpuHotAdd {
+			*gpu = true
+		}
+		if *parallel < 1 {
+			return fmt.Errorf("--parallel must be at least 1")
+		}
+
+		if *count < 1 {
+			return fmt.Errorf("--count must be at least 1")
+		}
+		if *id != "" && *count > 1 {
+			return fmt.Errorf("--id cannot be combined with --count")
+		}
+		if *openExisting && *id == "" {
+			return fmt.Errorf("--open-existing requires --id")
+		}
+		if *replace {
+			switch {
+			case *id == "" && *name == "":
+				return usageErrorf("--replace needs --id or --name to find the system to replace")
+			case *openExisting:
+				return usageErrorf("--replace and --open-existing are mutually exclusive")
+			case *count > 1:
+				return usageErrorf("--replace cannot be combined with --count")
+			case *specDir != "":
+				return usageErrorf("--replace cannot be combined with --spec-dir")
+			}
+		} else if *yes {
+			return usageErrorf("--yes only applies to --replace")
+		}
+		if *retries < 0 {
+			return fmt.Errorf("--retry must not be negative")
+		}
+		var retryCodes map[uint32]bool
+		if *retryOn != "" {
+			codes, err := parseHRESULTList(*retryOn)
+			if err != nil {
+				return fmt.Errorf("--retry-on: %w", err)
+			}
+			retryCodes = codes
+		}
+
+		var postModifyReqs []ModifySettingRequest
+		if *postModify != "" {
+			reqs, err := readModifyFile(*postModify)
+			if err != nil {
+				return err
+			}
+			postModifyReqs = reqs
+		}
+		var endpointID string
+		if *endpoint != "" {
+			var err error
+			if endpointID, err = normalizeEndpointID(*endpoint); err != nil {
+				return usageErrorf("%v", err)
+			}
+			// An HNS endpoint backs one adapter of one VM at a time.
+			if *specDir != "" || *count > 1 {
+				return usageErrorf("--endpoint cannot be combined with --spec-dir or --count")
+			}
+		}
+		if *onStartRequired && *onStart == "" {
+			return usageErrorf("--on-start-required needs --on-start")
+		}
+		relaxedJSON = *relaxed
+		gpuStrict = *gpuStrictFlag
+		if gpuStrict && !*gpu && !*gpuHotAdd {
+			return usageErrorf("--gpu-strict needs --gpu or --gpu-hotadd")
+		}
+		if *ignoreMissingGPU && !*gpu && !*gpuHotAdd {
+			return usageErrorf("--ignore-missing-gpu needs --gpu or --gpu-hotadd")
+		}
+
+		switch *events {
+		case "text":
+		case "json":
+			eventsJSON = true
+		default:
+			return fmt.Errorf("invalid --events %q: expected text or json", *events)
+		}
+
+		var stopOnReset *bool
+		if *onReset != "" {
+			stop, ok := resetActions[strings.ToLower(*onReset)]
+			if !ok {
+				return fmt.Errorf("invalid --on-reset %q: expected stop or restart", *onReset)
+			}
+			stopOnReset = &stop
+		}
+
+		var shares []*Plan9Share
+		for _, f := range shareFlags {
+			share, err := parseShare(f)
+			if err != nil {
+				return err
+			}
+			shares = append(shares, share)
+		}
+
+		env := envExpansion{Enabled: *expandEnv, AllowEmpty: *expandEnvAllowEmpty}
+		var specJSON string
+		var baseDir string
+		var err error
+
+		if *specFile != "" {
+			specJSON, err = readSpecFile(*specFile, env)
+			if err != nil {
+				return err
+			}
+			baseDir = filepath.Dir(*specFile)
+		} else if *specTemplate != "" {
+			specJSON, err = renderSpecTemplate(*specTemplate, setVars)
+			if err != nil {
+				return err
+			}
+			baseDir = filepath.Dir(*specTemplate)
+		} else if *specDir != "" {
+			// Each spec is read by CreateFromSpecDir.
+		} else {
+			memoryMB, err := parseMemoryMB(*memory)
+			if err != nil {
+				return err
+			}
+			specJSON, err = buildSpecFromFlags(quickSpecOptions{
+				VhdxPaths:       vhdxPaths,
+				DiskType:        *diskType,
+				Access:          diskAccess{ReadOnly: *diskReadOnly, CacheMode: *diskCacheMode},
+				Schema:          *schema,
+				SecureBoot:      *secureBoot,
+				TPM:             *tpm,
+				ISOPaths:        isoPaths,
+				BootOrder:       splitList(*bootOrder),
+				Kernel:          *kernel,
+				Initrd:          *initrd,
+				KernelCmdline:   *cmdline,
+				ScsiControllers: *scsiControllers,
+				MemoryMB:        memoryMB,
+				Ballooning:      *ballooning,
+				MemoryBuffer:    *memoryBuffer,
+				MemoryPriority:  *memoryPriority,
+				CPUCount:        *cpuCount,
+				CPUWeight:       *cpuWeight,
+				CPULimit:        *cpuLimit,
+				CPUReserve:      *cpuReserve,
+				Generation:      *generation,
+				ApicMode:        *apic,
+				RTC:             *rtc,
+			}, *gpu, *ignoreMissingGPU, gpuInstances)
+			if err != nil {
+				return err
+			}
+			// GPU already injected by buildSpecFromFlags, don't inject again
+			*gpu = false
+		}
+
+		if *dryRun {
+			if *summary {
+				line, err := summarizeSpec(specJSON, *gpu || *gpuHotAdd)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(os.Stderr, line)
+				return nil
+			}
+			printSpec(specJSON)
+			return nil
+		}
+
+		opts := CreateOptions{
+			Name:             *name,
+			ID:               *id,
+			SDDL:             *sddl,
+			Owner:            *owner,
+			AddGPU:           *gpu,
+			HotAddGPU:        *gpuHotAdd,
+			IgnoreMissingGPU: *ignoreMissingGPU,
+			GPUInstances:     gpuInstances,
+			BaseDir:          baseDir,
+			KeepACLs:         *keepACLs,
+			PrintJSON:        *printJSON,
+			Retries:          *retries,
+			RetryOn:          retryCodes,
+			Shares:           shares,
+			StopOnReset:      stopOnReset,
+			OpenExisting:     *openExisting,
+			Replace:          *replace,
+			AssumeYes:        *yes,
+			Endpoint:         endpointID,
+			PostCreateModify: postModifyReqs,
+
+			OnStart:         *onStart,
+			OnStartRequired: *onStartRequired,
+		}
+		if *specDir != "" {
+			return CreateFromSpecDir(*specDir, opts, *parallel, env)
+		}
+		if *count > 1 {
+			return CreateCopies(specJSON, opts, *count)
+		}
+		return CreateAndStartVM(specJSON, opts)
+	}
+}
+
+func cmdList(fs *flag.FlagSet) func(args []string) error {
+	format := fs.String("format", "", "Render each entry with a Go template, e.g. '{{.Id}} {{.State}}', or \"wide\" for extra OS/MEMORY/UPTIME columns (memory and uptime are best-effort)")
+	sortBy := fs.String("sort", "name", "Sort by name, state, owner or id (ties broken by id)")
+	systemType := fs.String("type", "", "Only list systems of this type: VirtualMachine or Container")
+	var quiet bool
+	fs.BoolVar(&quiet, "quiet", false, "Print only IDs, one per line")
+	fs.BoolVar(&quiet, "q", false, "Shorthand for --quiet")
+
+	return func(args []string) error {
+		if quiet && *format != "" {
+			return fmt.Errorf("--quiet and --format are mutually exclusive")
+		}
+		if _, ok := enumSortKeys[strings.ToLower(*sortBy)]; !ok {
+			return usageErrorf("invalid --sort %q (expected name, state, owner or id)", *sortBy)
+		}
+		opts := ListOptions{Format: *format, Quiet: quiet, Sort: *sortBy}
+		if *systemType != "" {
+			t, err := canonicalSystemType(*systemType)
+			if err != nil {
+				return usageErrorf("%v", err)
+			}
+			opts.Type = t
+		}
+		if *format == "wide" {
+			opts.Format, opts.Wide = "", true
+		}
+		return ListVMs(opts)
+	}
+}
+
+func cmdInspect(fs *flag.FlagSet) func(args []string) error {
+	format := fs.String("format", "", "Render the properties with a Go template, e.g. '{{.State}}'")
+	selectVM := addVMSelector(fs)
+
+	return func(args []string) error {
+		id, _, err := selectVM(args)
+		if err != nil {
+			return err
+		}
+		return InspectVM(id, *format)
+	}
+}
+
+func cmdDump(fs *flag.FlagSet) func(args []string) error {
+	out := fs.String("out", "-", "Write properties to this file instead of stdout (- for stdout)")
+	query := fs.String("query", "", "Send this raw property query JSON instead of the --properties bundles")
+	properties := fs.String("properties", "", "Comma-separated property bundles: basic, stats, memory, devices, guest, all (default basic,stats,memory)")
+	selectVM := addVMSelector(fs)
+
+	return func(args []string) error {
+		id, _, err := selectVM(args)
+		if err != nil {
+			return err
+		}
+		if *query != "" && *properties != "" {
+			return usageErrorf("--query and --properties are mutually exclusive")
+		}
+		return DumpVM(id, *out, *query, splitList(*properties))
+	}
+}
+
+func cmdStop(fs *flag.FlagSet) func(args []string) error {
+	timeout := fs.Int("timeout", 30, "Shutdown timeout in seconds")
+	hibernate := fs.Bool("hibernate", false, "Hibernate the guest instead of shutting it down")
+	force := fs.Bool("force", false, "Force the shutdown even if the guest ignores the request")
+	dryRun := fs.Bool("dry-run", false, "Check the system and print what would happen without shutting it down")
+	waitGone := addWaitStopped(fs)
+	selectVM := addVMSelector(fs)
+
+	return func(args []string) error {
+		id, _, err := selectVM(args)
+		if err != nil {
+			return err
+		}
+
+		var opts *ShutdownOptions
+		if *hibernate || *force {
+			opts = &ShutdownOptions{
+				Mechanism: "IntegrationService",
+				Type:      "Shutdown",
+				Force:     *force,
+			}
+			if *hibernate {
+				opts.Type = "Hibernate"
+			}
+		}
+
+		ms, err := timeoutMs(*timeout)
+		if err != nil {
+			return usageErrorf("--timeout: %v", err)
+		}
+
+		if *dryRun {
+			desc, err := describeSystem(id)
+			if err != nil {
+				return err
+			}
+			verb := "shut down"
+			if *hibernate {
+				verb = "hibernate"
+			}
+			fmt.Fprintf(os.Stderr, "Would %s %s (timeout %ds, force %t).\n", verb, desc, *timeout, *force)
+			return nil
+		}
+
+		if err := StopVM(id, ms, opts); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Compute system shut down successfully.")
+		return waitGone(id)
+	}
+}
+
+func cmdWait(fs *flag.FlagSet) func(args []string) error {
+	states := fs.String("state", "", "Comma-separated target states, e.g. Stopped or Running,Paused")
+	timeout := fs.Int("timeout", 0, "Give up after this many seconds (0 = wait forever); exits 2 on timeout")
+	async := fs.Bool("async", false, "Wait for each state query with an HCS completion callback instead of a blocking wait")
+	selectVM := addVMSelector(fs)
+
+	return func(args []string) error {
+		if *async {
+			useAsyncEnumeration()
+		}
+		id, _, err := selectVM(args)
+		if err != nil {
+			return err
+		}
+		if *states == "" {
+			return usageErrorf("--state is required")
+		}
+		state, err := WaitForState(id, splitList(*states), time.Duration(*timeout)*time.Second)
+		if errors.Is(err, errWaitTimeout) {
+			printError(err)
+			return &exitError{code: exitWaitTimeout}
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(state)
+		return nil
+	}
+}
+
+func cmdKill(fs *flag.FlagSet) func(args []string) error {
+	dryRun := fs.Bool("dry-run", false, "Check the system and print what would happen without terminating it")
+	waitGone := addWaitStopped(fs)
+	selectVM := addVMSelector(fs)
+
+	return func(args []string) error {
+		id, _, err := selectVM(args)
+		if err != nil {
+			return err
+		}
+		if *dryRun {
+			desc, err := describeSystem(id)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Would terminate %s.\n", desc)
+			return nil
+		}
+		if err := KillVM(id); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Compute system terminated.")
+		return waitGone(id)
+	}
+}
+
+// addWaitStopped registers --wait-stopped and --wait-timeout on fs for stop
+// and kill. The returned func, called after the operation succeeds, waits
+// for the system to disappear when --wait-stopped is set, so its disks can
+// be deleted right away; otherwise it does nothing.
+func addWaitStopped(fs *flag.FlagSet) func(id string) error {
+	wait := fs.Bool("wait-stopped", false, "Wait until the system no longer exists before returning")
+	timeout := fs.Int("wait-timeout", 60, "Give up --wait-stopped after this many seconds (0 = wait forever)")
+	return func(id string) error {
+		if !*wait {
+			return nil
+		}
+		if *timeout < 0 {
+			return usageErrorf("--wait-timeout must not be negative")
+		}
+		if err := WaitForGone(id, time.Duration(*timeout)*time.Second); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Compute system is gone.")
+		return nil
+	}
+}
+
+func cmdProcesses(fs *flag.FlagSet) func(args []string) error {
+	selectVM := addVMSelector(fs)
+
+	return func(args []string) error {
+		id, _, err := selectVM(args)
+		if err != nil {
+			return err
+		}
+		return ListProcesses(id)
+	}
+}
+
+// cmdGrant builds the grant command, or revoke when revoke is set; the two
+// differ only in the helper they call.
+func cmdGrant(revoke bool) func(fs *flag.FlagSet) func(args []string) error {
+	return func(fs *flag.FlagSet) func(args []string) error {
+		selectVM := addVMSelector(fs)
+
+		return func(args []string) error {
+			id, paths, err := selectVM(args)
+			if err != nil {
+				return err
+			}
+			if len(paths) == 0 {
+				return usageErrorf("specify at least one path")
+			}
+			return SetVMAccess(id, paths, revoke)
+		}
+	}
+}
+
+func cmdStats(fs *flag.FlagSet) func(args []string) error {
+	samples := fs.Int("samples", 1, "Number of samples to take")
+	interval := fs.Duration("interval", time.Second, "Time between samples")
+	selectVM := addVMSelector(fs)
+
+	return func(args []string) error {
+		id, _, err := selectVM(args)
+		if err != nil {
+			return err
+		}
+		if *samples < 1 {
+			return usageErrorf("--samples must be at least 1")
+		}
+		if *interval <= 0 {
+			return usageErrorf("--interval must be positive")
+		}
+		return ShowStats(id, *samples, *interval)
+	}
+}
+
+func cmdAttachDisk(fs *flag.FlagSet) func(args []string) error {
+	diskPath := fs.String("path", "", "VHD(X) to attach")
+	controller := fs.String("controller", "Primary", "SCSI controller to attach to")
+	slot := fs.Int("slot", -1, "Attachment slot (default: the first slot free in the system's saved spec)")
+	readOnly := fs.Bool("read-only", false, "Attach the disk read-only")
+	cacheMode := fs.String("cache-mode", "", "Disk caching: uncached, cached or readonlycached (needs --read-only) (default: HCS default)")
+	dryRun := fs.Bool("dry-run", false, "Print the modify request without sending it")
+	selectVM := addVMSelector(fs)
+
+	return func(args []string) error {
+		id, _, err := selectVM(args)
+		if err != nil {
+			return err
+		}
+		if *diskPath == "" {
+			return usageErrorf("--path is required")
+		}
+		chosen, err := AttachDisk(id, *controller, *slot, *diskPath, diskAccess{ReadOnly: *readOnly, CacheMode: *cacheMode}, *dryRun)
+		if err != nil {
+			return err
+		}
+		if *dryRun {
+			return nil
+		}
+		fmt.Println(chosen)
+		return nil
+	}
+}
+
+func cmdSwapISO(fs *flag.FlagSet) func(args []string) error {
+	controller := fs.String("controller", "Primary", "SCSI controller holding the DVD drive")
+	slot := fs.Int("slot", -1, "Attachment slot of the DVD drive")
+	isoPath := fs.String("path", "", "ISO to insert")
+	eject := fs.Bool("eject", false, "Remove the media instead of inserting an ISO")
+	dryRun := fs.Bool("dry-run", false, "Print the modify request without sending it")
+	selectVM := addVMSelector(fs)
+
+	return func(args []string) error {
+		id, _, err := selectVM(args)
+		if err != nil {
+			return err
+		}
+		if *slot < 0 {
+			return usageErrorf("--slot is required")
+		}
+		if (*isoPath == "") == !*eject {
+			return usageErrorf("specify exactly one of --path or --eject")
+		}
+		return SwapISO(id, *controller, *slot, *isoPath, *eject, *dryRun)
+	}
+}
+
+func cmdCrash(fs *flag.FlagSet) func(args []string) error {
+	selectVM := addVMSelector(fs)
+
+	return func(args []string) error {
+		id, _, err := selectVM(args)
+		if err != nil {
+			return err
+		}
+		if err := CrashVM(id); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Crash requested; check the guest's dump location after it restarts.")
+		return nil
+	}
+}
+
+func cmdExport(fs *flag.FlagSet) func(args []string) error {
+	out := fs.String("out", "-", "Output spec file (- for stdout)")
+	relative := fs.Bool("relative", false, "Rewrite disk paths relative to the output file's directory")
+	selectVM := addVMSelector(fs)
+
+	return func(args []string) error {
+		id, _, err := selectVM(args)
+		if err != nil {
+			return err
+		}
+		return ExportVM(id, *out, *relative)
+	}
+}
+
+func cmdImport(fs *flag.FlagSet) func(args []string) error {
+	specFile := fs.String("spec", "", "Path to an exported HCS v2 JSON spec file")
+	diskDir := fs.String("disk-dir", "", "Directory holding the spec's disks on this host")
+	gpu := fs.Bool("gpu", false, "Enable GPU-PV passthrough")
+	name := fs.String("name", "", "Friendly name for the VM")
+	owner := fs.String("owner", "", "Owner for the VM (default $HCSTOOL_OWNER, then the spec's Owner, then hcstool)")
+	dryRun := fs.Bool("dry-run", false, "Print the rebound spec without creating the VM")
+
+	return func(args []string) error {
+		if *specFile == "" || *diskDir == "" {
+			return usageErrorf("--spec and --disk-dir are required")
+		}
+
+		specJSON, err := rebindSpec(*specFile, *diskDir)
+		if err != nil {
+			return err
+		}
+
+		if *dryRun {
+			printSpec(specJSON)
+			return nil
+		}
+
+		return CreateAndStartVM(specJSON, CreateOptions{Name: *name, Owner: *owner, AddGPU: *gpu})
+	}
+}
+
+func cmdClone(fs *flag.FlagSet) func(args []string) error {
+	diskDir := fs.String("disk-dir", "", "Directory holding copies of the source's disks")
+	memory := fs.String("memory", "", "Memory size, e.g. 4G (default: same as the source)")
+	cpus := fs.Int("cpus", 0, "Number of virtual CPUs (default: same as the source)")
+	gpu := fs.Bool("gpu", false, "Enable GPU-PV passthrough")
+	// --name selects the source VM (addVMSelector), so the clone's own
+	// friendly name needs a flag of its own.
+	newName := fs.String("new-name", "", "Friendly name for the new VM")
+	owner := fs.String("owner", "", "Owner for the VM (default $HCSTOOL_OWNER, then the source's Owner, then hcstool)")
+	dryRun := fs.Bool("dry-run", false, "Print the cloned spec without creating the VM")
+	selectVM := addVMSelector(fs)
+
+	return func(args []string) error {
+		id, _, err := selectVM(args)
+		if err != nil {
+			return err
+		}
+		if *diskDir == "" {
+			return usageErrorf("--disk-dir is required")
+		}
+		if *cpus < 0 {
+			return fmt.Errorf("--cpus must not be negative")
+		}
+		memoryMB := 0
+		if *memory != "" {
+			if memoryMB, err = parseMemoryMB(*memory); err != nil {
+				return err
+			}
+		}
+
+		specJSON, err := CloneSpec(id, *diskDir, memoryMB, *cpus)
+		if err != nil {
+			return err
+		}
+		if *dryRun {
+			printSpec(specJSON)
+			return nil
+		}
+		return CreateAndStartVM(specJSON, CreateOptions{Name: *newName, Owner: *owner, AddGPU: *gpu})
+	}
+}
+
+func cmdConsole(fs *flag.FlagSet) func(args []string) error {
+	selectVM := addVMSelector(fs)
+
+	return func(args []string) error {
+		id, _, err := selectVM(args)
+		if err != nil {
+			return err
+		}
+		return ConsoleVM(id)
+	}
+}
+
+func cmdMkvhd(fs *flag.FlagSet) func(args []string) error {
+	path := fs.String("path", "", "File to create (.vhdx, or .vhd for the legacy format)")
+	size := fs.String("size", "", "Disk size, e.g. 40G or 512M")
+	dynamic := fs.Bool("dynamic", false, "Create a dynamically expanding disk instead of a fixed one")
+	force := fs.Bool("force", false, "Replace the file if it already exists")
+	parent := fs.String("parent", "", "Create a differencing disk on top of this base VHD(X)")
+
+	return func(args []string) error {
+		if *path == "" {
+			return usageErrorf("--path is required")
+		}
+		var sizeMB int64
+		switch {
+		case *parent != "" && (*size != "" || *dynamic):
+			return usageErrorf("--parent disks take their size from the parent and are always dynamic; drop --size/--dynamic")
+		case *parent == "" && *size == "":
+			return usageErrorf("--size is required unless --parent is given")
+		case *size != "":
+			var err error
+			if sizeMB, err = parseSizeMB(*size); err != nil {
+				return fmt.Errorf("--size: %w", err)
+			}
+		}
+
+		created, err := CreateVHD(VHDOptions{Path: *path, SizeMB: sizeMB, Dynamic: *dynamic, Force: *force, Parent: *parent})
+		if err != nil {
+			return err
+		}
+		fmt.Println(created)
+		return nil
+	}
+}
+
+func cmdGpuList(fs *flag.FlagSet) func(args []string) error {
+	asJSON := fs.Bool("json", false, "Output as JSON")
+	detect := fs.String("detect", gpuDetectAuto, "How to decide GPU-PV capability: auto, interface (GPU-P device interface) or class (instance ID heuristic)")
+
+	return func(args []string) error {
+		switch *detect {
+		case gpuDetectAuto, gpuDetectInterface, gpuDetectClass:
+			gpuDetectMode = *detect
+		default:
+			return usageErrorf("invalid --detect %q (expected auto, interface or class)", *detect)
+		}
+		return ListGPUs(*asJSON)
+	}
+}
+
+func cmdSwitches(fs *flag.FlagSet) func(args []string) error {
+	asJSON := fs.Bool("json", false, "Output as JSON")
+
+	return func(args []string) error {
+		return ListSwitches(*asJSON)
+	}
+}
+
+func cmdServiceSet(fs *flag.FlagSet) func(args []string) error {
+	settings := fs.String("json", "", "HCS service settings document")
+
+	return func(args []string) error {
+		if *settings == "" {
+			return usageErrorf("--json is required")
+		}
+		if err := SetServiceSettings(*settings); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Service settings applied.")
+		return nil
+	}
+}
+
+func cmdDiff(fs *flag.FlagSet) func(args []string) error {
+	includeStats := fs.Bool("include-stats", false, "Also compare runtime statistics")
+
+	return func(args []string) error {
+		if len(args) < 2 {
+			return usageErrorf("diff needs two VM IDs")
+		}
+		idA, err := resolveVMID(args[0])
+		if err != nil {
+			return err
+		}
+		idB, err := resolveVMID(args[1])
+		if err != nil {
+			return err
+		}
+
+		differ, err := DiffVMs(idA, idB, *includeStats)
+		if err != nil {
+			return err
+		}
+		if differ {
+			return &exitError{code: 1}
+		}
+		return nil
+	}
+}
+
+func cmdVersion(fs *flag.FlagSet) func(args []string) error {
+	asJSON := fs.Bool("json", false, "Output as JSON")
+
+	return func(args []string) error {
+		return PrintVersion(*asJSON)
+	}
+}
+
+// splitList splits a comma-separated flag value, dropping blank entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseHRESULTList parses a comma-separated list of hex HRESULTs such as
+// "0x80370109,0x80370114".
+func parseHRESULTList(s string) (map[uint32]bool, error) {
+	codes := make(map[uint32]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(part), "0x"), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HRESULT %q", part)
+		}
+		codes[uint32(v)] = true
+	}
+	return codes, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// verbose enables extra diagnostics on stderr. Set by the global --verbose flag.
+var verbose bool
+
+// verbosef prints a diagnostic line to stderr when verbose mode is on.
+func verbosef(format string, args ...interface{}) {
+	if !verbose {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[verbose] "+format+"\n", args...)
+}
+
+// verboseHCS prints every create and modify document exactly as it is handed
+// to HCS. Set by the global --verbose-hcs flag.
+var verboseHCS bool
+
+// traceHCSDocument prints doc, pretty, to stderr when verboseHCS is on. call
+// names the HCS function about to receive it.
+func traceHCSDocument(call, target, doc string) {
+	if !verboseHCS {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[hcs] %s %s:\n%s\n", call, target, prettyJSON(doc))
+}
+
+// traceSpecSource prints a spec file's text as written, before relaxed
+// parsing strips its comments, when verboseHCS is on. The document HCS
+// receives is traced separately by traceHCSDocument.
+func traceSpecSource(path, text string) {
+	if !verboseHCS {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[hcs] spec source %s:\n%s\n", path, strings.TrimRight(text, "\r\n"))
+}
+
+// timed starts a timer for the named step and returns a func that logs the
+// elapsed duration in verbose mode. Typical use: defer timed("step")().
+func timed(what string) func() {
+	start := time.Now()
+	return func() {
+		verbosef("%s took %s", what, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// eventsJSON makes create report its progress as one JSON event per line on
+// stderr instead of text. Set by create --events json.
+var eventsJSON bool
+
+// progressEvent is one create lifecycle step in --events json mode.
+type progressEvent struct {
+	Event   string `json:"event"` // creating, grant, created, exists, hotadd, modify, hook, started, retry or failed
+	ID      string `json:"id,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Attempt int    `json:"attempt,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// progress reports a create step: ev as a JSON line in --events json mode,
+// otherwise the text given by format and args, if any.
+func progress(ev progressEvent, format string, args ...interface{}) {
+	if eventsJSON {
+		data, err := json.Marshal(ev)
+		if err == nil {
+			fmt.Fprintln(os.Stderr, string(data))
+		}
+		return
+	}
+	if format != "" {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
+
+// jsonErrors makes main report failures as a JSON object on stderr. Set by
+// the global --json-errors flag.
+var jsonErrors bool
+
+// errorReport is the --json-errors form of a command failure. Op, HResult
+// and Result are filled in when the failure came from an HCS call.
+type errorReport struct {
+	Op      string          `json:"op,omitempty"`
+	HResult string          `json:"hresult,omitempty"`
+	Message string          `json:"message"`
+	Result  json.RawMessage `json:"result,omitempty"`
+}
+
+// newErrorReport builds the report for err. The HCS result document is moved
+// out of the message into Result, kept as JSON when it parses.
+func newErrorReport(err error) errorReport {
+	r := errorReport{Message: err.Error()}
+	var hcsErr *HcsError
+	if !errors.As(err, &hcsErr) {
+		return r
+	}
+	r.Op = hcsErr.Op
+	r.HResult = fmt.Sprintf("0x%08x", hcsErr.HR)
+	if hcsErr.ResultJSON != "" {
+		r.Message = strings.TrimSuffix(r.Message, resultSuffix+hcsErr.ResultJSON)
+		if json.Valid([]byte(hcsErr.ResultJSON)) {
+			r.Result = json.RawMessage(hcsErr.ResultJSON)
+		} else {
+			r.Result, _ = json.Marshal(hcsErr.ResultJSON)
+		}
+	}
+	return r
+}
+
+// printError reports a command failure on stderr, as JSON with --json-errors.
+func printError(err error) {
+	if !jsonErrors {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+	data, _ := json.Marshal(newErrorReport(err))
+	fmt.Fprintln(os.Stderr, string(data))
+}
+
+// closeLog flushes and closes the --log-file tee; a no-op without one.
+var closeLog = func() {}
+
+// exit flushes the log file and exits. Use it instead of os.Exit.
+func exit(code int) {
+	closeLog()
+	os.Exit(code)
+}
+
+// startLogFile mirrors everything written to stderr into path, appending one
+// timestamped entry per line: plain text, or JSON lines with format "json".
+// os.Stderr is swapped for a pipe so every existing stderr write is captured;
+// closeLog must run before exit to drain it.
+func startLogFile(path, format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid --log-format %q: expected text or json", format)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	realStderr := os.Stderr
+	os.Stderr = w
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer f.Close()
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" {
+				io.WriteString(realStderr, line)
+				writeLogEntry(f, format, strings.TrimSuffix(line, "\n"))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	closeLog = func() {
+		os.Stderr = realStderr
+		w.Close()
+		<-done
+		closeLog = func() {}
+	}
+	return nil
+}
+
+// writeLogEntry appends one timestamped line to the log file.
+func writeLogEntry(w io.Writer, format, line string) {
+	now := time.Now().Format(time.RFC3339Nano)
+	if format == "json" {
+		data, _ := json.Marshal(struct {
+			Time string `json:"time"`
+			Msg  string `json:"msg"`
+		}{now, line})
+		fmt.Fprintf(w, "%s\n", data)
+		return
+	}
+	fmt.Fprintf(w, "%s %s\n", now, line)
+}
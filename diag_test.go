@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestNewErrorReport(t *testing.T) {
+	hcsErr := &HcsError{Op: "HcsCreateComputeSystem", HR: hcsESystemNotFound, ResultJSON: `{"Error":-1070137074}`}
+	err := fmt.Errorf("create compute system: %w", hcsErr)
+
+	data, _ := json.Marshal(newErrorReport(err))
+	want := `{"op":"HcsCreateComputeSystem","hresult":"0xc037010e","message":"create compute system: HcsCreateComputeSystem: HRESULT 0xc037010e (HCS compute system not found)","result":{"Error":-1070137074}}`
+	if string(data) != want {
+		t.Errorf("report =\n%s\nwant\n%s", data, want)
+	}
+
+	data, _ = json.Marshal(newErrorReport(&HcsError{Op: "HcsStartComputeSystem", HR: eTimeout, ResultJSON: "not json"}))
+	want = `{"op":"HcsStartComputeSystem","hresult":"0x800705b4","message":"HcsStartComputeSystem: HRESULT 0x800705b4 (Operation timed out)","result":"not json"}`
+	if string(data) != want {
+		t.Errorf("report =\n%s\nwant\n%s", data, want)
+	}
+
+	data, _ = json.Marshal(newErrorReport(fmt.Errorf("--count must be at least 1")))
+	if want := `{"message":"--count must be at least 1"}`; string(data) != want {
+		t.Errorf("report = %s, want %s", data, want)
+	}
+}
+
+// captureStderr returns what f writes to os.Stderr.
+func captureStderr(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stderr
+	os.Stderr = w
+	f()
+	os.Stderr = orig
+	w.Close()
+	out, _ := io.ReadAll(r)
+	r.Close()
+	return string(out)
+}
+
+// captureStdout returns what f writes to os.Stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = orig
+	w.Close()
+	out, _ := io.ReadAll(r)
+	r.Close()
+	return string(out)
+}
+
+func TestProgress(t *testing.T) {
+	defer func(orig bool) { eventsJSON = orig }(eventsJSON)
+
+	eventsJSON = false
+	got := captureStderr(t, func() {
+		progress(progressEvent{Event: "grant", Path: `C:\vm.vhdx`}, "  Granting VM access to %s", `C:\vm.vhdx`)
+		progress(progressEvent{Event: "created"}, "")
+	})
+	if want := "  Granting VM access to C:\\vm.vhdx\n"; got != want {
+		t.Errorf("text mode wrote %q, want %q", got, want)
+	}
+
+	eventsJSON = true
+	got = captureStderr(t, func() {
+		progress(progressEvent{Event: "grant", ID: "id", Path: `C:\vm.vhdx`}, "  Granting VM access to %s", `C:\vm.vhdx`)
+		progress(progressEvent{Event: "created", ID: "id"}, "")
+	})
+	want := `{"event":"grant","id":"id","path":"C:\\vm.vhdx"}` + "\n" + `{"event":"created","id":"id"}` + "\n"
+	if got != want {
+		t.Errorf("json mode wrote\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTraceHCSDocument(t *testing.T) {
+	defer func(v bool) { verboseHCS = v }(verboseHCS)
+
+	verboseHCS = false
+	if out := captureStderr(t, func() { traceHCSDocument("HcsCreateComputeSystem", "vm", `{"Owner":"x"}`) }); out != "" {
+		t.Errorf("printed %q with --verbose-hcs off", out)
+	}
+
+	verboseHCS = true
+	out := captureStderr(t, func() { traceHCSDocument("HcsCreateComputeSystem", "vm", `{"Owner":"x"}`) })
+	if want := "[hcs] HcsCreateComputeSystem vm:\n{\n  \"Owner\": \"x\"\n}\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// volatileKeys are property fields that differ between any two systems (or
+// between two queries of the same one) and are always masked by diff, at any
+// depth.
+var volatileKeys = map[string]bool{
+	"Id":                 true,
+	"RuntimeId":          true,
+	"SystemGUID":         true,
+	"Timestamp":          true,
+	"ContainerStartTime": true,
+	"Uptime100ns":        true,
+}
+
+// topLevelVolatileKeys are masked like volatileKeys, but only as fields of
+// the system itself: the system's Name is masked, while names within its
+// configuration (shares, adapters) are compared.
+var topLevelVolatileKeys = map[string]bool{
+	"Name": true,
+}
+
+// configurationKey is where diff puts a system's saved spec in its tree.
+const configurationKey = "Configuration"
+
+// statsKeys are runtime statistics property types, masked by diff unless
+// --include-stats is given. Like the property types themselves, they are
+// only matched at the top level.
+var statsKeys = map[string]bool{
+	"Statistics":         true,
+	"ProcessList":        true,
+	"Memory":             true,
+	"GuestMemory":        true,
+	"SharedMemoryRegion": true,
+	"ICHeartbeatStatus":  true,
+}
+
+// DiffVMs prints the path-level differences between two compute systems:
+// their properties, and under Configuration the specs hcstool saved when it
+// created them, since HCS does not report a system's configuration. Volatile
+// fields are masked, and statistics unless includeStats is set. It reports
+// whether any difference was found.
+func DiffVMs(idA, idB string, includeStats bool) (bool, error) {
+	a, err := loadPropertiesTree(idA)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", idA, err)
+	}
+	b, err := loadPropertiesTree(idB)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", idB, err)
+	}
+
+	// A configuration on one side only would show up as one big difference
+	// that says nothing about the systems, so it is compared only when both
+	// have one.
+	cfgA, err := configurationTree(idA)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", idA, err)
+	}
+	cfgB, err := configurationTree(idB)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", idB, err)
+	}
+	for _, side := range []struct {
+		id  string
+		cfg interface{}
+	}{{idA, cfgA}, {idB, cfgB}} {
+		if side.cfg == nil {
+			fmt.Fprintf(os.Stderr, "Note: %s has no spec saved by hcstool; its configuration (memory, disks, devices) is not compared.\n", side.id)
+		}
+	}
+	if cfgA != nil && cfgB != nil {
+		a[configurationKey] = cfgA
+		b[configurationKey] = cfgB
+	}
+
+	diffs := diffJSON("", a, b, diffMask(includeStats))
+	if len(diffs) == 0 {
+		fmt.Fprintln(os.Stderr, "No differences.")
+		return false, nil
+	}
+	fmt.Printf("--- %s\n+++ %s\n", idA, idB)
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	return true, nil
+}
+
+// diffMask returns the diffJSON mask of diff: volatile fields, and the
+// statistics property types unless includeStats is set.
+func diffMask(includeStats bool) func(path, key string) bool {
+	return func(path, key string) bool {
+		if path != "" {
+			return volatileKeys[key]
+		}
+		return volatileKeys[key] || topLevelVolatileKeys[key] || (!includeStats && statsKeys[key])
+	}
+}
+
+// loadPropertiesTree fetches a system's properties as a generic JSON tree.
+func loadPropertiesTree(id string) (map[string]interface{}, error) {
+	props, err := collectProperties(id, allPropertyTypes)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	if err := json.Unmarshal([]byte(props), &tree); err != nil {
+		return nil, fmt.Errorf("failed to parse properties: %w", err)
+	}
+	return tree, nil
+}
+
+// configurationTree returns a system's saved spec as a generic JSON tree, or
+// nil if it has none.
+func configurationTree(id string) (interface{}, error) {
+	spec := configuredSpec(id)
+	if spec == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize saved spec: %w", err)
+	}
+	var tree interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("failed to parse saved spec: %w", err)
+	}
+	return tree, nil
+}
+
+// diffJSON recursively compares two decoded JSON trees and returns one line
+// per differing path: "- path: a" (only in a), "+ path: b" (only in b) or
+// "~ path: a -> b" (changed). Object keys for which masked(path, key)
+// returns true are skipped, path being that of the object holding them ("" at
+// the top level).
+func diffJSON(path string, a, b interface{}, masked func(path, key string) bool) []string {
+	am, aIsObj := a.(map[string]interface{})
+	bm, bIsObj := b.(map[string]interface{})
+	if aIsObj && bIsObj {
+		keys := make(map[string]bool)
+		for k := range am {
+			keys[k] = true
+		}
+		for k := range bm {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			if !masked(path, k) {
+				sorted = append(sorted, k)
+			}
+		}
+		sort.Strings(sorted)
+
+		var out []string
+		for _, k := range sorted {
+			p := joinJSONPath(path, k)
+			av, inA := am[k]
+			bv, inB := bm[k]
+			switch {
+			case !inB:
+				out = append(out, fmt.Sprintf("- %s: %s", p, compactJSON(av)))
+			case !inA:
+				out = append(out, fmt.Sprintf("+ %s: %s", p, compactJSON(bv)))
+			default:
+				out = append(out, diffJSON(p, av, bv, masked)...)
+			}
+		}
+		return out
+	}
+
+	as, aIsArr := a.([]interface{})
+	bs, bIsArr := b.([]interface{})
+	if aIsArr && bIsArr {
+		var out []string
+		for i := 0; i < len(as) || i < len(bs); i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(bs):
+				out = append(out, fmt.Sprintf("- %s: %s", p, compactJSON(as[i])))
+			case i >= len(as):
+				out = append(out, fmt.Sprintf("+ %s: %s", p, compactJSON(bs[i])))
+			default:
+				out = append(out, diffJSON(p, as[i], bs[i], masked)...)
+			}
+		}
+		return out
+	}
+
+	ac, bc := compactJSON(a), compactJSON(b)
+	if ac == bc {
+		return nil
+	}
+	return []string{fmt.Sprintf("~ %s: %s -> %s", path, ac, bc)}
+}
+
+func joinJSONPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// compactJSON renders a decoded JSON value on a single line.
+func compactJSON(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return strings.TrimSpace(string(data))
+}
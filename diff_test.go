@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiffJSON(t *testing.T) {
+	decode := func(s string) interface{} {
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatalf("bad fixture %s: %v", s, err)
+		}
+		return v
+	}
+	a := decode(`{"Id":"a","State":"Running","Memory":{"Size":1},"Devices":{"Scsi":["x","y"]},"Gone":1}`)
+	b := decode(`{"Id":"b","State":"Stopped","Memory":{"Size":2},"Devices":{"Scsi":["x"]},"New":true}`)
+	masked := diffMask(false)
+
+	got := diffJSON("", a, b, masked)
+	want := []string{
+		`- Devices.Scsi[1]: "y"`,
+		`- Gone: 1`,
+		`+ New: true`,
+		`~ State: "Running" -> "Stopped"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffJSON =\n%q\nwant\n%q", got, want)
+	}
+
+	if d := diffJSON("", a, a, masked); len(d) != 0 {
+		t.Errorf("identical trees produced diffs: %q", d)
+	}
+}
+
+func TestDiffMaskConfiguration(t *testing.T) {
+	decode := func(s string) interface{} {
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatalf("bad fixture %s: %v", s, err)
+		}
+		return v
+	}
+	// The system's own Name and Memory statistics are masked; the same keys
+	// within the configuration are compared.
+	a := decode(`{"Name":"a","Memory":{"Size":1},"Configuration":{"VirtualMachine":{"ComputeTopology":{"Memory":{"SizeInMB":2048}},"Devices":{"Plan9":{"Shares":[{"Name":"data"}]}}}}}`)
+	b := decode(`{"Name":"b","Memory":{"Size":2},"Configuration":{"VirtualMachine":{"ComputeTopology":{"Memory":{"SizeInMB":4096}},"Devices":{"Plan9":{"Shares":[{"Name":"logs"}]}}}}}`)
+
+	got := diffJSON("", a, b, diffMask(false))
+	want := []string{
+		`~ Configuration.VirtualMachine.ComputeTopology.Memory.SizeInMB: 2048 -> 4096`,
+		`~ Configuration.VirtualMachine.Devices.Plan9.Shares[0].Name: "data" -> "logs"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffJSON =\n%q\nwant\n%q", got, want)
+	}
+
+	got = diffJSON("", a, b, diffMask(true))
+	if len(got) != 3 || got[2] != `~ Memory.Size: 1 -> 2` {
+		t.Errorf("with stats: diffJSON = %q, want the Memory statistics too", got)
+	}
+}
@@ -2,4 +2,4 @@ module hcstool
 
 go 1.25.3
 
-require golang.org/x/sys v0.41.0 // indirect
+require golang.org/x/sys v0.41.0
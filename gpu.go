@@ -1,7 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
@@ -9,8 +14,40 @@ import (
 
 // GpuDevice holds information about a GPU suitable for GPU-PV passthrough.
 type GpuDevice struct {
-	Name       string // Friendly device name
-	InstanceID string // Device instance path (e.g., PCI\VEN_10DE&DEV_...)
+	Name          string `json:"name"`          // Friendly device name
+	InstanceID    string `json:"instanceId"`    // Device instance path (e.g., PCI\VEN_10DE&DEV_...)
+	Manufacturer  string `json:"manufacturer"`  // Driver provider / manufacturer
+	Partitionable bool   `json:"partitionable"` // Best-effort GPU-PV capability guess
+
+	// Detection is how Partitionable was decided: "interface" when the
+	// adapter was checked for the GPU-P device interface, "heuristic" when
+	// it was guessed from the instance ID and manufacturer.
+	Detection string `json:"detection"`
+}
+
+// GPU-PV detection modes. gpuDetectAuto checks the GPU-P device interface
+// and falls back to the heuristic when no adapter registers it.
+const (
+	gpuDetectAuto      = "auto"
+	gpuDetectInterface = "interface"
+	gpuDetectClass     = "class"
+)
+
+// gpuDetectMode selects how enumerateGPUs decides Partitionable.
+var gpuDetectMode = gpuDetectAuto
+
+// gpuStrict makes enumerateGPUs fail on any adapter it can't fully read
+// instead of skipping or guessing, so --gpu never quietly assigns fewer
+// devices than are present. Set by create --gpu-strict.
+var gpuStrict bool
+
+// guidDevInterfaceGPUP is the device interface class partitionable GPUs
+// register; Hyper-V's partitionable GPU paths end in it.
+var guidDevInterfaceGPUP = windows.GUID{
+	Data1: 0x064092b3,
+	Data2: 0x625e,
+	Data3: 0x43bf,
+	Data4: [8]byte{0x9e, 0xb5, 0xdc, 0x84, 0x58, 0x97, 0xdd, 0x59},
 }
 
 // GUID_DEVCLASS_DISPLAY is the device setup class GUID for display adapters.
@@ -27,9 +64,21 @@ const (
 	digcfDeviceInterface = 0x00000010
 	spdrpFriendlyName    = 0x0000000C
 	spdrpDeviceDesc      = 0x00000000
+	spdrpMfg             = 0x0000000B
 )
 
-// SP_DEVINFO_DATA for SetupAPI
+// spDevinfoData is SetupAPI's SP_DEVINFO_DATA:
+//
+//	typedef struct _SP_DEVINFO_DATA {
+//	  DWORD     cbSize;
+//	  GUID      ClassGuid;
+//	  DWORD     DevInst;
+//	  ULONG_PTR Reserved;
+//	} SP_DEVINFO_DATA;
+//
+// Size must be set to exactly sizeof(SP_DEVINFO_DATA), 32 bytes on 64-bit
+// Windows and 28 on 32-bit, or SetupDiEnumDeviceInfo fails with
+// ERROR_INVALID_USER_BUFFER.
 type spDevinfoData struct {
 	Size      uint32
 	ClassGUID windows.GUID
@@ -37,6 +86,18 @@ type spDevinfoData struct {
 	Reserved  uintptr
 }
 
+// spDevinfoDataSize is sizeof(SP_DEVINFO_DATA): 24 bytes of fixed fields,
+// then Reserved, which is pointer-aligned and so needs no padding on either
+// architecture.
+const spDevinfoDataSize = 24 + unsafe.Sizeof(uintptr(0))
+
+// Compile-time check that spDevinfoData matches SP_DEVINFO_DATA: either
+// array length goes negative, and fails to build, if the sizes differ.
+var (
+	_ [unsafe.Sizeof(spDevinfoData{}) - spDevinfoDataSize]struct{}
+	_ [spDevinfoDataSize - unsafe.Sizeof(spDevinfoData{})]struct{}
+)
+
 var (
 	modSetupAPI = windows.NewLazySystemDLL("setupapi.dll")
 
@@ -47,38 +108,88 @@ var (
 	procSetupDiDestroyDeviceInfoList = modSetupAPI.NewProc("SetupDiDestroyDeviceInfoList")
 )
 
+// setupDiGetClassDevs, setupDiEnumDeviceInfo and setupDiDestroyDeviceInfoList
+// call SetupAPI; tests replace them to exercise the failure paths.
+var (
+	setupDiGetClassDevs          = procSetupDiGetClassDevsW.Call
+	setupDiEnumDeviceInfo        = procSetupDiEnumDeviceInfo.Call
+	setupDiDestroyDeviceInfoList = procSetupDiDestroyDeviceInfoList.Call
+)
+
+// enumDeviceInfoError describes a SetupDiEnumDeviceInfo failure at index i.
+// ERROR_INVALID_USER_BUFFER means the SP_DEVINFO_DATA size was rejected,
+// which would otherwise look like a host with no devices at all.
+func enumDeviceInfoError(i uint32, err error) error {
+	if err == windows.ERROR_INVALID_USER_BUFFER {
+		return fmt.Errorf("SetupDiEnumDeviceInfo(%d) rejected the %d-byte SP_DEVINFO_DATA: %w", i, spDevinfoDataSize, err)
+	}
+	return fmt.Errorf("SetupDiEnumDeviceInfo(%d) failed: %w", i, err)
+}
+
+// validDevInfoHandle reports whether a SetupDiGetClassDevs result is usable.
+// Failure is documented as INVALID_HANDLE_VALUE, but NULL is rejected too.
+func validDevInfoHandle(h uintptr) bool {
+	return h != 0 && h != uintptr(windows.InvalidHandle)
+}
+
 // enumerateGPUs finds all present display adapters using SetupAPI.
 func enumerateGPUs() ([]GpuDevice, error) {
+	err := findProcs(
+		procSetupDiGetClassDevsW,
+		procSetupDiEnumDeviceInfo,
+		procSetupDiGetDeviceInstanceIdW,
+		procSetupDiGetDeviceRegistryPropertyW,
+		procSetupDiDestroyDeviceInfoList,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GPU enumeration is not available on this system (setupapi.dll): %w", err)
+	}
+
 	// SetupDiGetClassDevs with DIGCF_PRESENT to get only present devices
-	hDevInfo, _, err := procSetupDiGetClassDevsW.Call(
+	hDevInfo, _, err := setupDiGetClassDevs(
 		uintptr(unsafe.Pointer(&guidDevClassDisplay)),
 		0, // Enumerator — NULL
 		0, // hwndParent — NULL
 		uintptr(digcfPresent),
 	)
-	if hDevInfo == uintptr(windows.InvalidHandle) {
+	if !validDevInfoHandle(hDevInfo) {
+		if errno, ok := err.(windows.Errno); !ok || errno == 0 {
+			return nil, fmt.Errorf("SetupDiGetClassDevs failed with handle %#x", hDevInfo)
+		}
 		return nil, fmt.Errorf("SetupDiGetClassDevs failed: %w", err)
 	}
-	defer procSetupDiDestroyDeviceInfoList.Call(hDevInfo)
+	defer setupDiDestroyDeviceInfoList(hDevInfo)
 
 	var gpus []GpuDevice
 
 	for i := uint32(0); ; i++ {
 		var devInfo spDevinfoData
-		devInfo.Size = uint32(unsafe.Sizeof(devInfo))
+		devInfo.Size = uint32(spDevinfoDataSize)
 
-		r1, _, _ := procSetupDiEnumDeviceInfo.Call(
+		r1, _, err := setupDiEnumDeviceInfo(
 			hDevInfo,
 			uintptr(i),
 			uintptr(unsafe.Pointer(&devInfo)),
 		)
 		if r1 == 0 {
-			break // No more devices
+			if err == windows.ERROR_NO_MORE_ITEMS {
+				break // No more devices
+			}
+			// A rejected buffer fails every index, so it is never skipped.
+			if gpuStrict || err == windows.ERROR_INVALID_USER_BUFFER {
+				return nil, enumDeviceInfoError(i, err)
+			}
+			verbosef("display adapter enumeration stopped: %v", enumDeviceInfoError(i, err))
+			break
 		}
 
 		// Get device instance ID
-		instanceID := getDeviceInstanceID(hDevInfo, &devInfo)
-		if instanceID == "" {
+		instanceID, err := getDeviceInstanceID(hDevInfo, &devInfo)
+		if err != nil {
+			if gpuStrict {
+				return nil, fmt.Errorf("display adapter %d: %w", i, err)
+			}
+			verbosef("skipping display adapter %d: %v", i, err)
 			continue
 		}
 
@@ -88,24 +199,91 @@ func enumerateGPUs() ([]GpuDevice, error) {
 			name = getDeviceRegistryString(hDevInfo, &devInfo, spdrpDeviceDesc)
 		}
 		if name == "" {
+			if gpuStrict {
+				return nil, fmt.Errorf("display adapter %s: cannot read its name", instanceID)
+			}
+			verbosef("display adapter %s has no name", instanceID)
 			name = "Unknown GPU"
 		}
 
+		mfg := getDeviceRegistryString(hDevInfo, &devInfo, spdrpMfg)
+
 		gpus = append(gpus, GpuDevice{
-			Name:       name,
-			InstanceID: instanceID,
+			Name:          name,
+			InstanceID:    instanceID,
+			Manufacturer:  mfg,
+			Partitionable: isPartitionableGPU(instanceID, mfg),
+			Detection:     "heuristic",
 		})
 	}
 
+	if gpuDetectMode == gpuDetectClass {
+		return gpus, nil
+	}
+	ids, err := gpupInterfaceInstances()
+	switch {
+	case err != nil && gpuDetectMode == gpuDetectInterface:
+		return nil, fmt.Errorf("GPU-P interface enumeration failed: %w", err)
+	case err != nil:
+		verbosef("GPU-P interface enumeration failed, guessing GPU-PV capability: %v", err)
+	case len(ids) == 0 && gpuDetectMode == gpuDetectAuto:
+		verbosef("no adapter registers the GPU-P interface, guessing GPU-PV capability")
+	default:
+		applyPartitionInterfaces(gpus, ids)
+	}
 	return gpus, nil
 }
 
+// gpupInterfaceInstances returns the upper-cased instance IDs of present
+// devices that expose the GPU-P device interface.
+func gpupInterfaceInstances() (map[string]bool, error) {
+	hDevInfo, _, err := setupDiGetClassDevs(
+		uintptr(unsafe.Pointer(&guidDevInterfaceGPUP)),
+		0,
+		0,
+		uintptr(digcfPresent|digcfDeviceInterface),
+	)
+	if !validDevInfoHandle(hDevInfo) {
+		return nil, fmt.Errorf("SetupDiGetClassDevs failed: %w", err)
+	}
+	defer setupDiDestroyDeviceInfoList(hDevInfo)
+
+	ids := make(map[string]bool)
+	for i := uint32(0); ; i++ {
+		var devInfo spDevinfoData
+		devInfo.Size = uint32(spDevinfoDataSize)
+		r1, _, err := setupDiEnumDeviceInfo(hDevInfo, uintptr(i), uintptr(unsafe.Pointer(&devInfo)))
+		if r1 == 0 {
+			if err != windows.ERROR_NO_MORE_ITEMS {
+				return nil, enumDeviceInfoError(i, err)
+			}
+			break
+		}
+		id, err := getDeviceInstanceID(hDevInfo, &devInfo)
+		if err != nil {
+			verbosef("skipping GPU-P interface device %d: %v", i, err)
+			continue
+		}
+		ids[strings.ToUpper(id)] = true
+	}
+	return ids, nil
+}
+
+// applyPartitionInterfaces decides Partitionable from the set of instance
+// IDs exposing the GPU-P interface, replacing the heuristic guess.
+func applyPartitionInterfaces(gpus []GpuDevice, ids map[string]bool) {
+	for i := range gpus {
+		gpus[i].Partitionable = ids[strings.ToUpper(gpus[i].InstanceID)]
+		gpus[i].Detection = "interface"
+	}
+}
+
 // getDeviceInstanceID retrieves the device instance ID string.
-func getDeviceInstanceID(hDevInfo uintptr, devInfo *spDevinfoData) string {
+func getDeviceInstanceID(hDevInfo uintptr, devInfo *spDevinfoData) (string, error) {
 	buf := make([]uint16, 512)
 	var requiredSize uint32
 
-	r1, _, _ := procSetupDiGetDeviceInstanceIdW.Call(
+	r1, _, err := procSetupDiGetDeviceInstanceIdW.Call(
 		hDevInfo,
 		uintptr(unsafe.Pointer(devInfo)),
 		uintptr(unsafe.Pointer(&buf[0])),
@@ -113,9 +291,9 @@ func getDeviceInstanceID(hDevInfo uintptr, devInfo *spDevinfoData) string {
 		uintptr(unsafe.Pointer(&requiredSize)),
 	)
 	if r1 == 0 {
-		return ""
+		return "", fmt.Errorf("SetupDiGetDeviceInstanceId failed: %w", err)
 	}
-	return windows.UTF16ToString(buf)
+	return windows.UTF16ToString(buf), nil
 }
 
 // getDeviceRegistryString retrieves a string device registry property.
@@ -138,3 +316,130 @@ func getDeviceRegistryString(hDevInfo uintptr, devInfo *spDevinfoData, property
 	}
 	return windows.UTF16ToString(buf)
 }
+
+// isPartitionableGPU guesses whether an adapter can back GPU-PV. Only
+// physical PCI adapters from a hardware vendor qualify; software adapters such
+// as Microsoft Basic Display (ROOT\BASICDISPLAY) or the Remote Display Adapter
+// (SWD\REMOTEDISPLAYENUM) cannot be partitioned.
+func isPartitionableGPU(instanceID, manufacturer string) bool {
+	if !strings.HasPrefix(strings.ToUpper(instanceID), `PCI\`) {
+		return false
+	}
+	mfg := strings.ToLower(manufacturer)
+	return !strings.Contains(mfg, "microsoft") && !strings.Contains(mfg, "standard display")
+}
+
+// errNoGPUs is returned by selectGPUs when the host has no GPU-PV capable
+// adapter at all, as opposed to one it failed to enumerate.
+var errNoGPUs = errors.New("no GPU-PV capable GPUs found")
+
+// selectGPUs enumerates display adapters and keeps only those that look
+// GPU-PV capable, warning about each adapter it skips. It fails if no capable
+// adapter remains so HCS is never handed an unusable device path.
+func selectGPUs() ([]GpuDevice, error) {
+	gpus, err := enumerateGPUs()
+	if err != nil {
+		return nil, fmt.Errorf("GPU enumeration failed: %w", err)
+	}
+
+	var capable []GpuDevice
+	for _, g := range gpus {
+		if !g.Partitionable {
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s (%s): not GPU-PV capable\n", g.Name, g.InstanceID)
+			continue
+		}
+		capable = append(capable, g)
+	}
+	if len(capable) == 0 {
+		return nil, fmt.Errorf("%w (%d display adapter(s) present)", errNoGPUs, len(gpus))
+	}
+
+	fmt.Fprintf(os.Stderr, "Found %d GPU(s) for GPU-PV:\n", len(capable))
+	for _, g := range capable {
+		fmt.Fprintf(os.Stderr, "  %s (%s)\n", g.Name, g.InstanceID)
+	}
+	return capable, nil
+}
+
+// selectGPUInstances picks the adapters named by instance ID (case-
+// insensitive) from the enumerated gpus, in the order given. Every ID must
+// be a present adapter and may be named once. An adapter that doesn't look
+// GPU-PV capable is still assigned, with a warning, since the capability
+// check is only a guess.
+func selectGPUInstances(gpus []GpuDevice, ids []string) ([]GpuDevice, error) {
+	byID := make(map[string]GpuDevice, len(gpus))
+	for _, g := range gpus {
+		byID[strings.ToUpper(g.InstanceID)] = g
+	}
+
+	seen := make(map[string]bool, len(ids))
+	var chosen []GpuDevice
+	var missing []string
+	for _, id := range ids {
+		key := strings.ToUpper(id)
+		if seen[key] {
+			return nil, fmt.Errorf("--gpu-instance %s given more than once", id)
+		}
+		seen[key] = true
+		g, ok := byID[key]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		if !g.Partitionable {
+			fmt.Fprintf(os.Stderr, "Warning: %s (%s) doesn't look GPU-PV capable; assigning it anyway\n", g.Name, g.InstanceID)
+		}
+		chosen = append(chosen, g)
+	}
+	if len(missing) > 0 {
+		present := make([]string, len(gpus))
+		for i, g := range gpus {
+			present[i] = g.InstanceID
+		}
+		return nil, fmt.Errorf("no present display adapter with instance ID %s (present: %s); see gpu-list",
+			strings.Join(missing, ", "), orDash(strings.Join(present, ", ")))
+	}
+	return chosen, nil
+}
+
+// ListGPUs prints the display adapters enumerateGPUs finds, as a table or JSON.
+func ListGPUs(asJSON bool) error {
+	gpus, err := enumerateGPUs()
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		type gpuEntry struct {
+			Index int `json:"index"`
+			GpuDevice
+		}
+		entries := make([]gpuEntry, 0, len(gpus))
+		for i, g := range gpus {
+			entries = append(entries, gpuEntry{Index: i, GpuDevice: g})
+		}
+		out, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	if len(gpus) == 0 {
+		fmt.Println("No display adapters found.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tGPU-PV\tNAME\tINSTANCE ID")
+	for i, g := range gpus {
+		pv := "no"
+		if g.Partitionable {
+			pv = "yes"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", i, pv, g.Name, g.InstanceID)
+	}
+	w.Flush()
+	return nil
+}
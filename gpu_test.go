@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestEnumerateGPUsBadHandle(t *testing.T) {
+	if err := procSetupDiGetClassDevsW.Find(); err != nil {
+		t.Skipf("setupapi.dll not available: %v", err)
+	}
+	orig := setupDiGetClassDevs
+	defer func() { setupDiGetClassDevs = orig }()
+
+	for _, tc := range []struct {
+		name   string
+		handle uintptr
+		errno  windows.Errno
+	}{
+		{"null", 0, windows.ERROR_INVALID_PARAMETER},
+		{"invalid", uintptr(windows.InvalidHandle), windows.ERROR_INVALID_FLAGS},
+		{"null without last error", 0, 0},
+	} {
+		setupDiGetClassDevs = func(...uintptr) (uintptr, uintptr, error) {
+			return tc.handle, 0, tc.errno
+		}
+		gpus, err := enumerateGPUs()
+		if err == nil {
+			t.Errorf("%s handle: got %d GPUs, want an error", tc.name, len(gpus))
+			continue
+		}
+		if tc.errno != 0 && !errors.Is(err, tc.errno) {
+			t.Errorf("%s handle: error %q does not wrap %v", tc.name, err, tc.errno)
+		}
+	}
+}
+
+func TestEnumerateGPUsEnumDeviceInfoError(t *testing.T) {
+	if err := procSetupDiGetClassDevsW.Find(); err != nil {
+		t.Skipf("setupapi.dll not available: %v", err)
+	}
+	origGet, origEnum, origDestroy := setupDiGetClassDevs, setupDiEnumDeviceInfo, setupDiDestroyDeviceInfoList
+	defer func() {
+		setupDiGetClassDevs, setupDiEnumDeviceInfo, setupDiDestroyDeviceInfoList = origGet, origEnum, origDestroy
+		gpuStrict = false
+	}()
+	setupDiGetClassDevs = func(...uintptr) (uintptr, uintptr, error) { return 1, 0, nil }
+	setupDiDestroyDeviceInfoList = func(...uintptr) (uintptr, uintptr, error) { return 1, 0, nil }
+
+	for _, tc := range []struct {
+		errno   windows.Errno
+		strict  bool
+		wantErr bool
+	}{
+		// A rejected SP_DEVINFO_DATA must never pass for "no adapters".
+		{windows.ERROR_INVALID_USER_BUFFER, false, true},
+		{windows.ERROR_INVALID_PARAMETER, true, true},
+		{windows.ERROR_INVALID_PARAMETER, false, false},
+		{windows.ERROR_NO_MORE_ITEMS, true, false},
+	} {
+		gpuStrict = tc.strict
+		setupDiEnumDeviceInfo = func(...uintptr) (uintptr, uintptr, error) { return 0, 0, tc.errno }
+		gpus, err := enumerateGPUs()
+		if tc.wantErr {
+			if !errors.Is(err, tc.errno) {
+				t.Errorf("%v (strict=%v): error %v does not wrap it", tc.errno, tc.strict, err)
+			}
+			continue
+		}
+		if err != nil || len(gpus) != 0 {
+			t.Errorf("%v (strict=%v): got %d GPUs, %v; want none and no error", tc.errno, tc.strict, len(gpus), err)
+		}
+	}
+}
+
+func TestApplyPartitionInterfaces(t *testing.T) {
+	gpus := []GpuDevice{
+		{InstanceID: `PCI\VEN_10DE&DEV_2684\4&1`, Partitionable: true, Detection: "heuristic"},
+		{InstanceID: `PCI\VEN_1002&DEV_73BF\4&2`, Partitionable: true, Detection: "heuristic"},
+		{InstanceID: `ROOT\BASICDISPLAY\0000`, Detection: "heuristic"},
+	}
+	applyPartitionInterfaces(gpus, map[string]bool{`PCI\VEN_10DE&DEV_2684\4&1`: true})
+
+	for i, want := range []bool{true, false, false} {
+		if gpus[i].Partitionable != want || gpus[i].Detection != "interface" {
+			t.Errorf("gpu %d: partitionable=%v detection=%q, want %v via interface", i, gpus[i].Partitionable, gpus[i].Detection, want)
+		}
+	}
+}
+
+func TestSelectGPUInstances(t *testing.T) {
+	gpus := []GpuDevice{
+		{Name: "A", InstanceID: `PCI\VEN_10DE&DEV_2684\4&1`, Partitionable: true},
+		{Name: "B", InstanceID: `PCI\VEN_10DE&DEV_2684\4&2`, Partitionable: true},
+		{Name: "Basic", InstanceID: `ROOT\BASICDISPLAY\0000`},
+	}
+
+	chosen, err := selectGPUInstances(gpus, []string{`pci\ven_10de&dev_2684\4&2`, `PCI\VEN_10DE&DEV_2684\4&1`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chosen) != 2 || chosen[0].Name != "B" || chosen[1].Name != "A" {
+		t.Errorf("chosen = %+v, want B then A", chosen)
+	}
+
+	for _, ids := range [][]string{
+		{`PCI\VEN_1002&DEV_73BF\4&9`},                              // not present
+		{`PCI\VEN_10DE&DEV_2684\4&1`, `pci\ven_10de&dev_2684\4&1`}, // named twice
+	} {
+		if _, err := selectGPUInstances(gpus, ids); err == nil {
+			t.Errorf("%q: expected an error", ids)
+		}
+	}
+}
+
+// stubNoGPUHost makes GPU enumeration find no display adapters for the rest
+// of the test.
+func stubNoGPUHost(t *testing.T) {
+	t.Helper()
+	if err := procSetupDiGetClassDevsW.Find(); err != nil {
+		t.Skipf("setupapi.dll not available: %v", err)
+	}
+	origGet, origEnum, origDestroy := setupDiGetClassDevs, setupDiEnumDeviceInfo, setupDiDestroyDeviceInfoList
+	t.Cleanup(func() {
+		setupDiGetClassDevs, setupDiEnumDeviceInfo, setupDiDestroyDeviceInfoList = origGet, origEnum, origDestroy
+	})
+	setupDiGetClassDevs = func(...uintptr) (uintptr, uintptr, error) { return 1, 0, nil }
+	setupDiEnumDeviceInfo = func(...uintptr) (uintptr, uintptr, error) { return 0, 0, windows.ERROR_NO_MORE_ITEMS }
+	setupDiDestroyDeviceInfoList = func(...uintptr) (uintptr, uintptr, error) { return 1, 0, nil }
+}
+
+func TestSelectCreateGPUsWithoutGPUs(t *testing.T) {
+	stubNoGPUHost(t)
+
+	// --spec: the GPUs are injected into (or hot-added to) the given spec.
+	for _, opts := range []CreateOptions{{AddGPU: true}, {HotAddGPU: true}} {
+		spec := &ComputeSystemSpec{VirtualMachine: &VirtualMachineSpec{}}
+		if _, err := applyCreateGPUs(spec, opts); !errors.Is(err, errNoGPUs) {
+			t.Errorf("--spec %+v: err = %v, want errNoGPUs", opts, err)
+		}
+
+		opts.IgnoreMissingGPU = true
+		var postStart []ModifySettingRequest
+		var err error
+		stderr := captureStderr(t, func() { postStart, err = applyCreateGPUs(spec, opts) })
+		if err != nil || len(postStart) != 0 || spec.VirtualMachine.Devices != nil {
+			t.Errorf("--spec %+v: got %v, %+v, devices %+v; want no GPUs and no error", opts, err, postStart, spec.VirtualMachine.Devices)
+		}
+		if !strings.Contains(stderr, "without GPU-PV") {
+			t.Errorf("--spec %+v: no warning, stderr %q", opts, stderr)
+		}
+
+		// Named adapters must exist even with IgnoreMissingGPU.
+		opts.GPUInstances = []string{`PCI\VEN_10DE&DEV_2204\4&1`}
+		if _, err := applyCreateGPUs(spec, opts); err == nil || errors.Is(err, errNoGPUs) {
+			t.Errorf("--spec %+v: err = %v, want a missing adapter error", opts, err)
+		}
+	}
+
+	// Quick-create: the GPUs go into the spec built from the flags.
+	origService := getServiceProperties
+	t.Cleanup(func() { getServiceProperties = origService })
+	getServiceProperties = func(string) (string, error) { return "", errors.New("no HCS in tests") }
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("boot.vhdx", append([]byte(vhdxSignature), make([]byte, 512)...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	quick := quickSpecOptions{VhdxPaths: []string{"boot.vhdx"}, MemoryMB: 2048, CPUCount: 2}
+
+	if _, err := buildSpecFromFlags(quick, true, false, nil); !errors.Is(err, errNoGPUs) {
+		t.Errorf("quick-create: err = %v, want errNoGPUs", err)
+	}
+	var specJSON string
+	var err error
+	captureStderr(t, func() { specJSON, err = buildSpecFromFlags(quick, true, true, nil) })
+	if err != nil {
+		t.Fatalf("quick-create with IgnoreMissingGPU: %v", err)
+	}
+	var spec ComputeSystemSpec
+	if err := json.Unmarshal([]byte(specJSON), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if d := spec.VirtualMachine.Devices; d == nil || len(d.VirtualPci) != 0 {
+		t.Errorf("quick-create with IgnoreMissingGPU: devices %+v, want no VirtualPci", d)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// guestPropertyTypes are queried on top of the basic properties so inspect
+// can report whether the guest booted and its integration services respond.
+var guestPropertyTypes = []string{"GuestConnection", "ICHeartbeatStatus"}
+
+// GuestInfo is the guest OS and integration status surfaced by inspect.
+// Fields the host didn't report (no integration services, guest not booted
+// yet) are left empty and omitted from output.
+type GuestInfo struct {
+	RuntimeOsType   string `json:",omitempty"`
+	OsName          string `json:",omitempty"`
+	OsVersion       string `json:",omitempty"`
+	ProtocolVersion uint32 `json:",omitempty"`
+	Heartbeat       string `json:",omitempty"`
+	Shutdown        string `json:",omitempty"`
+	TimeSync        string `json:",omitempty"`
+}
+
+// extractGuestInfo picks the guest fields out of a properties document. HCS
+// reports them in different places depending on the build and guest, so each
+// field is looked up at every known location. Returns nil if none were found.
+func extractGuestInfo(props map[string]interface{}) *GuestInfo {
+	conn, _ := props["GuestConnectionInfo"].(map[string]interface{})
+	caps, _ := conn["GuestDefinedCapabilities"].(map[string]interface{})
+	osInfo := firstMap(conn["GuestOsInfo"], caps["GuestOsInfo"], props["GuestOsInfo"])
+	ics := firstMap(props["IntegrationComponents"], caps["IntegrationComponents"])
+
+	g := &GuestInfo{
+		RuntimeOsType: stringValue(props["RuntimeOsType"]),
+		OsName:        stringValue(osInfo["OsName"]),
+		OsVersion:     stringValue(osInfo["OsVersion"]),
+		Heartbeat:     firstString(props["ICHeartbeatStatus"], ics["Heartbeat"]),
+		Shutdown:      stringValue(ics["Shutdown"]),
+		TimeSync:      stringValue(ics["TimeSync"]),
+	}
+	if g.OsVersion == "" {
+		// Older guests report the version as discrete numbers.
+		if major, ok := osInfo["MajorVersion"].(float64); ok {
+			g.OsVersion = fmt.Sprintf("%v.%v.%v", major, osInfo["MinorVersion"], osInfo["BuildNumber"])
+		}
+	}
+	if v, ok := conn["ProtocolVersion"].(float64); ok {
+		g.ProtocolVersion = uint32(v)
+	}
+
+	if *g == (GuestInfo{}) {
+		return nil
+	}
+	return g
+}
+
+// firstMap returns the first of vs that is a JSON object, or nil.
+func firstMap(vs ...interface{}) map[string]interface{} {
+	for _, v := range vs {
+		if m, ok := v.(map[string]interface{}); ok {
+			return m
+		}
+	}
+	return nil
+}
+
+// firstString returns the first non-empty stringValue of vs.
+func firstString(vs ...interface{}) string {
+	for _, v := range vs {
+		if s := stringValue(v); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// stringValue renders a JSON scalar as a string. Status objects such as
+// {"Status":"Ok"} collapse to their Status field; anything else is "".
+func stringValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case bool:
+		return fmt.Sprint(v)
+	case float64:
+		return fmt.Sprint(v)
+	case map[string]interface{}:
+		return stringValue(v["Status"])
+	}
+	return ""
+}
+
+// ProcessDetails is one entry of the HCS ProcessList property.
+type ProcessDetails struct {
+	ProcessId                    uint32 `json:"ProcessId"`
+	ImageName                    string `json:"ImageName"`
+	UserTime100ns                uint64 `json:"UserTime100ns"`
+	KernelTime100ns              uint64 `json:"KernelTime100ns"`
+	MemoryCommitBytes            uint64 `json:"MemoryCommitBytes"`
+	MemoryWorkingSetPrivateBytes uint64 `json:"MemoryWorkingSetPrivateBytes"`
+}
+
+// ListProcesses prints the processes running in a compute system's guest.
+// HCS only reports ProcessList for system types with guest process tracking
+// (containers, and VMs whose guest agent supports it); for anything else a
+// "not supported" error is returned.
+func ListProcesses(id string) error {
+	sys, err := openComputeSystem(id, accessRead)
+	if err != nil {
+		return err
+	}
+	defer closeComputeSystem(sys)
+
+	procs, err := processList(getComputeSystemPropertiesQuery(sys, buildPropertyQuery([]string{"ProcessList"})))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tNAME\tCPU TIME\tPRIVATE WS\tCOMMIT")
+	for _, p := range procs {
+		cpu := time.Duration(p.UserTime100ns+p.KernelTime100ns) * 100
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", p.ProcessId, p.ImageName,
+			cpu.Truncate(time.Millisecond), formatMB(p.MemoryWorkingSetPrivateBytes), formatMB(p.MemoryCommitBytes))
+	}
+	return w.Flush()
+}
+
+// processList extracts the ProcessList property from the result of a
+// ProcessList query. A query refused with ERROR_NOT_SUPPORTED, or answered
+// without the property, means the system type does not track guest
+// processes; any other query failure is returned as is.
+func processList(resultJSON string, qerr error) ([]ProcessDetails, error) {
+	var props struct {
+		SystemType  string
+		ProcessList []ProcessDetails
+	}
+	if qerr != nil {
+		if !isHRESULT(qerr, eNotSupported) {
+			return nil, qerr
+		}
+		verbosef("ProcessList query failed: %v", qerr)
+	} else if err := json.Unmarshal([]byte(resultJSON), &props); err != nil {
+		return nil, fmt.Errorf("failed to parse process list: %w", err)
+	}
+	if props.ProcessList == nil {
+		systemType := props.SystemType
+		if systemType == "" {
+			systemType = "this system type"
+		}
+		return nil, fmt.Errorf("process listing is not supported for %s", systemType)
+	}
+	return props.ProcessList, nil
+}
+
+// formatMB renders a byte count in MB with one decimal.
+func formatMB(bytes uint64) string {
+	return fmt.Sprintf("%.1f MB", float64(bytes)/(1<<20))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExtractGuestInfo(t *testing.T) {
+	var props map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"RuntimeOsType": "Windows",
+		"GuestConnectionInfo": {
+			"ProtocolVersion": 4,
+			"GuestOsInfo": {"OsName": "Windows 11 Pro", "MajorVersion": 10, "MinorVersion": 0, "BuildNumber": 22631}
+		},
+		"ICHeartbeatStatus": {"Status": "Ok"},
+		"IntegrationComponents": {"Shutdown": "Ok"}
+	}`), &props)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := extractGuestInfo(props)
+	want := GuestInfo{
+		RuntimeOsType:   "Windows",
+		OsName:          "Windows 11 Pro",
+		OsVersion:       "10.0.22631",
+		ProtocolVersion: 4,
+		Heartbeat:       "Ok",
+		Shutdown:        "Ok",
+	}
+	if got == nil || *got != want {
+		t.Errorf("extractGuestInfo = %+v, want %+v", got, want)
+	}
+
+	if got := extractGuestInfo(map[string]interface{}{"State": "Running"}); got != nil {
+		t.Errorf("extractGuestInfo without guest fields = %+v, want nil", got)
+	}
+}
+
+func TestProcessList(t *testing.T) {
+	procs, err := processList(`{"SystemType":"Container","ProcessList":[{"ProcessId":4,"ImageName":"System"}]}`, nil)
+	if err != nil || len(procs) != 1 || procs[0].ImageName != "System" {
+		t.Errorf("processList = %+v, %v; want the System process", procs, err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		resultJSON string
+		qerr       error
+	}{
+		{"not supported", "", &HcsError{Op: "HcsGetComputeSystemProperties", HR: eNotSupported}},
+		{"no property", `{"SystemType":"VirtualMachine"}`, nil},
+	} {
+		if _, err := processList(tc.resultJSON, tc.qerr); err == nil || !strings.Contains(err.Error(), "not supported") {
+			t.Errorf("%s: err = %v, want a not supported error", tc.name, err)
+		}
+	}
+
+	denied := &HcsError{Op: "HcsGetComputeSystemProperties", HR: eAccessDenied}
+	if _, err := processList("", denied); !errors.Is(err, denied) {
+		t.Errorf("access denied: err = %v, want the query error as is", err)
+	}
+}
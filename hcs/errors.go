@@ -0,0 +1,146 @@
+package hcs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Well-known HRESULTs.
+const (
+	ESystemNotFound       = 0xc037010e
+	ESystemAlreadyExists  = 0xc037010f
+	EHypervisorNotPresent = 0xc0351000
+	EAccessDenied         = 0x80070005
+	ETimeout              = 0x800705b4 // HRESULT_FROM_WIN32(ERROR_TIMEOUT)
+	ENotSupported         = 0x80070032 // HRESULT_FROM_WIN32(ERROR_NOT_SUPPORTED)
+	ENotFound             = 0x80070490 // HRESULT_FROM_WIN32(ERROR_NOT_FOUND)
+)
+
+// TransientHRESULTs are failures worth retrying: the HCS service or its
+// connection was briefly unavailable or an operation timed out under load.
+var TransientHRESULTs = map[uint32]bool{
+	0x80370108: true, // HCS_E_CONNECT_FAILED
+	0x80370109: true, // HCS_E_CONNECTION_TIMEOUT
+	0x8037010a: true, // HCS_E_CONNECTION_CLOSED
+	0x80370114: true, // HCS_E_SERVICE_NOT_AVAILABLE
+	0x80370118: true, // HCS_E_OPERATION_TIMEOUT
+	0x8037011e: true, // HCS_E_SERVICE_DISCONNECT
+	ETimeout:   true,
+}
+
+// IsTransient reports whether err is an *Error whose HRESULT is in codes.
+func IsTransient(err error, codes map[uint32]bool) bool {
+	var hcsErr *Error
+	return errors.As(err, &hcsErr) && codes[hcsErr.HR]
+}
+
+// IsHRESULT reports whether err is an *Error with the given HRESULT.
+func IsHRESULT(err error, hr uint32) bool {
+	var hcsErr *Error
+	return errors.As(err, &hcsErr) && hcsErr.HR == hr
+}
+
+// hresultMessages maps known HRESULT codes to human-readable messages.
+var hresultMessages = map[uint32]string{
+	ESystemNotFound:       "HCS compute system not found",
+	ESystemAlreadyExists:  "HCS compute system already exists",
+	EHypervisorNotPresent: "Hypervisor is not present — enable Hyper-V",
+	EAccessDenied:         "Access denied — run as Administrator",
+	ETimeout:              "Operation timed out",
+	ENotSupported:         "Not supported",
+	ENotFound:             "Element not found",
+}
+
+// Error wraps an HCS API failure with the operation name, HRESULT, and any
+// result document returned by the operation.
+type Error struct {
+	Op         string
+	HR         uint32
+	ResultJSON string
+}
+
+func (e *Error) Error() string {
+	var sb strings.Builder
+	sb.WriteString(e.Op)
+	sb.WriteString(": HRESULT ")
+	sb.WriteString(fmt.Sprintf("0x%08x", e.HR))
+	if DecodeHRESULTs {
+		sb.WriteString(" [")
+		sb.WriteString(DecodeHRESULT(e.HR))
+		sb.WriteString("]")
+	}
+	if msg, ok := hresultMessages[e.HR]; ok {
+		sb.WriteString(" (")
+		sb.WriteString(msg)
+		sb.WriteString(")")
+	}
+	if e.ResultJSON != "" {
+		sb.WriteString(ResultSuffix)
+		sb.WriteString(e.ResultJSON)
+	}
+	return sb.String()
+}
+
+// DecodeHRESULTs makes Error text break the HRESULT down with
+// DecodeHRESULT after the hex. The hcstool CLI sets it with --verbose.
+var DecodeHRESULTs bool
+
+// facilityNames names the HRESULT facilities HCS failures usually carry.
+var facilityNames = map[uint32]string{
+	0:  "FACILITY_NULL",
+	1:  "FACILITY_RPC",
+	4:  "FACILITY_ITF",
+	7:  "FACILITY_WIN32",
+	8:  "FACILITY_WINDOWS",
+	53: "FACILITY_HYPERVISOR",
+	55: "FACILITY_VIRTUALIZATION",
+	58: "FACILITY_VHD",
+}
+
+// DecodeHRESULT splits an HRESULT into its severity, facility and code, e.g.
+// "severity=error facility=FACILITY_WIN32(7) code=0x05b4". A Win32-mapped
+// failure (HRESULT_FROM_WIN32) carries the Win32 error in its code, while
+// native HCS failures come from the virtualization facilities. Customer and
+// NTSTATUS-mapped codes are flagged as such.
+func DecodeHRESULT(hr uint32) string {
+	severity := "success"
+	if hr&0x80000000 != 0 {
+		severity = "error"
+	}
+	facility := hr >> 16 & 0x7ff
+	name, ok := facilityNames[facility]
+	if !ok {
+		name = "FACILITY"
+	}
+	s := fmt.Sprintf("severity=%s facility=%s(%d) code=0x%04x", severity, name, facility, hr&0xffff)
+	if hr&0x20000000 != 0 {
+		s += " customer"
+	}
+	if hr&0x10000000 != 0 {
+		s += " ntstatus"
+	}
+	return s
+}
+
+// ResultSuffix introduces the result document at the end of Error text.
+const ResultSuffix = "\n  result: "
+
+// WithResult attaches an operation's result document to err if it is an
+// *Error that doesn't already carry one, so the HCS failure reason is shown
+// alongside the HRESULT.
+func WithResult(err error, resultJSON string) error {
+	var hcsErr *Error
+	if resultJSON != "" && errors.As(err, &hcsErr) && hcsErr.ResultJSON == "" {
+		hcsErr.ResultJSON = resultJSON
+	}
+	return err
+}
+
+// hrIsError reports whether an HRESULT is a failure code. Only the low 32
+// bits of a syscall return are the HRESULT, and failure is signalled by the
+// severity (sign) bit alone, so success-with-info codes such as S_FALSE are
+// not errors.
+func hrIsError(hr uintptr) bool {
+	return uint32(hr)&0x80000000 != 0
+}
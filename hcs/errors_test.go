@@ -0,0 +1,61 @@
+package hcs
+
+import "testing"
+
+func TestHrIsError(t *testing.T) {
+	tests := []struct {
+		hr   uintptr
+		want bool
+	}{
+		{0x00000000, false}, // S_OK
+		{0x00000001, false}, // S_FALSE
+		{0x00040000, false}, // success with a facility code
+		{0x00370001, false}, // success in FACILITY_COMPUTE
+		{0x80070005, true},  // E_ACCESSDENIED
+		{0x800705b4, true},  // HRESULT_FROM_WIN32(ERROR_TIMEOUT)
+		{0x80370109, true},  // HCS_E_CONNECTION_TIMEOUT
+		{0xc037010e, true},  // HCS_E_SYSTEM_NOT_FOUND
+		{0xc0351000, true},  // HCS_E_HYPERV_NOT_INSTALLED
+	}
+	for _, tt := range tests {
+		if got := hrIsError(tt.hr); got != tt.want {
+			t.Errorf("hrIsError(%#x) = %v, want %v", tt.hr, got, tt.want)
+		}
+	}
+
+	// A negative HRESULT sign-extended into a 64-bit register is still an error.
+	accessDenied := int32(-0x7ff8fffb) // 0x80070005
+	if !hrIsError(uintptr(accessDenied)) {
+		t.Errorf("hrIsError(sign-extended E_ACCESSDENIED) = false, want true")
+	}
+}
+
+func TestDecodeHRESULT(t *testing.T) {
+	tests := []struct {
+		hr   uint32
+		want string
+	}{
+		{0x00000001, "severity=success facility=FACILITY_NULL(0) code=0x0001"},
+		{0x800705b4, "severity=error facility=FACILITY_WIN32(7) code=0x05b4"},
+		{0x80370109, "severity=error facility=FACILITY_VIRTUALIZATION(55) code=0x0109"},
+		{0xc0351000, "severity=error facility=FACILITY_HYPERVISOR(53) code=0x1000"},
+		{0xa1230001, "severity=error facility=FACILITY(291) code=0x0001 customer"},
+		{0xd0000022, "severity=error facility=FACILITY_NULL(0) code=0x0022 ntstatus"},
+	}
+	for _, tt := range tests {
+		if got := DecodeHRESULT(tt.hr); got != tt.want {
+			t.Errorf("DecodeHRESULT(%#x) = %q, want %q", tt.hr, got, tt.want)
+		}
+	}
+
+	defer func(v bool) { DecodeHRESULTs = v }(DecodeHRESULTs)
+	err := &Error{Op: "HcsStartComputeSystem", HR: ETimeout}
+	DecodeHRESULTs = false
+	if got, want := err.Error(), "HcsStartComputeSystem: HRESULT 0x800705b4 (Operation timed out)"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	DecodeHRESULTs = true
+	if got, want := err.Error(), "HcsStartComputeSystem: HRESULT 0x800705b4 [severity=error facility=FACILITY_WIN32(7) code=0x05b4] (Operation timed out)"; got != want {
+		t.Errorf("verbose Error() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,72 @@
+package hcs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Grants records the VM access grants made for one VM so they can all be
+// undone together when the operation they were made for fails. It is safe
+// for concurrent use, so a signal handler can roll back a create that is
+// still granting.
+type Grants struct {
+	vmID string
+
+	mu    sync.Mutex
+	paths []string
+}
+
+// grantAccess and revokeAccess make and undo the grants; tests replace them.
+var (
+	grantAccess  = GrantVmAccess
+	revokeAccess = RevokeVmAccess
+)
+
+// NewGrants starts an empty grant transaction for vmID.
+func NewGrants(vmID string) *Grants {
+	return &Grants{vmID: vmID}
+}
+
+// Grant grants the VM access to path and records it for Rollback. A failed
+// grant records nothing.
+func (t *Grants) Grant(path string) error {
+	if err := grantAccess(t.vmID, path); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.paths = append(t.paths, path)
+	t.mu.Unlock()
+	return nil
+}
+
+// Paths returns the paths granted so far, in grant order.
+func (t *Grants) Paths() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.paths...)
+}
+
+// Commit keeps every grant made so far; a later Rollback won't undo them.
+func (t *Grants) Commit() {
+	t.mu.Lock()
+	t.paths = nil
+	t.mu.Unlock()
+}
+
+// Rollback revokes every recorded grant, newest first, and forgets them.
+// Every revoke is attempted; the failures are returned together.
+func (t *Grants) Rollback() error {
+	t.mu.Lock()
+	paths := t.paths
+	t.paths = nil
+	t.mu.Unlock()
+
+	var errs []error
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := revokeAccess(t.vmID, paths[i]); err != nil {
+			errs = append(errs, fmt.Errorf("revoke access to %s: %w", paths[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
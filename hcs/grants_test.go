@@ -0,0 +1,58 @@
+package hcs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestGrantsRollback(t *testing.T) {
+	origGrant, origRevoke := grantAccess, revokeAccess
+	defer func() { grantAccess, revokeAccess = origGrant, origRevoke }()
+
+	var revoked []string
+	grantAccess = func(vmID, path string) error {
+		if strings.HasSuffix(path, "bad.vhdx") {
+			return errors.New("access denied")
+		}
+		return nil
+	}
+	revokeAccess = func(vmID, path string) error {
+		revoked = append(revoked, path)
+		if strings.HasSuffix(path, "stuck.vhdx") {
+			return errors.New("in use")
+		}
+		return nil
+	}
+
+	txn := NewGrants("vm")
+	for _, p := range []string{`C:\a.vhdx`, `C:\stuck.vhdx`, `C:\b.vhdx`} {
+		if err := txn.Grant(p); err != nil {
+			t.Fatalf("Grant(%s): %v", p, err)
+		}
+	}
+	if err := txn.Grant(`C:\bad.vhdx`); err == nil {
+		t.Fatal("failed grant reported success")
+	}
+	if got := strings.Join(txn.Paths(), " "); got != `C:\a.vhdx C:\stuck.vhdx C:\b.vhdx` {
+		t.Errorf("Paths() = %s", got)
+	}
+
+	err := txn.Rollback()
+	if got := strings.Join(revoked, " "); got != `C:\b.vhdx C:\stuck.vhdx C:\a.vhdx` {
+		t.Errorf("revoked %s, want newest first", got)
+	}
+	if err == nil || !strings.Contains(err.Error(), "stuck.vhdx") {
+		t.Errorf("Rollback error = %v, want the failed revoke", err)
+	}
+
+	revoked = nil
+	if err := txn.Rollback(); err != nil || len(revoked) != 0 {
+		t.Errorf("second Rollback revoked %v (%v), want nothing", revoked, err)
+	}
+	txn.Grant(`C:\c.vhdx`)
+	txn.Commit()
+	if err := txn.Rollback(); err != nil || len(revoked) != 0 {
+		t.Errorf("Rollback after Commit revoked %v (%v), want nothing", revoked, err)
+	}
+}
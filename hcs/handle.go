@@ -0,0 +1,94 @@
+package hcs
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// System is an open compute system handle and Operation an open HCS operation
+// handle. Copies share one guard, so closing any copy closes the handle and
+// closing twice does nothing; the zero value holds no handle. A handle that
+// becomes unreachable while still open is closed by the garbage collector and
+// reported through Leaked.
+type System struct{ h *handle }
+type Operation struct{ h *handle }
+
+// Leaked is called, from the finalizer goroutine, with the kind ("system" or
+// "operation") and raw value of a handle that was garbage collected without
+// being closed, just before it is closed. The default does nothing; the
+// hcstool CLI prints a warning.
+var Leaked = func(kind string, raw uintptr) {}
+
+// handle guards a raw HCS handle so it is closed exactly once.
+type handle struct {
+	kind   string
+	raw    uintptr
+	close  func(uintptr)
+	closed atomic.Bool
+}
+
+func newHandle(kind string, raw uintptr, close func(uintptr)) *handle {
+	h := &handle{kind: kind, raw: raw, close: close}
+	trackOpen(kind)
+	runtime.SetFinalizer(h, (*handle).finalize)
+	return h
+}
+
+// value returns the raw handle, or 0 once closed so a stale copy fails with
+// an invalid-handle error instead of reaching a recycled handle value.
+func (h *handle) value() uintptr {
+	if h == nil || h.closed.Load() {
+		return 0
+	}
+	return h.raw
+}
+
+func (h *handle) open() bool {
+	return h != nil && !h.closed.Load()
+}
+
+func (h *handle) release() {
+	if h == nil || !h.closed.CompareAndSwap(false, true) {
+		return
+	}
+	runtime.SetFinalizer(h, nil)
+	h.close(h.raw)
+	trackClose(h.kind)
+}
+
+func (h *handle) finalize() {
+	if h.closed.Load() {
+		return
+	}
+	Leaked(h.kind, h.raw)
+	h.release()
+}
+
+func newSystem(raw uintptr) System {
+	return System{newHandle("system", raw, func(raw uintptr) {
+		procHcsCloseComputeSystem.Call(raw)
+	})}
+}
+
+func newOperation(raw uintptr) Operation {
+	return Operation{newHandle("operation", raw, func(raw uintptr) {
+		procHcsCloseOperation.Call(raw)
+	})}
+}
+
+// Valid reports whether sys holds a handle that has not been closed.
+func (sys System) Valid() bool { return sys.h.open() }
+
+// Close releases the handle. This does NOT stop the VM — it just releases our
+// reference.
+func (sys System) Close() { sys.h.release() }
+
+func (sys System) raw() uintptr { return sys.h.value() }
+
+// Valid reports whether op holds a handle that has not been closed.
+func (op Operation) Valid() bool { return op.h.open() }
+
+// Close releases the operation handle.
+func (op Operation) Close() { op.h.release() }
+
+func (op Operation) raw() uintptr { return op.h.value() }
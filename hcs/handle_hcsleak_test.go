@@ -0,0 +1,22 @@
+//go:build hcsleak
+
+package hcs
+
+import "testing"
+
+func TestOpenHandlesCounts(t *testing.T) {
+	before := OpenHandles()
+	sys := System{newHandle("system", 0x1, func(uintptr) {})}
+	op := Operation{newHandle("operation", 0x2, func(uintptr) {})}
+
+	got := OpenHandles()
+	if got["system"] != before["system"]+1 || got["operation"] != before["operation"]+1 {
+		t.Fatalf("OpenHandles() = %v with one of each open, before %v", got, before)
+	}
+	sys.Close()
+	op.Close()
+	op.Close()
+	if got := OpenHandles(); got["system"] != before["system"] || got["operation"] != before["operation"] {
+		t.Errorf("OpenHandles() = %v after closing, want %v", got, before)
+	}
+}
@@ -0,0 +1,78 @@
+package hcs
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestHandleReleaseOnce(t *testing.T) {
+	var closed []uintptr
+	h := newHandle("system", 0x42, func(raw uintptr) { closed = append(closed, raw) })
+	sys := System{h}
+	dup := sys
+
+	if !sys.Valid() || sys.raw() != 0x42 {
+		t.Fatalf("new handle: Valid=%v raw=%#x", sys.Valid(), sys.raw())
+	}
+	sys.Close()
+	dup.Close()
+	CloseComputeSystem(dup)
+	if len(closed) != 1 || closed[0] != 0x42 {
+		t.Fatalf("closed %v, want one close of 0x42", closed)
+	}
+	if dup.Valid() || dup.raw() != 0 {
+		t.Errorf("closed copy: Valid=%v raw=%#x, want false 0", dup.Valid(), dup.raw())
+	}
+
+	var zero Operation
+	zero.Close()
+	if zero.Valid() || zero.raw() != 0 {
+		t.Errorf("zero Operation: Valid=%v raw=%#x", zero.Valid(), zero.raw())
+	}
+}
+
+func TestHandleFinalizerReportsLeak(t *testing.T) {
+	type leak struct {
+		kind string
+		raw  uintptr
+	}
+	leaked := make(chan leak, 1)
+	closed := make(chan uintptr, 1)
+	defer func(prev func(string, uintptr)) { Leaked = prev }(Leaked)
+	Leaked = func(kind string, raw uintptr) { leaked <- leak{kind, raw} }
+
+	func() {
+		newHandle("operation", 0x7, func(raw uintptr) { closed <- raw })
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		runtime.GC()
+		select {
+		case got := <-leaked:
+			if got.kind != "operation" || got.raw != 0x7 {
+				t.Errorf("Leaked(%q, %#x), want (\"operation\", 0x7)", got.kind, got.raw)
+			}
+			if raw := <-closed; raw != 0x7 {
+				t.Errorf("closed %#x, want 0x7", raw)
+			}
+			return
+		case <-deadline:
+			t.Fatal("finalizer never reported the unclosed handle")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestHandleClosedNotReported(t *testing.T) {
+	defer func(prev func(string, uintptr)) { Leaked = prev }(Leaked)
+	Leaked = func(kind string, raw uintptr) { t.Errorf("Leaked(%q, %#x) for a closed handle", kind, raw) }
+
+	func() {
+		newHandle("system", 0x9, func(uintptr) {}).release()
+	}()
+	for i := 0; i < 3; i++ {
+		runtime.GC()
+	}
+}
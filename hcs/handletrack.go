@@ -0,0 +1,37 @@
+//go:build hcsleak
+
+package hcs
+
+import "sync"
+
+var (
+	openHandlesMu sync.Mutex
+	openHandles   = map[string]int{}
+)
+
+func trackOpen(kind string) {
+	openHandlesMu.Lock()
+	openHandles[kind]++
+	openHandlesMu.Unlock()
+}
+
+func trackClose(kind string) {
+	openHandlesMu.Lock()
+	openHandles[kind]--
+	openHandlesMu.Unlock()
+}
+
+// OpenHandles returns the number of open handles by kind ("system",
+// "operation"). Counting is only compiled in with -tags hcsleak, for leak
+// tests; otherwise OpenHandles returns nil.
+func OpenHandles() map[string]int {
+	openHandlesMu.Lock()
+	defer openHandlesMu.Unlock()
+	counts := make(map[string]int, len(openHandles))
+	for kind, n := range openHandles {
+		if n != 0 {
+			counts[kind] = n
+		}
+	}
+	return counts
+}
@@ -0,0 +1,9 @@
+//go:build !hcsleak
+
+package hcs
+
+func trackOpen(kind string)  {}
+func trackClose(kind string) {}
+
+// OpenHandles returns nil; handle counting needs -tags hcsleak.
+func OpenHandles() map[string]int { return nil }
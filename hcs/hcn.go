@@ -0,0 +1,127 @@
+package hcs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// computenetwork.dll (Host Compute Network) proc bindings, for looking up
+// the HNS networks VM network adapters attach to.
+var (
+	modComputeNetwork = windows.NewLazySystemDLL("computenetwork.dll")
+
+	procHcnEnumerateNetworks      = modComputeNetwork.NewProc("HcnEnumerateNetworks")
+	procHcnOpenNetwork            = modComputeNetwork.NewProc("HcnOpenNetwork")
+	procHcnQueryNetworkProperties = modComputeNetwork.NewProc("HcnQueryNetworkProperties")
+	procHcnCloseNetwork           = modComputeNetwork.NewProc("HcnCloseNetwork")
+)
+
+// hcnQuery asks HCN for schema 2.0 documents.
+const hcnQuery = `{"SchemaVersion":{"Major":2,"Minor":0}}`
+
+// Network is an HNS network (a virtual switch) as HCN reports it.
+type Network struct {
+	ID   string `json:"ID"`
+	Name string `json:"Name"`
+	Type string `json:"Type"` // NAT, ICS, Transparent, L2Bridge, ...
+}
+
+// takeHcnString copies an HCN-allocated string into Go memory and frees it.
+// Unlike computecore's result documents, HCN strings (results and error
+// records alike) are released with CoTaskMemFree. A nil pointer yields "".
+func takeHcnString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	s := windows.UTF16PtrToString(p)
+	windows.CoTaskMemFree(unsafe.Pointer(p))
+	return s
+}
+
+// EnumerateNetworks returns every HNS network on the host.
+func EnumerateNetworks() ([]Network, error) {
+	err := FindProcs(procHcnEnumerateNetworks, procHcnOpenNetwork, procHcnQueryNetworkProperties, procHcnCloseNetwork)
+	if err != nil {
+		return nil, fmt.Errorf("HNS is not available on this system (computenetwork.dll): %w", err)
+	}
+	queryPtr, err := windows.UTF16PtrFromString(hcnQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var idsPtr, errPtr *uint16
+	// HcnEnumerateNetworks(query, networks, errorRecord)
+	hr, _, _ := procHcnEnumerateNetworks.Call(
+		uintptr(unsafe.Pointer(queryPtr)),
+		uintptr(unsafe.Pointer(&idsPtr)),
+		uintptr(unsafe.Pointer(&errPtr)),
+	)
+	idsJSON, errRecord := takeHcnString(idsPtr), takeHcnString(errPtr)
+	if hrIsError(hr) {
+		return nil, &Error{Op: "HcnEnumerateNetworks", HR: uint32(hr), ResultJSON: errRecord}
+	}
+
+	var ids []string
+	if idsJSON != "" {
+		if err := json.Unmarshal([]byte(idsJSON), &ids); err != nil {
+			return nil, fmt.Errorf("failed to parse HNS network list: %w", err)
+		}
+	}
+	networks := make([]Network, 0, len(ids))
+	for _, id := range ids {
+		n, err := networkProperties(id, queryPtr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// networkProperties opens one HNS network by ID and reads its properties.
+func networkProperties(id string, queryPtr *uint16) (Network, error) {
+	guid, err := windows.GUIDFromString("{" + strings.Trim(id, "{}") + "}")
+	if err != nil {
+		return Network{}, fmt.Errorf("HNS returned an invalid network ID %q: %w", id, err)
+	}
+
+	var network uintptr
+	var errRecordPtr *uint16
+	// HcnOpenNetwork(id, network, errorRecord)
+	hr, _, _ := procHcnOpenNetwork.Call(
+		uintptr(unsafe.Pointer(&guid)),
+		uintptr(unsafe.Pointer(&network)),
+		uintptr(unsafe.Pointer(&errRecordPtr)),
+	)
+	if errRecord := takeHcnString(errRecordPtr); hrIsError(hr) {
+		return Network{}, &Error{Op: "HcnOpenNetwork " + id, HR: uint32(hr), ResultJSON: errRecord}
+	}
+	defer procHcnCloseNetwork.Call(network)
+
+	var propsPtr *uint16
+	errRecordPtr = nil
+	// HcnQueryNetworkProperties(network, query, properties, errorRecord)
+	hr, _, _ = procHcnQueryNetworkProperties.Call(
+		network,
+		uintptr(unsafe.Pointer(queryPtr)),
+		uintptr(unsafe.Pointer(&propsPtr)),
+		uintptr(unsafe.Pointer(&errRecordPtr)),
+	)
+	propsJSON, errRecord := takeHcnString(propsPtr), takeHcnString(errRecordPtr)
+	if hrIsError(hr) {
+		return Network{}, &Error{Op: "HcnQueryNetworkProperties " + id, HR: uint32(hr), ResultJSON: errRecord}
+	}
+
+	n := Network{ID: id}
+	if err := json.Unmarshal([]byte(propsJSON), &n); err != nil {
+		return Network{}, fmt.Errorf("failed to parse HNS network %s: %w", id, err)
+	}
+	if n.ID == "" {
+		n.ID = id
+	}
+	return n, nil
+}
@@ -0,0 +1,564 @@
+// Package hcs binds the Host Compute Service API in computecore.dll and
+// provides typed compute system lifecycle operations on top of it, up to
+// granting a VM its files, creating and starting it (CreateAndStart).
+// Nothing in the package prints or exits; every failure is returned as an
+// error, HCS failures as *Error.
+package hcs
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Trace is called when a traced HCS call starts and the func it returns when
+// the call ends; the hcstool CLI uses it for --verbose timings. The default
+// does nothing.
+var Trace = func(what string) func() { return func() {} }
+
+// Infinite is the INFINITE timeout value for HcsWaitForOperationResult.
+const Infinite = uint32(0xFFFFFFFF)
+
+// Access masks for HcsOpenComputeSystem. Query-only commands request
+// GENERIC_READ so they need the least privilege HCS will accept.
+const (
+	AccessRead = uint32(0x80000000) // GENERIC_READ
+	AccessAll  = uint32(0x10000000) // GENERIC_ALL
+)
+
+// computecore.dll proc bindings.
+var (
+	modComputeCore = windows.NewLazySystemDLL("computecore.dll")
+
+	procHcsCreateOperation            = modComputeCore.NewProc("HcsCreateOperation")
+	procHcsCloseOperation             = modComputeCore.NewProc("HcsCloseOperation")
+	procHcsWaitForOperationResult     = modComputeCore.NewProc("HcsWaitForOperationResult")
+	procHcsGetOperationResult         = modComputeCore.NewProc("HcsGetOperationResult")
+	procHcsCreateComputeSystem        = modComputeCore.NewProc("HcsCreateComputeSystem")
+	procHcsOpenComputeSystem          = modComputeCore.NewProc("HcsOpenComputeSystem")
+	procHcsCloseComputeSystem         = modComputeCore.NewProc("HcsCloseComputeSystem")
+	procHcsStartComputeSystem         = modComputeCore.NewProc("HcsStartComputeSystem")
+	procHcsShutDownComputeSystem      = modComputeCore.NewProc("HcsShutDownComputeSystem")
+	procHcsTerminateComputeSystem     = modComputeCore.NewProc("HcsTerminateComputeSystem")
+	procHcsModifyComputeSystem        = modComputeCore.NewProc("HcsModifyComputeSystem")
+	procHcsCrashComputeSystem         = modComputeCore.NewProc("HcsCrashComputeSystem")
+	procHcsEnumerateComputeSystems    = modComputeCore.NewProc("HcsEnumerateComputeSystems")
+	procHcsGetComputeSystemProperties = modComputeCore.NewProc("HcsGetComputeSystemProperties")
+	procHcsGrantVmAccess              = modComputeCore.NewProc("HcsGrantVmAccess")
+	procHcsRevokeVmAccess             = modComputeCore.NewProc("HcsRevokeVmAccess")
+	procHcsModifyServiceSettings      = modComputeCore.NewProc("HcsModifyServiceSettings")
+	procHcsGetServiceProperties       = modComputeCore.NewProc("HcsGetServiceProperties")
+)
+
+// ErrUnavailable is returned when computecore.dll or its core exports are
+// missing: the host predates HCS v2 or lacks Hyper-V.
+var ErrUnavailable = errors.New("HCS is not available on this system; enable the Hyper-V and Containers Windows features")
+
+// FindProcs resolves each proc, returning the first that is missing. Calling
+// an unresolvable LazyProc panics, so optional exports are checked first.
+func FindProcs(procs ...*windows.LazyProc) error {
+	for _, p := range procs {
+		if err := p.Find(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Available verifies computecore.dll loads and exports the calls
+// every HCS command relies on, so a host without HCS gets one clear error
+// instead of a panic deep inside an operation.
+func Available() error {
+	if err := modComputeCore.Load(); err != nil {
+		return fmt.Errorf("%w (%v)", ErrUnavailable, err)
+	}
+	err := FindProcs(
+		procHcsCreateOperation,
+		procHcsCloseOperation,
+		procHcsWaitForOperationResult,
+		procHcsCreateComputeSystem,
+		procHcsOpenComputeSystem,
+		procHcsCloseComputeSystem,
+		procHcsStartComputeSystem,
+		procHcsShutDownComputeSystem,
+		procHcsTerminateComputeSystem,
+		procHcsModifyComputeSystem,
+		procHcsEnumerateComputeSystems,
+		procHcsGetComputeSystemProperties,
+		procHcsGrantVmAccess,
+		procHcsRevokeVmAccess,
+	)
+	if err != nil {
+		return fmt.Errorf("%w (%v)", ErrUnavailable, err)
+	}
+	return nil
+}
+
+// CreateOperation creates a new HCS operation handle. The caller must close it
+// with CloseOperation after use.
+func CreateOperation() (Operation, error) {
+	// HcsCreateOperation(context, callback) -> HCS_OPERATION
+	// We pass NULL for both context and callback (synchronous usage).
+	r1, _, _ := procHcsCreateOperation.Call(0, 0)
+	if r1 == 0 {
+		return Operation{}, fmt.Errorf("HcsCreateOperation returned NULL")
+	}
+	return newOperation(r1), nil
+}
+
+// Operation completion callbacks. windows.NewCallback slots are a limited,
+// never-freed resource, so a single callback is shared by all async
+// operations and the per-operation context is an ID keyed into opWaiters.
+var (
+	opCallbackOnce sync.Once
+	opCallback     uintptr
+	opWaiters      sync.Map // uintptr context ID -> chan struct{}
+	opNextID       uint64
+)
+
+// operationCompleted is the HCS_OPERATION_COMPLETION callback. It signals the
+// channel registered for the operation's context ID.
+func operationCompleted(op, context uintptr) uintptr {
+	if ch, ok := opWaiters.LoadAndDelete(context); ok {
+		close(ch.(chan struct{}))
+	}
+	return 0
+}
+
+// CreateOperationWithCallback creates an HCS operation whose completion is
+// signalled on the returned channel instead of requiring a blocking wait.
+// Use WaitForResultAsync to collect the result. The caller must close the
+// operation with CloseOperation after use.
+func CreateOperationWithCallback() (Operation, <-chan struct{}, error) {
+	opCallbackOnce.Do(func() {
+		opCallback = windows.NewCallback(operationCompleted)
+	})
+
+	context := uintptr(atomic.AddUint64(&opNextID, 1))
+	done := make(chan struct{})
+	opWaiters.Store(context, done)
+
+	r1, _, _ := procHcsCreateOperation.Call(context, opCallback)
+	if r1 == 0 {
+		opWaiters.Delete(context)
+		return Operation{}, nil, fmt.Errorf("HcsCreateOperation returned NULL")
+	}
+	return newOperation(r1), done, nil
+}
+
+// WaitForResultAsync waits for an operation created by
+// CreateOperationWithCallback to complete, or for timeout to elapse, and
+// returns the result document. A timeout yields an *Error with ETimeout.
+func WaitForResultAsync(op Operation, done <-chan struct{}, timeout time.Duration) (string, error) {
+	defer Trace("async operation")()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return "", &Error{Op: "WaitForResultAsync", HR: ETimeout}
+	}
+
+	// Operations with a callback must not be waited on; fetch the result.
+	var resultPtr *uint16
+	hr, _, _ := procHcsGetOperationResult.Call(
+		op.raw(),
+		uintptr(unsafe.Pointer(&resultPtr)),
+	)
+	runtime.KeepAlive(op)
+	resultJSON := takeResultDocument(resultPtr)
+	if hrIsError(hr) {
+		return resultJSON, &Error{
+			Op:         "HcsGetOperationResult",
+			HR:         uint32(hr),
+			ResultJSON: resultJSON,
+		}
+	}
+	return resultJSON, nil
+}
+
+// CloseOperation closes an HCS operation handle.
+func CloseOperation(op Operation) {
+	op.Close()
+}
+
+// takeResultDocument copies an HCS-allocated result string into Go memory and
+// frees it. Every computecore API that returns a result document
+// (HcsWaitForOperationResult, HcsGetOperationResult, HcsModifyServiceSettings,
+// ...) hands ownership to the caller, who must release it with LocalFree;
+// closing the operation does not free it. A nil pointer yields "".
+func takeResultDocument(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	s := windows.UTF16PtrToString(p)
+	windows.LocalFree(windows.Handle(unsafe.Pointer(p)))
+	return s
+}
+
+// WaitForResult waits for an HCS operation to complete and returns the result
+// document JSON. The operation must still be open when this is called.
+func WaitForResult(op Operation, timeoutMs uint32) (string, error) {
+	defer Trace("HcsWaitForOperationResult")()
+
+	var resultPtr *uint16
+	hr, _, _ := procHcsWaitForOperationResult.Call(
+		op.raw(),
+		uintptr(timeoutMs),
+		uintptr(unsafe.Pointer(&resultPtr)),
+	)
+	runtime.KeepAlive(op)
+	resultJSON := takeResultDocument(resultPtr)
+	if hrIsError(hr) {
+		return resultJSON, &Error{
+			Op:         "HcsWaitForOperationResult",
+			HR:         uint32(hr),
+			ResultJSON: resultJSON,
+		}
+	}
+	return resultJSON, nil
+}
+
+// CreateComputeSystem creates a new HCS compute system. sd restricts who may
+// open and control it; nil uses the HCS default.
+func CreateComputeSystem(id, configJSON string, op Operation, sd *windows.SECURITY_DESCRIPTOR) (System, error) {
+	idPtr, err := windows.UTF16PtrFromString(id)
+	if err != nil {
+		return System{}, fmt.Errorf("invalid system id: %w", err)
+	}
+	configPtr, err := windows.UTF16PtrFromString(configJSON)
+	if err != nil {
+		return System{}, fmt.Errorf("invalid config JSON: %w", err)
+	}
+
+	var raw uintptr
+	// HcsCreateComputeSystem(id, configuration, operation, securityDescriptor, computeSystem)
+	hr, _, _ := procHcsCreateComputeSystem.Call(
+		uintptr(unsafe.Pointer(idPtr)),
+		uintptr(unsafe.Pointer(configPtr)),
+		op.raw(),
+		uintptr(unsafe.Pointer(sd)),
+		uintptr(unsafe.Pointer(&raw)),
+	)
+	runtime.KeepAlive(op)
+	if hrIsError(hr) {
+		return System{}, &Error{Op: "HcsCreateComputeSystem", HR: uint32(hr)}
+	}
+	return newSystem(raw), nil
+}
+
+// OpenComputeSystem opens an existing compute system by ID with the requested
+// access mask. An access of 0 defaults to GENERIC_ALL.
+func OpenComputeSystem(id string, access uint32) (System, error) {
+	idPtr, err := windows.UTF16PtrFromString(id)
+	if err != nil {
+		return System{}, fmt.Errorf("invalid system id: %w", err)
+	}
+	if access == 0 {
+		access = AccessAll
+	}
+
+	var raw uintptr
+	// HcsOpenComputeSystem(id, requestedAccess, computeSystem)
+	hr, _, _ := procHcsOpenComputeSystem.Call(
+		uintptr(unsafe.Pointer(idPtr)),
+		uintptr(access),
+		uintptr(unsafe.Pointer(&raw)),
+	)
+	if hrIsError(hr) {
+		return System{}, &Error{Op: "HcsOpenComputeSystem", HR: uint32(hr)}
+	}
+	return newSystem(raw), nil
+}
+
+// CloseComputeSystem releases the handle to a compute system. This does NOT
+// stop the VM — it just releases our reference.
+func CloseComputeSystem(sys System) {
+	sys.Close()
+}
+
+// StartComputeSystem starts a created compute system.
+func StartComputeSystem(sys System, op Operation) error {
+	// HcsStartComputeSystem(computeSystem, operation, options)
+	hr, _, _ := procHcsStartComputeSystem.Call(
+		sys.raw(),
+		op.raw(),
+		0, // options — NULL
+	)
+	runtime.KeepAlive(sys)
+	runtime.KeepAlive(op)
+	if hrIsError(hr) {
+		return &Error{Op: "HcsStartComputeSystem", HR: uint32(hr)}
+	}
+	return nil
+}
+
+// ShutdownComputeSystem initiates a clean shutdown of a compute system.
+// Pass empty string for optionsJSON to use NULL (default power-off).
+func ShutdownComputeSystem(sys System, op Operation, optionsJSON string) error {
+	var optionsArg uintptr
+	if optionsJSON != "" {
+		oPtr, err := windows.UTF16PtrFromString(optionsJSON)
+		if err != nil {
+			return fmt.Errorf("invalid shutdown options JSON: %w", err)
+		}
+		optionsArg = uintptr(unsafe.Pointer(oPtr))
+	}
+
+	// HcsShutDownComputeSystem(computeSystem, operation, options)
+	hr, _, _ := procHcsShutDownComputeSystem.Call(
+		sys.raw(),
+		op.raw(),
+		optionsArg,
+	)
+	runtime.KeepAlive(sys)
+	runtime.KeepAlive(op)
+	if hrIsError(hr) {
+		return &Error{Op: "HcsShutDownComputeSystem", HR: uint32(hr)}
+	}
+	return nil
+}
+
+// TerminateComputeSystem forcibly stops a compute system.
+func TerminateComputeSystem(sys System, op Operation) error {
+	// HcsTerminateComputeSystem(computeSystem, operation, options)
+	hr, _, _ := procHcsTerminateComputeSystem.Call(
+		sys.raw(),
+		op.raw(),
+		0,
+	)
+	runtime.KeepAlive(sys)
+	runtime.KeepAlive(op)
+	if hrIsError(hr) {
+		return &Error{Op: "HcsTerminateComputeSystem", HR: uint32(hr)}
+	}
+	return nil
+}
+
+// CrashComputeSystem makes the guest bugcheck so it writes a crash dump.
+// HcsCrashComputeSystem only exists on newer hosts; on older ones an error
+// wrapping the missing export is returned.
+func CrashComputeSystem(sys System, op Operation) error {
+	if err := procHcsCrashComputeSystem.Find(); err != nil {
+		return fmt.Errorf("this host's HCS cannot crash a compute system: %w", err)
+	}
+
+	// HcsCrashComputeSystem(computeSystem, operation, options)
+	hr, _, _ := procHcsCrashComputeSystem.Call(
+		sys.raw(),
+		op.raw(),
+		0, // options — NULL
+	)
+	runtime.KeepAlive(sys)
+	runtime.KeepAlive(op)
+	if hrIsError(hr) {
+		return &Error{Op: "HcsCrashComputeSystem", HR: uint32(hr)}
+	}
+	return nil
+}
+
+// ModifyComputeSystem applies a ModifySettingRequest document to a running
+// compute system.
+func ModifyComputeSystem(sys System, op Operation, configJSON string) error {
+	configPtr, err := windows.UTF16PtrFromString(configJSON)
+	if err != nil {
+		return fmt.Errorf("invalid modify request JSON: %w", err)
+	}
+
+	// HcsModifyComputeSystem(computeSystem, operation, configuration, identity)
+	hr, _, _ := procHcsModifyComputeSystem.Call(
+		sys.raw(),
+		op.raw(),
+		uintptr(unsafe.Pointer(configPtr)),
+		0, // identity — NULL
+	)
+	runtime.KeepAlive(sys)
+	runtime.KeepAlive(op)
+	if hrIsError(hr) {
+		return &Error{Op: "HcsModifyComputeSystem", HR: uint32(hr)}
+	}
+	return nil
+}
+
+// EnumerateComputeSystems calls HcsEnumerateComputeSystems once with a
+// SystemQuery document ("" lists all) and returns the result JSON.
+func EnumerateComputeSystems(queryJSON string) (string, error) {
+	op, err := CreateOperation()
+	if err != nil {
+		return "", err
+	}
+	defer CloseOperation(op)
+
+	if err := enumerate(queryJSON, op); err != nil {
+		return "", err
+	}
+	return WaitForResult(op, Infinite)
+}
+
+// EnumerateComputeSystemsAsync is EnumerateComputeSystems on an operation
+// created with CreateOperationWithCallback: the completion callback ends the
+// wait instead of a blocking HcsWaitForOperationResult. It gives up with an
+// ETimeout *Error after timeout.
+func EnumerateComputeSystemsAsync(queryJSON string, timeout time.Duration) (string, error) {
+	op, done, err := CreateOperationWithCallback()
+	if err != nil {
+		return "", err
+	}
+	defer CloseOperation(op)
+
+	if err := enumerate(queryJSON, op); err != nil {
+		return "", err
+	}
+	return WaitForResultAsync(op, done, timeout)
+}
+
+// enumerate starts an HcsEnumerateComputeSystems on op.
+func enumerate(queryJSON string, op Operation) error {
+	// HcsEnumerateComputeSystems(query, operation)
+	// Pass NULL query to list all.
+	var queryArg uintptr
+	if queryJSON != "" {
+		qPtr, err := windows.UTF16PtrFromString(queryJSON)
+		if err != nil {
+			return fmt.Errorf("invalid query JSON: %w", err)
+		}
+		queryArg = uintptr(unsafe.Pointer(qPtr))
+	}
+	hr, _, _ := procHcsEnumerateComputeSystems.Call(queryArg, op.raw())
+	runtime.KeepAlive(op)
+	if hrIsError(hr) {
+		return &Error{Op: "HcsEnumerateComputeSystems", HR: uint32(hr)}
+	}
+	return nil
+}
+
+// GetComputeSystemProperties retrieves properties using a PropertyQuery JSON.
+// Pass empty string for queryJSON to use NULL (basic properties only).
+func GetComputeSystemProperties(sys System, queryJSON string) (string, error) {
+	op, err := CreateOperation()
+	if err != nil {
+		return "", err
+	}
+	defer CloseOperation(op)
+
+	var queryArg uintptr
+	if queryJSON != "" {
+		qPtr, err := windows.UTF16PtrFromString(queryJSON)
+		if err != nil {
+			return "", fmt.Errorf("invalid query JSON: %w", err)
+		}
+		queryArg = uintptr(unsafe.Pointer(qPtr))
+	}
+
+	// HcsGetComputeSystemProperties(computeSystem, operation, propertyQuery)
+	hr, _, _ := procHcsGetComputeSystemProperties.Call(
+		sys.raw(),
+		op.raw(),
+		queryArg,
+	)
+	runtime.KeepAlive(sys)
+	runtime.KeepAlive(op)
+	if hrIsError(hr) {
+		return "", &Error{Op: "HcsGetComputeSystemProperties", HR: uint32(hr)}
+	}
+
+	return WaitForResult(op, Infinite)
+}
+
+// GrantVmAccess grants a VM (by ID) access to a file on the host. The file
+// path must be absolute. This is synchronous — no operation handle needed.
+func GrantVmAccess(vmID, filePath string) error {
+	vmIDPtr, err := windows.UTF16PtrFromString(vmID)
+	if err != nil {
+		return fmt.Errorf("invalid VM ID: %w", err)
+	}
+	filePathPtr, err := windows.UTF16PtrFromString(filePath)
+	if err != nil {
+		return fmt.Errorf("invalid file path: %w", err)
+	}
+
+	hr, _, _ := procHcsGrantVmAccess.Call(
+		uintptr(unsafe.Pointer(vmIDPtr)),
+		uintptr(unsafe.Pointer(filePathPtr)),
+	)
+	if hrIsError(hr) {
+		return &Error{
+			Op: fmt.Sprintf("HcsGrantVmAccess(%s)", filePath),
+			HR: uint32(hr),
+		}
+	}
+	return nil
+}
+
+// RevokeVmAccess revokes a VM's access to a file previously granted.
+func RevokeVmAccess(vmID, filePath string) error {
+	vmIDPtr, err := windows.UTF16PtrFromString(vmID)
+	if err != nil {
+		return err
+	}
+	filePathPtr, err := windows.UTF16PtrFromString(filePath)
+	if err != nil {
+		return err
+	}
+
+	hr, _, _ := procHcsRevokeVmAccess.Call(
+		uintptr(unsafe.Pointer(vmIDPtr)),
+		uintptr(unsafe.Pointer(filePathPtr)),
+	)
+	if hrIsError(hr) {
+		return &Error{Op: fmt.Sprintf("HcsRevokeVmAccess(%s)", filePath), HR: uint32(hr)}
+	}
+	return nil
+}
+
+// GetServiceProperties queries properties of the HCS service itself, such as
+// its version and supported schema versions. This is synchronous.
+func GetServiceProperties(queryJSON string) (string, error) {
+	queryPtr, err := windows.UTF16PtrFromString(queryJSON)
+	if err != nil {
+		return "", fmt.Errorf("invalid query JSON: %w", err)
+	}
+
+	if err := procHcsGetServiceProperties.Find(); err != nil {
+		return "", err
+	}
+
+	var resultPtr *uint16
+	// HcsGetServiceProperties(propertyQuery, result)
+	hr, _, _ := procHcsGetServiceProperties.Call(
+		uintptr(unsafe.Pointer(queryPtr)),
+		uintptr(unsafe.Pointer(&resultPtr)),
+	)
+	resultJSON := takeResultDocument(resultPtr)
+	if hrIsError(hr) {
+		return resultJSON, &Error{Op: "HcsGetServiceProperties", HR: uint32(hr), ResultJSON: resultJSON}
+	}
+	return resultJSON, nil
+}
+
+// ModifyServiceSettings applies a global HCS service settings document. This
+// is synchronous; any result document HCS returns is passed back (and
+// attached to the error on failure).
+func ModifyServiceSettings(settingsJSON string) (string, error) {
+	settingsPtr, err := windows.UTF16PtrFromString(settingsJSON)
+	if err != nil {
+		return "", fmt.Errorf("invalid settings JSON: %w", err)
+	}
+
+	var resultPtr *uint16
+	// HcsModifyServiceSettings(settings, result)
+	hr, _, _ := procHcsModifyServiceSettings.Call(
+		uintptr(unsafe.Pointer(settingsPtr)),
+		uintptr(unsafe.Pointer(&resultPtr)),
+	)
+	resultJSON := takeResultDocument(resultPtr)
+	if hrIsError(hr) {
+		return resultJSON, &Error{Op: "HcsModifyServiceSettings", HR: uint32(hr), ResultJSON: resultJSON}
+	}
+	return resultJSON, nil
+}
@@ -0,0 +1,36 @@
+package hcs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOperationCompletedSignalsWaiter(t *testing.T) {
+	const context = 1 << 30 // far from any ID CreateOperationWithCallback hands out
+	done := make(chan struct{})
+	opWaiters.Store(uintptr(context), done)
+
+	operationCompleted(0, context)
+	select {
+	case <-done:
+	default:
+		t.Fatal("completion did not signal the waiter")
+	}
+	if _, ok := opWaiters.Load(uintptr(context)); ok {
+		t.Error("waiter still registered after completion")
+	}
+
+	// A second completion for the same context must not close it again.
+	operationCompleted(0, context)
+}
+
+func TestWaitForResultAsyncTimeout(t *testing.T) {
+	start := time.Now()
+	_, err := WaitForResultAsync(Operation{}, make(chan struct{}), 10*time.Millisecond)
+	if !IsHRESULT(err, ETimeout) {
+		t.Fatalf("err = %v, want an ETimeout *Error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timed out after %s, want about 10ms", elapsed)
+	}
+}
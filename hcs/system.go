@@ -0,0 +1,209 @@
+package hcs
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// Lifecycle operations by compute system ID. Each opens the system, runs
+// one operation to completion and releases every handle it took, so callers
+// never manage System or Operation handles themselves. Timeouts are in
+// milliseconds; Infinite waits forever.
+
+// withSystem opens the system with access and runs fn with a fresh
+// operation, then waits for the operation's result.
+func withSystem(id string, access uint32, timeoutMs uint32, fn func(System, Operation) error) (string, error) {
+	sys, err := OpenComputeSystem(id, access)
+	if err != nil {
+		return "", err
+	}
+	defer CloseComputeSystem(sys)
+
+	op, err := CreateOperation()
+	if err != nil {
+		return "", err
+	}
+	defer CloseOperation(op)
+
+	if err := fn(sys, op); err != nil {
+		return "", err
+	}
+	resultJSON, err := WaitForResult(op, timeoutMs)
+	return resultJSON, WithResult(err, resultJSON)
+}
+
+// create creates a compute system and waits for the create to complete.
+// created, if set, is handed the handle before the wait.
+func create(id, configJSON string, sd *windows.SECURITY_DESCRIPTOR, timeoutMs uint32, created func(System)) (System, error) {
+	op, err := CreateOperation()
+	if err != nil {
+		return System{}, err
+	}
+	defer CloseOperation(op)
+
+	sys, err := CreateComputeSystem(id, configJSON, op, sd)
+	if err != nil {
+		return System{}, err
+	}
+	if created != nil {
+		created(sys)
+	}
+	if resultJSON, err := WaitForResult(op, timeoutMs); err != nil {
+		CloseComputeSystem(sys)
+		return System{}, fmt.Errorf("create compute system: %w", WithResult(err, resultJSON))
+	}
+	return sys, nil
+}
+
+// Start starts a created compute system.
+func Start(id string, timeoutMs uint32) error {
+	_, err := withSystem(id, AccessAll, timeoutMs, func(sys System, op Operation) error {
+		return StartComputeSystem(sys, op)
+	})
+	return err
+}
+
+func start(sys System, timeoutMs uint32) error {
+	op, err := CreateOperation()
+	if err != nil {
+		return err
+	}
+	defer CloseOperation(op)
+
+	if err := StartComputeSystem(sys, op); err != nil {
+		return err
+	}
+	resultJSON, err := WaitForResult(op, timeoutMs)
+	if err != nil {
+		return fmt.Errorf("start compute system: %w", WithResult(err, resultJSON))
+	}
+	return nil
+}
+
+// CreateOptions are the optional parts of CreateAndStart.
+type CreateOptions struct {
+	// GrantPaths are absolute host files, such as the VM's disks, the
+	// system is granted access to before it is created.
+	GrantPaths []string
+
+	// Grants is the transaction the grants are made in. When set, the
+	// caller commits or rolls it back; otherwise CreateAndStart rolls its
+	// own back on failure and commits it on success.
+	Grants *Grants
+
+	// SecurityDescriptor restricts who may open the system; nil uses the
+	// HCS default.
+	SecurityDescriptor *windows.SECURITY_DESCRIPTOR
+
+	// Granting is called before each path is granted.
+	Granting func(path string)
+
+	// Created is called with the system's handle as soon as HCS returns
+	// it, before the create has completed, so a caller can terminate it if
+	// interrupted. CreateAndStart keeps ownership of the handle.
+	Created func(sys System)
+
+	// CreateDone is called once the system has been created, before it is
+	// started.
+	CreateDone func()
+}
+
+// CreateAndStart grants the system access to opts.GrantPaths, creates it from
+// configJSON and starts it, returning the handle of the running system for
+// the caller to close. If any step fails, the system is terminated (or, if
+// its create failed, closed) and, unless opts.Grants is set, the grants
+// revoked. On success the grants stay, since the VM needs them while it
+// runs.
+func CreateAndStart(id, configJSON string, opts CreateOptions, timeoutMs uint32) (System, error) {
+	grants := opts.Grants
+	if grants == nil {
+		grants = NewGrants(id)
+	}
+	fail := func(sys System, err error) (System, error) {
+		if sys.Valid() {
+			TerminateAndClose(sys)
+		}
+		if opts.Grants == nil {
+			if rerr := grants.Rollback(); rerr != nil {
+				err = errors.Join(err, rerr)
+			}
+		}
+		return System{}, err
+	}
+
+	for _, p := range opts.GrantPaths {
+		if opts.Granting != nil {
+			opts.Granting(p)
+		}
+		if err := grants.Grant(p); err != nil {
+			return fail(System{}, fmt.Errorf("grant VM access to %s: %w", p, err))
+		}
+	}
+	sys, err := create(id, configJSON, opts.SecurityDescriptor, timeoutMs, opts.Created)
+	if err != nil {
+		return fail(System{}, err)
+	}
+	if opts.CreateDone != nil {
+		opts.CreateDone()
+	}
+	if err := start(sys, timeoutMs); err != nil {
+		return fail(sys, err)
+	}
+	if opts.Grants == nil {
+		grants.Commit()
+	}
+	return sys, nil
+}
+
+// Shutdown asks a compute system to shut down cleanly. optionsJSON is a
+// ShutdownOptions document, or "" for the default.
+func Shutdown(id, optionsJSON string, timeoutMs uint32) error {
+	_, err := withSystem(id, AccessAll, timeoutMs, func(sys System, op Operation) error {
+		return ShutdownComputeSystem(sys, op, optionsJSON)
+	})
+	return err
+}
+
+// Terminate forcibly stops a compute system.
+func Terminate(id string, timeoutMs uint32) error {
+	_, err := withSystem(id, AccessAll, timeoutMs, func(sys System, op Operation) error {
+		return TerminateComputeSystem(sys, op)
+	})
+	return err
+}
+
+// TerminateAndClose terminates a compute system, waiting up to five seconds
+// for it, and closes the handle. Errors are ignored: it undoes a create that
+// has already failed.
+func TerminateAndClose(sys System) {
+	op, err := CreateOperation()
+	if err != nil {
+		CloseComputeSystem(sys)
+		return
+	}
+	_ = TerminateComputeSystem(sys, op)
+	_, _ = WaitForResult(op, 5000)
+	CloseOperation(op)
+	CloseComputeSystem(sys)
+}
+
+// Modify applies a ModifySettingRequest document to a running system.
+func Modify(id, requestJSON string, timeoutMs uint32) error {
+	_, err := withSystem(id, AccessAll, timeoutMs, func(sys System, op Operation) error {
+		return ModifyComputeSystem(sys, op, requestJSON)
+	})
+	return err
+}
+
+// Properties returns a compute system's properties for a PropertyQuery
+// document, or its base properties when queryJSON is "".
+func Properties(id, queryJSON string) (string, error) {
+	sys, err := OpenComputeSystem(id, AccessRead)
+	if err != nil {
+		return "", err
+	}
+	defer CloseComputeSystem(sys)
+	return GetComputeSystemProperties(sys, queryJSON)
+}
@@ -2,319 +2,134 @@ package main
 
 import (
 	"fmt"
-	"strings"
-	"unsafe"
+	"os"
+	"time"
 
-	"golang.org/x/sys/windows"
+	"hcstool/hcs"
 )
 
-// Handle types for HCS API objects.
-type HcsSystem uintptr
-type HcsOperation uintptr
+// The HCS bindings live in package hcs so other Go programs can import them;
+// the CLI refers to them by the short names below.
+
+// Handle and error types.
+type (
+	HcsSystem    = hcs.System
+	HcsOperation = hcs.Operation
+	HcsError     = hcs.Error
+	grantTxn     = hcs.Grants
+)
 
 // Well-known HRESULTs.
 const (
-	hcsESystemNotFound       = 0xc037010e
-	hcsEHypervisorNotPresent = 0xc0351000
-	eAccessDenied            = 0x80070005
+	hcsESystemNotFound      = hcs.ESystemNotFound
+	hcsESystemAlreadyExists = hcs.ESystemAlreadyExists
+	eAccessDenied           = hcs.EAccessDenied
+	eTimeout                = hcs.ETimeout
+	eNotSupported           = hcs.ENotSupported
+	eNotFound               = hcs.ENotFound
 )
 
-// hresultMessages maps known HRESULT codes to human-readable messages.
-var hresultMessages = map[uint32]string{
-	hcsESystemNotFound:       "HCS compute system not found",
-	hcsEHypervisorNotPresent: "Hypervisor is not present — enable Hyper-V",
-	eAccessDenied:            "Access denied — run as Administrator",
-}
-
-// HcsError wraps an HCS API failure with the operation name, HRESULT, and
-// any result document returned by the operation.
-type HcsError struct {
-	Op         string
-	HR         uint32
-	ResultJSON string
-}
-
-func (e *HcsError) Error() string {
-	var sb strings.Builder
-	sb.WriteString(e.Op)
-	sb.WriteString(": HRESULT ")
-	sb.WriteString(fmt.Sprintf("0x%08x", e.HR))
-	if msg, ok := hresultMessages[e.HR]; ok {
-		sb.WriteString(" (")
-		sb.WriteString(msg)
-		sb.WriteString(")")
-	}
-	if e.ResultJSON != "" {
-		sb.WriteString("\n  result: ")
-		sb.WriteString(e.ResultJSON)
-	}
-	return sb.String()
-}
-
-// INFINITE timeout value for HcsWaitForOperationResult.
-const infinite = uint32(0xFFFFFFFF)
+const (
+	resultSuffix = hcs.ResultSuffix
+	infinite     = hcs.Infinite
+	accessRead   = hcs.AccessRead
+	accessAll    = hcs.AccessAll
+)
 
-// computecore.dll proc bindings.
 var (
-	modComputeCore = windows.NewLazySystemDLL("computecore.dll")
-
-	procHcsCreateOperation            = modComputeCore.NewProc("HcsCreateOperation")
-	procHcsCloseOperation             = modComputeCore.NewProc("HcsCloseOperation")
-	procHcsWaitForOperationResult     = modComputeCore.NewProc("HcsWaitForOperationResult")
-	procHcsCreateComputeSystem        = modComputeCore.NewProc("HcsCreateComputeSystem")
-	procHcsOpenComputeSystem          = modComputeCore.NewProc("HcsOpenComputeSystem")
-	procHcsCloseComputeSystem         = modComputeCore.NewProc("HcsCloseComputeSystem")
-	procHcsStartComputeSystem         = modComputeCore.NewProc("HcsStartComputeSystem")
-	procHcsShutDownComputeSystem      = modComputeCore.NewProc("HcsShutDownComputeSystem")
-	procHcsTerminateComputeSystem     = modComputeCore.NewProc("HcsTerminateComputeSystem")
-	procHcsEnumerateComputeSystems    = modComputeCore.NewProc("HcsEnumerateComputeSystems")
-	procHcsGetComputeSystemProperties = modComputeCore.NewProc("HcsGetComputeSystemProperties")
-	procHcsGrantVmAccess              = modComputeCore.NewProc("HcsGrantVmAccess")
-	procHcsRevokeVmAccess             = modComputeCore.NewProc("HcsRevokeVmAccess")
+	defaultTransientHRESULTs = hcs.TransientHRESULTs
+
+	isTransient            = hcs.IsTransient
+	isHRESULT              = hcs.IsHRESULT
+	withResult             = hcs.WithResult
+	findProcs              = hcs.FindProcs
+	checkHCSAvailable      = hcs.Available
+	createOperation        = hcs.CreateOperation
+	closeOperation         = hcs.CloseOperation
+	waitForResult          = hcs.WaitForResult
+	openComputeSystem      = hcs.OpenComputeSystem
+	closeComputeSystem     = hcs.CloseComputeSystem
+	terminateComputeSystem = hcs.TerminateComputeSystem
+	crashComputeSystem     = hcs.CrashComputeSystem
+	modifyComputeSystem    = hcs.ModifyComputeSystem
+	grantVmAccess          = hcs.GrantVmAccess
+	revokeVmAccess         = hcs.RevokeVmAccess
+	newGrantTxn            = hcs.NewGrants
+	terminateAndClose      = hcs.TerminateAndClose
+	getServiceProperties   = hcs.GetServiceProperties
+	modifyServiceSettings  = hcs.ModifyServiceSettings
+
+	getComputeSystemPropertiesQuery = hcs.GetComputeSystemProperties
+
+	enumerateNetworks = hcs.EnumerateNetworks
 )
 
-// hrOK checks whether an HRESULT indicates success (S_OK or S_FALSE).
-func hrOK(hr uintptr) bool {
-	return hr == 0 || hr == 1
-}
-
-// createOperation creates a new HCS operation handle. The caller must close it
-// with closeOperation after use.
-func createOperation() (HcsOperation, error) {
-	// HcsCreateOperation(context, callback) -> HCS_OPERATION
-	// We pass NULL for both context and callback (synchronous usage).
-	r1, _, _ := procHcsCreateOperation.Call(0, 0)
-	if r1 == 0 {
-		return 0, fmt.Errorf("HcsCreateOperation returned NULL")
-	}
-	return HcsOperation(r1), nil
-}
-
-// closeOperation closes an HCS operation handle.
-func closeOperation(op HcsOperation) {
-	if op != 0 {
-		procHcsCloseOperation.Call(uintptr(op))
-	}
-}
-
-// waitForResult waits for an HCS operation to complete and returns the result
-// document JSON. The operation must still be open when this is called.
-func waitForResult(op HcsOperation, timeoutMs uint32) (string, error) {
-	var resultPtr *uint16
-	hr, _, _ := procHcsWaitForOperationResult.Call(
-		uintptr(op),
-		uintptr(timeoutMs),
-		uintptr(unsafe.Pointer(&resultPtr)),
-	)
-	var resultJSON string
-	if resultPtr != nil {
-		resultJSON = windows.UTF16PtrToString(resultPtr)
-		// The result document is owned by the operation — valid until close.
-		// We copy it to a Go string above, so it's safe.
-	}
-	if !hrOK(hr) {
-		return resultJSON, &HcsError{
-			Op:         "HcsWaitForOperationResult",
-			HR:         uint32(hr),
-			ResultJSON: resultJSON,
-		}
-	}
-	return resultJSON, nil
+func init() {
+	hcs.Trace = timed
+	hcs.Leaked = warnLeakedHandle
 }
 
-// createComputeSystem creates a new HCS compute system.
-func createComputeSystem(id, configJSON string, op HcsOperation) (HcsSystem, error) {
-	idPtr, err := windows.UTF16PtrFromString(id)
-	if err != nil {
-		return 0, fmt.Errorf("invalid system id: %w", err)
-	}
-	configPtr, err := windows.UTF16PtrFromString(configJSON)
-	if err != nil {
-		return 0, fmt.Errorf("invalid config JSON: %w", err)
-	}
-
-	var sys HcsSystem
-	// HcsCreateComputeSystem(id, configuration, operation, securityDescriptor, computeSystem)
-	hr, _, _ := procHcsCreateComputeSystem.Call(
-		uintptr(unsafe.Pointer(idPtr)),
-		uintptr(unsafe.Pointer(configPtr)),
-		uintptr(op),
-		0, // security descriptor — NULL for default
-		uintptr(unsafe.Pointer(&sys)),
-	)
-	if !hrOK(hr) {
-		return 0, &HcsError{Op: "HcsCreateComputeSystem", HR: uint32(hr)}
-	}
-	return sys, nil
+// warnLeakedHandle reports an HCS handle the garbage collector found still
+// open. The handle is closed regardless; the warning points at a missing
+// close in hcstool itself.
+func warnLeakedHandle(kind string, raw uintptr) {
+	fmt.Fprintf(os.Stderr, "Warning: %s handle %#x was never closed\n", kind, raw)
 }
 
-// openComputeSystem opens an existing compute system by ID.
-func openComputeSystem(id string) (HcsSystem, error) {
-	idPtr, err := windows.UTF16PtrFromString(id)
-	if err != nil {
-		return 0, fmt.Errorf("invalid system id: %w", err)
+// timeoutMs converts a --timeout in seconds to a HcsWaitForOperationResult
+// timeout. Values too large for a uint32 of milliseconds clamp to infinite
+// instead of wrapping around to a short wait; negative values are rejected.
+func timeoutMs(seconds int) (uint32, error) {
+	if seconds < 0 {
+		return 0, fmt.Errorf("timeout must not be negative, got %d", seconds)
 	}
-
-	var sys HcsSystem
-	// HcsOpenComputeSystem(id, requestedAccess, computeSystem)
-	hr, _, _ := procHcsOpenComputeSystem.Call(
-		uintptr(unsafe.Pointer(idPtr)),
-		uintptr(0x10000000), // GENERIC_ALL
-		uintptr(unsafe.Pointer(&sys)),
-	)
-	if !hrOK(hr) {
-		return 0, &HcsError{Op: "HcsOpenComputeSystem", HR: uint32(hr)}
+	if seconds > int(infinite/1000) {
+		return infinite, nil
 	}
-	return sys, nil
+	return uint32(seconds) * 1000, nil
 }
 
-// closeComputeSystem releases the handle to a compute system. This does NOT
-// stop the VM — it just releases our reference.
-func closeComputeSystem(sys HcsSystem) {
-	if sys != 0 {
-		procHcsCloseComputeSystem.Call(uintptr(sys))
-	}
-}
+// Enumeration retry tunables. HcsEnumerateComputeSystems intermittently
+// fails with transient errors on busy hosts; every list and name or prefix
+// lookup goes through it, so it is retried enumerateRetries times with a
+// linearly growing enumerateBackoff before giving up.
+var (
+	enumerateRetries = 3
+	enumerateBackoff = 250 * time.Millisecond
+)
 
-// startComputeSystem starts a created compute system.
-func startComputeSystem(sys HcsSystem, op HcsOperation) error {
-	// HcsStartComputeSystem(computeSystem, operation, options)
-	hr, _, _ := procHcsStartComputeSystem.Call(
-		uintptr(sys),
-		uintptr(op),
-		0, // options — NULL
-	)
-	if !hrOK(hr) {
-		return &HcsError{Op: "HcsStartComputeSystem", HR: uint32(hr)}
-	}
-	return nil
-}
+// enumerateOnce performs a single enumeration; tests replace it.
+var enumerateOnce = hcs.EnumerateComputeSystems
 
-// shutdownComputeSystem initiates a clean shutdown of a compute system.
-func shutdownComputeSystem(sys HcsSystem, op HcsOperation) error {
-	// HcsShutDownComputeSystem(computeSystem, operation, options)
-	hr, _, _ := procHcsShutDownComputeSystem.Call(
-		uintptr(sys),
-		uintptr(op),
-		0,
-	)
-	if !hrOK(hr) {
-		return &HcsError{Op: "HcsShutDownComputeSystem", HR: uint32(hr)}
-	}
-	return nil
-}
+// asyncEnumerateTimeout bounds each enumeration made by useAsyncEnumeration.
+const asyncEnumerateTimeout = 30 * time.Second
 
-// terminateComputeSystem forcibly stops a compute system.
-func terminateComputeSystem(sys HcsSystem, op HcsOperation) error {
-	// HcsTerminateComputeSystem(computeSystem, operation, options)
-	hr, _, _ := procHcsTerminateComputeSystem.Call(
-		uintptr(sys),
-		uintptr(op),
-		0,
-	)
-	if !hrOK(hr) {
-		return &HcsError{Op: "HcsTerminateComputeSystem", HR: uint32(hr)}
+// useAsyncEnumeration makes enumerations wait for their result through an
+// HCS completion callback instead of a blocking HcsWaitForOperationResult
+// (wait --async). A timed-out enumeration is retried like any transient
+// failure.
+func useAsyncEnumeration() {
+	enumerateOnce = func(queryJSON string) (string, error) {
+		return hcs.EnumerateComputeSystemsAsync(queryJSON, asyncEnumerateTimeout)
 	}
-	return nil
 }
 
-// enumerateComputeSystems enumerates all HCS compute systems and returns
-// the result JSON (an array of system descriptors).
-func enumerateComputeSystems() (string, error) {
-	op, err := createOperation()
-	if err != nil {
-		return "", err
-	}
-	defer closeOperation(op)
-
-	// HcsEnumerateComputeSystems(query, operation)
-	// Pass NULL query to list all.
-	hr, _, _ := procHcsEnumerateComputeSystems.Call(0, uintptr(op))
-	if !hrOK(hr) {
-		return "", &HcsError{Op: "HcsEnumerateComputeSystems", HR: uint32(hr)}
+// enumerateComputeSystems enumerates the HCS compute systems matching
+// queryJSON (a SystemQuery document; "" lists all) and returns the result
+// JSON (an array of system descriptors), retrying transient failures.
+func enumerateComputeSystems(queryJSON string) (string, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := enumerateOnce(queryJSON)
+		if err == nil || attempt > enumerateRetries || !isTransient(err, defaultTransientHRESULTs) {
+			return result, err
+		}
+		backoff := time.Duration(attempt) * enumerateBackoff
+		verbosef("enumerate attempt %d failed, retrying in %s: %v", attempt, backoff, err)
+		time.Sleep(backoff)
 	}
-
-	return waitForResult(op, infinite)
 }
 
 // getComputeSystemProperties retrieves properties of a compute system (NULL query).
 func getComputeSystemProperties(sys HcsSystem) (string, error) {
 	return getComputeSystemPropertiesQuery(sys, "")
 }
-
-// getComputeSystemPropertiesQuery retrieves properties using a PropertyQuery JSON.
-// Pass empty string for queryJSON to use NULL (basic properties only).
-func getComputeSystemPropertiesQuery(sys HcsSystem, queryJSON string) (string, error) {
-	op, err := createOperation()
-	if err != nil {
-		return "", err
-	}
-	defer closeOperation(op)
-
-	var queryArg uintptr
-	if queryJSON != "" {
-		qPtr, err := windows.UTF16PtrFromString(queryJSON)
-		if err != nil {
-			return "", fmt.Errorf("invalid query JSON: %w", err)
-		}
-		queryArg = uintptr(unsafe.Pointer(qPtr))
-	}
-
-	// HcsGetComputeSystemProperties(computeSystem, operation, propertyQuery)
-	hr, _, _ := procHcsGetComputeSystemProperties.Call(
-		uintptr(sys),
-		uintptr(op),
-		queryArg,
-	)
-	if !hrOK(hr) {
-		return "", &HcsError{Op: "HcsGetComputeSystemProperties", HR: uint32(hr)}
-	}
-
-	return waitForResult(op, infinite)
-}
-
-// grantVmAccess grants a VM (by ID) access to a file on the host. The file
-// path must be absolute. This is synchronous — no operation handle needed.
-func grantVmAccess(vmID, filePath string) error {
-	vmIDPtr, err := windows.UTF16PtrFromString(vmID)
-	if err != nil {
-		return fmt.Errorf("invalid VM ID: %w", err)
-	}
-	filePathPtr, err := windows.UTF16PtrFromString(filePath)
-	if err != nil {
-		return fmt.Errorf("invalid file path: %w", err)
-	}
-
-	hr, _, _ := procHcsGrantVmAccess.Call(
-		uintptr(unsafe.Pointer(vmIDPtr)),
-		uintptr(unsafe.Pointer(filePathPtr)),
-	)
-	if !hrOK(hr) {
-		return &HcsError{
-			Op:         fmt.Sprintf("HcsGrantVmAccess(%s)", filePath),
-			HR:         uint32(hr),
-		}
-	}
-	return nil
-}
-
-// revokeVmAccess revokes a VM's access to a file previously granted.
-func revokeVmAccess(vmID, filePath string) error {
-	vmIDPtr, err := windows.UTF16PtrFromString(vmID)
-	if err != nil {
-		return err
-	}
-	filePathPtr, err := windows.UTF16PtrFromString(filePath)
-	if err != nil {
-		return err
-	}
-
-	hr, _, _ := procHcsRevokeVmAccess.Call(
-		uintptr(unsafe.Pointer(vmIDPtr)),
-		uintptr(unsafe.Pointer(filePathPtr)),
-	)
-	if !hrOK(hr) {
-		return &HcsError{Op: fmt.Sprintf("HcsRevokeVmAccess(%s)", filePath), HR: uint32(hr)}
-	}
-	return nil
-}
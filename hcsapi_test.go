@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestTimeoutMs(t *testing.T) {
+	maxSeconds := int(infinite / 1000) // 4294967
+	tests := []struct {
+		seconds int
+		want    uint32
+	}{
+		{0, 0},
+		{30, 30000},
+		{maxSeconds, uint32(maxSeconds) * 1000},
+		{maxSeconds + 1, infinite},
+		{5000000, infinite},
+		{math.MaxInt32, infinite},
+	}
+	for _, tt := range tests {
+		got, err := timeoutMs(tt.seconds)
+		if err != nil {
+			t.Errorf("timeoutMs(%d): %v", tt.seconds, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("timeoutMs(%d) = %d, want %d", tt.seconds, got, tt.want)
+		}
+	}
+	if _, err := timeoutMs(-1); err == nil {
+		t.Error("timeoutMs(-1) succeeded, want error")
+	}
+}
+
+func TestEnumerateRetriesTransientErrors(t *testing.T) {
+	origOnce, origBackoff := enumerateOnce, enumerateBackoff
+	defer func() { enumerateOnce, enumerateBackoff = origOnce, origBackoff }()
+	enumerateBackoff = 0
+
+	calls := 0
+	enumerateOnce = func(string) (string, error) {
+		calls++
+		if calls == 1 {
+			return "", &HcsError{Op: "HcsEnumerateComputeSystems", HR: 0x80370109}
+		}
+		return "[]", nil
+	}
+	got, err := enumerateComputeSystems("")
+	if err != nil || got != "[]" || calls != 2 {
+		t.Errorf("transient failure: got (%q, %v) after %d calls, want ([], nil) after 2", got, err, calls)
+	}
+
+	calls = 0
+	enumerateOnce = func(string) (string, error) {
+		calls++
+		return "", &HcsError{Op: "HcsEnumerateComputeSystems", HR: eAccessDenied}
+	}
+	if _, err := enumerateComputeSystems(""); err == nil || calls != 1 {
+		t.Errorf("non-transient failure: err = %v after %d calls, want an error after 1", err, calls)
+	}
+
+	calls = 0
+	enumerateOnce = func(string) (string, error) {
+		calls++
+		return "", &HcsError{Op: "HcsEnumerateComputeSystems", HR: 0x80370114}
+	}
+	if _, err := enumerateComputeSystems(""); err == nil || calls != enumerateRetries+1 {
+		t.Errorf("persistent transient failure: err = %v after %d calls, want an error after %d", err, calls, enumerateRetries+1)
+	}
+}
+
+// processMemoryCountersEx mirrors PROCESS_MEMORY_COUNTERS_EX.
+type processMemoryCountersEx struct {
+	CB                         uint32
+	PageFaultCount             uint32
+	PeakWorkingSetSize         uintptr
+	WorkingSetSize             uintptr
+	QuotaPeakPagedPoolUsage    uintptr
+	QuotaPagedPoolUsage        uintptr
+	QuotaPeakNonPagedPoolUsage uintptr
+	QuotaNonPagedPoolUsage     uintptr
+	PagefileUsage              uintptr
+	PeakPagefileUsage          uintptr
+	PrivateUsage               uintptr
+}
+
+var procK32GetProcessMemoryInfo = windows.NewLazySystemDLL("kernel32.dll").NewProc("K32GetProcessMemoryInfo")
+
+func privateBytes(t *testing.T) uintptr {
+	var c processMemoryCountersEx
+	c.CB = uint32(unsafe.Sizeof(c))
+	r, _, err := procK32GetProcessMemoryInfo.Call(
+		uintptr(windows.CurrentProcess()),
+		uintptr(unsafe.Pointer(&c)),
+		uintptr(c.CB),
+	)
+	if r == 0 {
+		t.Fatalf("K32GetProcessMemoryInfo: %v", err)
+	}
+	return c.PrivateUsage
+}
+
+// TestWaitForResultNoLeak creates and waits on many operations and checks
+// that private memory stays flat, i.e. result documents are freed. The check
+// is coarse: it catches a per-operation leak, not a few stray bytes.
+func TestWaitForResultNoLeak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+	if err := checkHCSAvailable(); err != nil {
+		t.Skipf("HCS not available: %v", err)
+	}
+	if _, err := enumerateComputeSystems(""); err != nil {
+		t.Skipf("HCS not usable: %v", err)
+	}
+
+	const (
+		warmup     = 200
+		iterations = 20000
+		maxGrowth  = 2 << 20
+	)
+	for i := 0; i < warmup; i++ {
+		enumerateComputeSystems("")
+	}
+	before := privateBytes(t)
+	for i := 0; i < iterations; i++ {
+		if _, err := enumerateComputeSystems(""); err != nil {
+			t.Fatalf("iteration %d: %v", i, err)
+		}
+	}
+	after := privateBytes(t)
+
+	if after > before && after-before > maxGrowth {
+		t.Errorf("private bytes grew by %d over %d operations (before %d, after %d)",
+			after-before, iterations, before, after)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// vmIDEnvVar carries the new VM's ID to the --on-start hook.
+const vmIDEnvVar = "HCSTOOL_VM_ID"
+
+// hookCommand builds the command that runs a hook command line through
+// cmd.exe. The line is handed over verbatim, so quoting follows cmd's rules
+// just as if it were typed at a prompt. Its output goes to stderr, keeping
+// stdout for the ID that create prints.
+func hookCommand(line, vmID string) *exec.Cmd {
+	shell := os.Getenv("ComSpec")
+	if shell == "" {
+		shell = "cmd.exe"
+	}
+	cmd := exec.Command(shell)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CmdLine: syscall.EscapeArg(shell) + ` /d /s /c "` + line + `"`,
+	}
+	cmd.Env = append(os.Environ(), vmIDEnvVar+"="+vmID)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// runOnStartHook runs opts.OnStart, if set, for a VM that has just started.
+// A failing hook is only a warning unless opts.OnStartRequired is set, in
+// which case its error is returned.
+func runOnStartHook(vmID string, opts CreateOptions) error {
+	if opts.OnStart == "" {
+		return nil
+	}
+	progress(progressEvent{Event: "hook", ID: vmID}, "  Running --on-start hook")
+	done := timed("on-start hook")
+	err := hookCommand(opts.OnStart, vmID).Run()
+	done()
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("--on-start hook: %w", err)
+	if opts.OnStartRequired {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHookCommand(t *testing.T) {
+	t.Setenv("ComSpec", `C:\Windows\System32\cmd.exe`)
+	cmd := hookCommand(`register.cmd "my vm"`, "01234567-89ab-cdef-0123-456789abcdef")
+
+	if want := `C:\Windows\System32\cmd.exe /d /s /c "register.cmd "my vm""`; cmd.SysProcAttr.CmdLine != want {
+		t.Errorf("CmdLine = %q, want %q", cmd.SysProcAttr.CmdLine, want)
+	}
+	var found bool
+	for _, kv := range cmd.Env {
+		if strings.HasPrefix(kv, vmIDEnvVar+"=") {
+			found = kv == vmIDEnvVar+"=01234567-89ab-cdef-0123-456789abcdef"
+		}
+	}
+	if !found {
+		t.Errorf("%s not set in the hook environment", vmIDEnvVar)
+	}
+}
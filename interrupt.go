@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// exitInterrupted is the exit code after a create is interrupted by a signal
+// (128 + SIGINT, as shells report it).
+const exitInterrupted = 130
+
+// pendingCreate is the undo state of a launchVM in progress: what the
+// interrupt handler has to tear down if the user hits Ctrl-C mid-create.
+type pendingCreate struct {
+	vmID     string
+	keepACLs bool
+	grants   *grantTxn
+
+	// Guarded by pendingMu.
+	sys   HcsSystem
+	saved bool
+}
+
+var (
+	pendingMu     sync.Mutex
+	pending       = map[*pendingCreate]bool{}
+	interruptOnce sync.Once
+)
+
+// trackCreate registers an in-progress create so an interrupt can undo it,
+// installing the signal handler on first use. The caller makes its grants
+// through grants, reports the system handle with created, and must call
+// untrack before doing its own cleanup or returning, so exactly one side
+// undoes the work.
+func trackCreate(vmID string, keepACLs bool, grants *grantTxn) *pendingCreate {
+	interruptOnce.Do(func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go handleInterrupt(sigs)
+	})
+
+	p := &pendingCreate{vmID: vmID, keepACLs: keepACLs, grants: grants}
+	pendingMu.Lock()
+	pending[p] = true
+	pendingMu.Unlock()
+	return p
+}
+
+// created records the handle of the compute system once HCS returns it.
+func (p *pendingCreate) created(sys HcsSystem) {
+	pendingMu.Lock()
+	p.sys = sys
+	pendingMu.Unlock()
+}
+
+// specSaved records that the system's spec was saved, so an interrupt
+// removes it along with the system.
+func (p *pendingCreate) specSaved() {
+	pendingMu.Lock()
+	p.saved = true
+	pendingMu.Unlock()
+}
+
+// untrack hands cleanup responsibility back to the caller. If an interrupt is
+// already being handled this blocks until the process exits.
+func (p *pendingCreate) untrack() {
+	pendingMu.Lock()
+	delete(pending, p)
+	pendingMu.Unlock()
+}
+
+// handleInterrupt waits for a signal, undoes every tracked create and exits.
+// pendingMu is held until exit so in-flight creates can't race the cleanup.
+func handleInterrupt(sigs <-chan os.Signal) {
+	sig := <-sigs
+	pendingMu.Lock()
+	fmt.Fprintf(os.Stderr, "\nReceived %v, cleaning up %d in-progress create(s)...\n", sig, len(pending))
+	for p := range pending {
+		if p.sys.Valid() {
+			fmt.Fprintf(os.Stderr, "  Terminating %s\n", p.vmID)
+			terminateAndClose(p.sys)
+		}
+		if p.saved {
+			removeSavedSpec(p.vmID)
+		}
+		if p.keepACLs {
+			for _, path := range p.grants.Paths() {
+				fmt.Fprintf(os.Stderr, "  Keeping VM access for %s on %s\n", p.vmID, path)
+			}
+			continue
+		}
+		if err := p.grants.Rollback(); err != nil {
+			fmt.Fprintf(os.Stderr, "  Warning: %v\n", err)
+		}
+	}
+	exit(exitInterrupted)
+}
@@ -1,179 +1,280 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"text/tabwriter"
 
 	"golang.org/x/sys/windows"
+
+	"hcstool/hcs"
 )
 
-func usage() {
-	fmt.Fprintf(os.Stderr, `hcstool — HCS VM Lifecycle Tool
+// command describes a CLI subcommand in the registry.
+type command struct {
+	name           string
+	usage          string // argument synopsis; one line per alternative form
+	summary        string // one-line description for the command list
+	needsElevation bool   // refused unless elevated, except with --dry-run
+	needsHCS       bool   // checked with checkHCSAvailable before running
 
-Usage:
-  hcstool create --spec file.json [--gpu] [--name myvm]
-  hcstool create --vhdx boot.vhdx [--memory 2048] [--cpus 2] [--gpu] [--name myvm]
-  hcstool list
-  hcstool inspect <vm-id>
-  hcstool dump <vm-id>
-  hcstool stop <vm-id> [--timeout 30]
-  hcstool kill <vm-id>
-
-Commands:
-  create    Create and start a VM from a JSON spec or VHDX file
-  list      List all HCS compute systems
-  inspect   Show basic properties of a compute system
-  dump      Dump all available properties (memory, devices, stats, etc.)
-  stop      Gracefully shut down a compute system
-  kill      Forcibly terminate a compute system
-`)
+	// setup registers the command's flags on fs and returns the func that
+	// runs it with the positional arguments left after flag parsing.
+	setup func(fs *flag.FlagSet) func(args []string) error
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		usage()
-		os.Exit(1)
-	}
-
-	// Admin elevation check
-	token := windows.GetCurrentProcessToken()
-	elevated := token.IsElevated()
-	if !elevated {
-		fmt.Fprintln(os.Stderr, "Warning: not running as Administrator. HCS operations require elevation.")
-	}
-
-	cmd := os.Args[1]
-	switch cmd {
-	case "create":
-		cmdCreate(os.Args[2:])
-	case "list":
-		cmdList()
-	case "inspect":
-		cmdInspect(os.Args[2:])
-	case "dump":
-		cmdDump(os.Args[2:])
-	case "stop":
-		cmdStop(os.Args[2:])
-	case "kill":
-		cmdKill(os.Args[2:])
-	case "help", "--help", "-h":
-		usage()
-	default:
-		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", cmd)
-		usage()
-		os.Exit(1)
+// commands is the registry of subcommands, keyed by name. commandOrder keeps
+// registration order for help output.
+var (
+	commands     = map[string]*command{}
+	commandOrder []string
+)
+
+// register adds a command to the registry.
+func register(c *command) {
+	if _, dup := commands[c.name]; dup {
+		panic("duplicate command " + c.name)
 	}
+	commands[c.name] = c
+	commandOrder = append(commandOrder, c.name)
+}
+
+// exitNotElevated is the exit code for commands refused for lack of elevation.
+const exitNotElevated = 3
+
+// usageError reports bad command-line usage; main prints the command's usage
+// after the message.
+type usageError struct {
+	msg string
 }
 
-func cmdCreate(args []string) {
-	fs := flag.NewFlagSet("create", flag.ExitOnError)
-	specFile := fs.String("spec", "", "Path to HCS v2 JSON spec file")
-	vhdxPath := fs.String("vhdx", "", "Path to bootable VHDX file (quick-create mode)")
-	memoryMB := fs.Int("memory", 2048, "Memory in MB (quick-create mode)")
-	cpuCount := fs.Int("cpus", 2, "Number of virtual CPUs (quick-create mode)")
-	gpu := fs.Bool("gpu", false, "Enable GPU-PV passthrough")
-	name := fs.String("name", "", "Friendly name for the VM")
-	dryRun := fs.Bool("dry-run", false, "Print the generated spec without creating the VM")
-	fs.Parse(args)
+func (e *usageError) Error() string { return e.msg }
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// exitError makes main exit with a specific code without printing anything
+// further (the command has already reported the outcome).
+type exitError struct {
+	code int
+}
 
-	if *specFile == "" && *vhdxPath == "" {
-		fmt.Fprintln(os.Stderr, "Error: specify either --spec or --vhdx")
-		fs.Usage()
-		os.Exit(1)
+func (e *exitError) Error() string { return fmt.Sprintf("exit status %d", e.code) }
+
+func usage() {
+	fmt.Fprint(os.Stderr, `hcstool — HCS VM Lifecycle Tool
+
+Usage:
+  hcstool [--verbose] [--verbose-hcs] [--json-errors] [--log-file f [--log-format json]] <command> [args]
+
+`)
+	for _, name := range commandOrder {
+		for _, line := range strings.Split(commands[name].usage, "\n") {
+			fmt.Fprintf(os.Stderr, "  hcstool %s %s\n", name, line)
+		}
 	}
 
-	if *specFile != "" && *vhdxPath != "" {
-		fmt.Fprintln(os.Stderr, "Error: --spec and --vhdx are mutually exclusive")
-		os.Exit(1)
+	fmt.Fprint(os.Stderr, "\nCommands:\n")
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, name := range commandOrder {
+		fmt.Fprintf(w, "  %s\t%s\n", name, commands[name].summary)
 	}
+	w.Flush()
 
-	var specJSON string
-	var err error
+	fmt.Fprint(os.Stderr, `
+VM IDs may be abbreviated to any unique prefix, or replaced by
+--name <name> to select a VM by its friendly name.
 
-	if *specFile != "" {
-		specJSON, err = readSpecFile(*specFile)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
-		}
-	} else {
-		specJSON, err = buildSpecFromFlags(*vhdxPath, *memoryMB, *cpuCount, *gpu)
-		if err != nil {
+Owner precedence for create/import:
+  --owner flag > $HCSTOOL_OWNER > Owner in the spec file > "hcstool"
+
+Global flags:
+  --verbose      Log per-operation timings and extra diagnostics to stderr,
+                 and break HRESULTs in errors down into severity/facility/code
+  --verbose-hcs  Print each create and modify document, pretty, to stderr
+                 just before it is sent to HCS (the operation still runs)
+  --log-file f   Also append everything written to stderr to f, timestamped
+  --log-format   Log file format: text (default) or json (one object per line)
+  --json-errors  Report failures as one JSON object on stderr:
+                 {"op":...,"hresult":"0x...","message":...,"result":{...}}
+
+Run "hcstool <command> -h" for a command's flags.
+`)
+}
+
+func main() {
+	global := flag.NewFlagSet("hcstool", flag.ContinueOnError)
+	global.Usage = usage
+	global.BoolVar(&verbose, "verbose", false, "Log per-operation timings to stderr")
+	global.BoolVar(&verboseHCS, "verbose-hcs", false, "Print each create and modify document sent to HCS to stderr")
+	global.BoolVar(&jsonErrors, "json-errors", false, "Report failures as a JSON object on stderr")
+	logFile := global.String("log-file", "", "Also append stderr output, timestamped, to this file")
+	logFormat := global.String("log-format", "text", "Log file line format: text or json")
+	if err := global.Parse(os.Args[1:]); err != nil {
+		exitParseError(err)
+	}
+	hcs.DecodeHRESULTs = verbose
+	if *logFile != "" {
+		if err := startLogFile(*logFile, *logFormat); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
-		// GPU already injected by buildSpecFromFlags, don't inject again
-		*gpu = false
 	}
+	defer closeLog()
+	args := global.Args()
 
-	if *dryRun {
-		printSpec(specJSON)
+	if len(args) < 1 {
+		usage()
+		exit(1)
+	}
+
+	name := args[0]
+	if name == "help" || name == "--help" || name == "-h" {
+		usage()
 		return
 	}
 
-	if err := CreateAndStartVM(specJSON, *name, *gpu); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	c, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+		usage()
+		exit(1)
 	}
-}
 
-func cmdList() {
-	if err := ListVMs(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		for _, line := range strings.Split(c.usage, "\n") {
+			fmt.Fprintf(os.Stderr, "Usage: hcstool %s %s\n", name, line)
+		}
+		fs.PrintDefaults()
+	}
+	run := c.setup(fs)
+	positional := parseArgs(fs, args[1:])
+
+	// Admin elevation check, once the flags are known. Read-only commands
+	// run best-effort without it; commands that change state fail fast
+	// instead of deep inside HCS.
+	if !windows.GetCurrentProcessToken().IsElevated() {
+		if requiresElevation(c, fs) {
+			fmt.Fprintf(os.Stderr, "Error: %q requires Administrator. Re-run from an elevated prompt.\n", name)
+			exit(exitNotElevated)
+		}
+		verbosef("not running as Administrator; %s may return partial results", name)
 	}
-}
 
-func cmdInspect(args []string) {
-	if len(args) < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: hcstool inspect <vm-id>")
-		os.Exit(1)
+	if c.needsHCS {
+		if err := checkHCSAvailable(); err != nil {
+			printError(err)
+			exit(1)
+		}
 	}
-	if err := InspectVM(args[0]); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+
+	endScope := scopeResolverCache()
+	err := run(positional)
+	endScope()
+	if err != nil {
+		var uerr *usageError
+		var xerr *exitError
+		switch {
+		case errors.As(err, &xerr):
+			exit(xerr.code)
+		case errors.As(err, &uerr) && !jsonErrors:
+			fmt.Fprintf(os.Stderr, "Error: %v\n", uerr)
+			fs.Usage()
+		default:
+			printError(err)
+		}
+		exit(1)
 	}
 }
 
-func cmdDump(args []string) {
-	if len(args) < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: hcstool dump <vm-id>")
-		os.Exit(1)
+// requiresElevation reports whether c, run with the flags parsed into fs,
+// must be elevated. A --dry-run changes nothing, so it never does.
+func requiresElevation(c *command, fs *flag.FlagSet) bool {
+	if !c.needsElevation {
+		return false
 	}
-	if err := DumpVM(args[0]); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	if f := fs.Lookup("dry-run"); f != nil && f.Value.String() == "true" {
+		return false
 	}
+	return true
 }
 
-func cmdStop(args []string) {
-	fs := flag.NewFlagSet("stop", flag.ExitOnError)
-	timeout := fs.Int("timeout", 30, "Shutdown timeout in seconds")
-	fs.Parse(args)
+// keyValueFlag is a repeatable key=value flag (e.g. --set memory=4096).
+type keyValueFlag map[string]string
 
-	remaining := fs.Args()
-	if len(remaining) < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: hcstool stop <vm-id> [--timeout 30]")
-		os.Exit(1)
+func (kv keyValueFlag) String() string {
+	pairs := make([]string, 0, len(kv))
+	for k, v := range kv {
+		pairs = append(pairs, k+"="+v)
 	}
+	return strings.Join(pairs, ",")
+}
 
-	timeoutMs := uint32(*timeout * 1000)
-	if err := StopVM(remaining[0], timeoutMs); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+func (kv keyValueFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
 	}
-	fmt.Fprintln(os.Stderr, "Compute system shut down successfully.")
+	kv[k] = v
+	return nil
 }
 
-func cmdKill(args []string) {
-	if len(args) < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: hcstool kill <vm-id>")
-		os.Exit(1)
+// stringListFlag is a repeatable string flag (e.g. --vhdx a.vhdx --vhdx b.vhdx).
+type stringListFlag []string
+
+func (l *stringListFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *stringListFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// exitParseError exits after a flag parse error, which the flag package has
+// already reported along with the usage. -h exits 0, as with ExitOnError.
+func exitParseError(err error) {
+	if errors.Is(err, flag.ErrHelp) {
+		exit(0)
+	}
+	exit(2)
+}
+
+// parseArgs parses flags that may appear before or after positional
+// arguments (e.g. "stop <vm-id> --timeout 30") and returns the positionals.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			exitParseError(err)
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
-	if err := KillVM(args[0]); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+}
+
+// addVMSelector registers --name on fs so a command can select its VM either
+// by <vm-id> (or unique prefix) or by friendly name. After parsing, call the
+// returned func with the positional args; it returns the resolved VM ID and
+// the positionals that follow it.
+func addVMSelector(fs *flag.FlagSet) func(positional []string) (string, []string, error) {
+	name := fs.String("name", "", "Select the VM by friendly name instead of ID")
+	return func(positional []string) (string, []string, error) {
+		if *name != "" {
+			id, err := resolveVMName(*name)
+			return id, positional, err
+		}
+		if len(positional) < 1 {
+			return "", nil, usageErrorf("specify a <vm-id> or --name")
+		}
+		id, err := resolveVMID(positional[0])
+		return id, positional[1:], err
 	}
-	fmt.Fprintln(os.Stderr, "Compute system terminated.")
 }
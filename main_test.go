@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+// TestCommandSetup registers every command's flags on a fresh FlagSet, as
+// main does, so a flag defined twice (which panics) is caught for all of
+// them.
+func TestCommandSetup(t *testing.T) {
+	for _, name := range commandOrder {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("setup panicked: %v", r)
+				}
+			}()
+			commands[name].setup(flag.NewFlagSet(name, flag.ContinueOnError))
+		})
+	}
+}
+
+func TestRequiresElevation(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		want bool
+	}{
+		{"create", nil, true},
+		{"create", []string{"--dry-run"}, false},
+		{"create", []string{"--dry-run=false"}, true},
+		{"kill", []string{"--dry-run"}, false},
+		{"list", nil, false},
+	} {
+		c := commands[tc.name]
+		fs := flag.NewFlagSet(tc.name, flag.ContinueOnError)
+		c.setup(fs)
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatalf("%s %v: %v", tc.name, tc.args, err)
+		}
+		if got := requiresElevation(c, fs); got != tc.want {
+			t.Errorf("requiresElevation(%s %v) = %v, want %v", tc.name, tc.args, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"hcstool/hcs"
+)
+
+// ModifySettingRequest is the HCS document for changing a running system's
+// configuration. ResourcePath addresses the setting within the VM schema,
+// e.g. "VirtualMachine/Devices/Scsi/Primary/Attachments/1".
+type ModifySettingRequest struct {
+	ResourcePath string      `json:"ResourcePath"`
+	RequestType  string      `json:"RequestType"` // Add, Remove or Update
+	Settings     interface{} `json:"Settings,omitempty"`
+}
+
+// readModifyFile reads a --post-create-modify file: one ModifySettingRequest
+// or an array of them, applied in order. Relative paths in the requests'
+// Settings are resolved against the file's directory, as spec disk paths
+// are against the spec's.
+func readModifyFile(path string) ([]ModifySettingRequest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading modify file: %w", err)
+	}
+	var reqs []ModifySettingRequest
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(data, &reqs)
+	} else {
+		var req ModifySettingRequest
+		err = json.Unmarshal(data, &req)
+		reqs = []ModifySettingRequest{req}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid modify request: %w", path, err)
+	}
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("%s holds no modify requests", path)
+	}
+
+	baseDir := filepath.Dir(path)
+	for i := range reqs {
+		if reqs[i].ResourcePath == "" || reqs[i].RequestType == "" {
+			return nil, fmt.Errorf("%s: request %d needs a ResourcePath and a RequestType", path, i+1)
+		}
+		if err := resolveSettingPaths(reqs[i].Settings, baseDir); err != nil {
+			return nil, fmt.Errorf("%s: request %d: %w", path, i+1, err)
+		}
+	}
+	return reqs, nil
+}
+
+// settingHostPath reports whether a "Path" value in a modify request's
+// Settings names a host file: device paths such as \\.\PhysicalDrive2 are
+// not, and neither are empty ones.
+func settingHostPath(p string) bool {
+	return p != "" && !strings.HasPrefix(p, `\\.\`) && !strings.HasPrefix(p, `\\?\`)
+}
+
+// resolveSettingPaths walks decoded Settings JSON and makes every host file
+// "Path" value absolute, relative ones against baseDir.
+func resolveSettingPaths(v interface{}, baseDir string) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			if p, ok := val.(string); ok && strings.EqualFold(key, "Path") && settingHostPath(p) {
+				if !filepath.IsAbs(p) {
+					p = filepath.Join(baseDir, p)
+				}
+				abs, err := filepath.Abs(p)
+				if err != nil {
+					return fmt.Errorf("cannot resolve path %q: %w", val, err)
+				}
+				v[key] = abs
+				continue
+			}
+			if err := resolveSettingPaths(val, baseDir); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, val := range v {
+			if err := resolveSettingPaths(val, baseDir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// modifyRequestPaths lists the host files the requests' Settings reference
+// through "Path" values, once each, so the VM can be granted access to them
+// before they are applied.
+func modifyRequestPaths(reqs []ModifySettingRequest) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				val := v[key]
+				if p, ok := val.(string); ok && strings.EqualFold(key, "Path") && settingHostPath(p) {
+					if !seen[strings.ToLower(p)] {
+						seen[strings.ToLower(p)] = true
+						paths = append(paths, p)
+					}
+					continue
+				}
+				walk(val)
+			}
+		case []interface{}:
+			for _, val := range v {
+				walk(val)
+			}
+		}
+	}
+	for _, req := range reqs {
+		walk(req.Settings)
+	}
+	return paths
+}
+
+// modifyVM sends a single ModifySettingRequest to a compute system and waits
+// for it to apply.
+func modifyVM(id string, req ModifySettingRequest) error {
+	defer timed("modify " + req.RequestType + " " + req.ResourcePath)()
+
+	reqJSON, err := modifyRequestJSON(req)
+	if err != nil {
+		return err
+	}
+	return hcs.Modify(id, reqJSON, infinite)
+}
+
+// modifyRequestJSON serializes req, logging and tracing it as it is sent.
+func modifyRequestJSON(req ModifySettingRequest) (string, error) {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	verbosef("modify request: %s", reqJSON)
+	traceHCSDocument("HcsModifyComputeSystem", req.ResourcePath, string(reqJSON))
+	return string(reqJSON), nil
+}
+
+// modifyRunningSystem is modifyVM for a system handle that is already open.
+func modifyRunningSystem(sys HcsSystem, req ModifySettingRequest) error {
+	defer timed("modify " + req.RequestType + " " + req.ResourcePath)()
+
+	reqJSON, err := modifyRequestJSON(req)
+	if err != nil {
+		return err
+	}
+
+	op, err := createOperation()
+	if err != nil {
+		return err
+	}
+	defer closeOperation(op)
+
+	if err := modifyComputeSystem(sys, op, reqJSON); err != nil {
+		return err
+	}
+	resultJSON, err := waitForResult(op, infinite)
+	return withResult(err, resultJSON)
+}
+
+// previewModify prints the request that modifyVM would send to id, after
+// confirming the system exists, without applying it.
+func previewModify(id string, req ModifySettingRequest) error {
+	desc, err := describeSystem(id)
+	if err != nil {
+		return err
+	}
+	reqJSON, err := json.MarshalIndent(req, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Would send to %s:\n", desc)
+	fmt.Println(string(reqJSON))
+	return nil
+}
+
+// scsiAttachmentPath is the modify ResourcePath of a SCSI attachment slot.
+func scsiAttachmentPath(controller string, slot int) string {
+	return fmt.Sprintf("VirtualMachine/Devices/Scsi/%s/Attachments/%d", controller, slot)
+}
+
+// SwapISO changes the media in a VM's SCSI DVD drive without a reboot, or
+// removes it when eject is set. If the slot already holds an ISO attachment
+// its media is updated in place; if the update fails with ERROR_NOT_FOUND
+// (the slot is empty) a new ISO attachment is added, and any other failure
+// is returned as is. VM access to the new ISO is granted first and revoked
+// again if the modify fails. The change is recorded in the system's saved
+// spec. With dryRun the request is printed instead of sent.
+func SwapISO(id, controller string, slot int, isoPath string, eject, dryRun bool) error {
+	resourcePath := scsiAttachmentPath(controller, slot)
+
+	if eject {
+		if dryRun {
+			return previewModify(id, ModifySettingRequest{ResourcePath: resourcePath, RequestType: "Remove"})
+		}
+		if err := modifyVM(id, ModifySettingRequest{ResourcePath: resourcePath, RequestType: "Remove"}); err != nil {
+			return err
+		}
+		recordAttachment(id, controller, slot, nil)
+		fmt.Fprintf(os.Stderr, "Ejected media from %s slot %d.\n", controller, slot)
+		return nil
+	}
+
+	absPath, err := filepath.Abs(isoPath)
+	if err != nil {
+		return fmt.Errorf("cannot resolve ISO path: %w", err)
+	}
+	if _, err := os.Stat(absPath); err != nil {
+		return fmt.Errorf("ISO not found: %w", err)
+	}
+
+	attachment := &ScsiAttachment{Type: attachIso, Path: absPath}
+	if dryRun {
+		// An empty slot would fall back to Add with the same settings.
+		return previewModify(id, ModifySettingRequest{ResourcePath: resourcePath, RequestType: "Update", Settings: attachment})
+	}
+
+	grants := newGrantTxn(id)
+	if err := grants.Grant(absPath); err != nil {
+		return fmt.Errorf("grant access to %s: %w", absPath, err)
+	}
+
+	err = modifyVM(id, ModifySettingRequest{ResourcePath: resourcePath, RequestType: "Update", Settings: attachment})
+	action := "Swapped media in"
+	if isHRESULT(err, eNotFound) {
+		// Update only works on an existing drive; an empty slot needs Add.
+		verbosef("update failed (%v), adding a new ISO attachment instead", err)
+		err = modifyVM(id, ModifySettingRequest{ResourcePath: resourcePath, RequestType: "Add", Settings: attachment})
+		action = "Attached ISO at"
+	}
+	if err != nil {
+		if rerr := grants.Rollback(); rerr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", rerr)
+		}
+		return err
+	}
+
+	recordAttachment(id, controller, slot, attachment)
+	fmt.Fprintf(os.Stderr, "%s %s slot %d: %s\n", action, controller, slot, absPath)
+	return nil
+}
+
+// maxScsiSlots is the number of attachments a Hyper-V SCSI controller holds.
+const maxScsiSlots = 64
+
+// savedScsiAttachments returns the attachments of one SCSI controller as
+// recorded in the saved spec of system id. HCS does not report a running
+// system's attachments, so this is the only record of them.
+func savedScsiAttachments(id, controller string) (map[string]*ScsiAttachment, error) {
+	spec, err := loadSavedSpec(id)
+	if err != nil {
+		return nil, err
+	}
+	if spec.VirtualMachine == nil || spec.VirtualMachine.Devices == nil || spec.VirtualMachine.Devices.Scsi[controller] == nil {
+		return nil, fmt.Errorf("the saved spec of %s has no SCSI controller %q", id, controller)
+	}
+	return spec.VirtualMachine.Devices.Scsi[controller].Attachments, nil
+}
+
+// nextFreeSlot returns the lowest slot number not present in attachments.
+func nextFreeSlot(attachments map[string]*ScsiAttachment) (int, error) {
+	for slot := 0; slot < maxScsiSlots; slot++ {
+		if _, used := attachments[strconv.Itoa(slot)]; !used {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("all %d slots are in use", maxScsiSlots)
+}
+
+// recordAttachment records a successful change of a SCSI slot in the saved
+// spec of system id (nil attachment: the slot was emptied), so inspect,
+// export, clone and later slot picks see it. The VM has already changed, so
+// a failure only warns.
+func recordAttachment(id, controller string, slot int, attachment *ScsiAttachment) {
+	err := updateSavedSpec(id, func(spec *ComputeSystemSpec) {
+		if spec.VirtualMachine == nil {
+			return
+		}
+		vm := spec.VirtualMachine
+		if vm.Devices == nil {
+			vm.Devices = &DevicesSpec{}
+		}
+		if vm.Devices.Scsi == nil {
+			vm.Devices.Scsi = make(map[string]*ScsiController)
+		}
+		c := vm.Devices.Scsi[controller]
+		if c == nil {
+			c = &ScsiController{}
+			vm.Devices.Scsi[controller] = c
+		}
+		if attachment == nil {
+			delete(c.Attachments, strconv.Itoa(slot))
+			return
+		}
+		if c.Attachments == nil {
+			c.Attachments = make(map[string]*ScsiAttachment)
+		}
+		c.Attachments[strconv.Itoa(slot)] = attachment
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s slot %d is not recorded for inspect, export and clone: %v\n", controller, slot, err)
+	}
+}
+
+// AttachDisk hot-adds a VHD(X) to a running VM and returns the slot it landed
+// in. The modify request addresses only that slot, so existing attachments
+// are left untouched. HCS does not report a running system's attachments, so
+// the slot is picked and checked against the system's saved spec: with
+// slot < 0 the lowest free slot is used, and an explicit slot must be free.
+// Without a saved spec an explicit slot is sent unchecked (HCS rejects an
+// occupied one) and none can be picked. The new disk is recorded in the saved
+// spec. With dryRun the slot is still chosen but the request is printed
+// instead of sent.
+func AttachDisk(id, controller string, slot int, diskPath string, access diskAccess, dryRun bool) (int, error) {
+	if slot >= maxScsiSlots {
+		return 0, fmt.Errorf("invalid slot %d: a SCSI controller has slots 0-%d", slot, maxScsiSlots-1)
+	}
+	absPath, err := filepath.Abs(diskPath)
+	if err != nil {
+		return 0, fmt.Errorf("cannot resolve disk path: %w", err)
+	}
+	attachment, err := access.attachment(attachVirtualDisk, absPath)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stat(absPath); err != nil {
+		return 0, fmt.Errorf("disk not found: %w", err)
+	}
+	if err := checkDiskFormat(absPath); err != nil {
+		return 0, err
+	}
+
+	attachments, err := savedScsiAttachments(id, controller)
+	switch {
+	case err != nil && slot < 0:
+		return 0, fmt.Errorf("cannot pick a free slot: %w; pass --slot", err)
+	case err != nil:
+		verbosef("skipping slot preflight: %v", err)
+	case slot < 0:
+		if slot, err = nextFreeSlot(attachments); err != nil {
+			return 0, fmt.Errorf("controller %s: %w", controller, err)
+		}
+	default:
+		if a, used := attachments[strconv.Itoa(slot)]; used {
+			return 0, fmt.Errorf("%s slot %d is already occupied by %s", controller, slot, a.Path)
+		}
+	}
+
+	req := ModifySettingRequest{
+		ResourcePath: scsiAttachmentPath(controller, slot),
+		RequestType:  "Add",
+		Settings:     attachment,
+	}
+	if dryRun {
+		return slot, previewModify(id, req)
+	}
+
+	grants := newGrantTxn(id)
+	if err := grants.Grant(absPath); err != nil {
+		return 0, fmt.Errorf("grant access to %s: %w", absPath, err)
+	}
+	err = modifyVM(id, req)
+	if err != nil {
+		if rerr := grants.Rollback(); rerr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", rerr)
+		}
+		return 0, err
+	}
+	recordAttachment(id, controller, slot, attachment)
+	return slot, nil
+}
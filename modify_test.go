@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestReadModifyFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	single := write("one.json", `{"ResourcePath":"VirtualMachine/Devices/Scsi/Primary/Attachments/1","RequestType":"Add","Settings":{"Type":"VirtualDisk","Path":"data.vhdx"}}`)
+	reqs, err := readModifyFile(single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPath := filepath.Join(dir, "data.vhdx")
+	if paths := modifyRequestPaths(reqs); len(reqs) != 1 || len(paths) != 1 || paths[0] != wantPath {
+		t.Errorf("got %d requests referencing %q, want 1 referencing %s", len(reqs), paths, wantPath)
+	}
+
+	list := write("list.json", `[
+		{"ResourcePath":"a","RequestType":"Add","Settings":{"Path":"data.vhdx"}},
+		{"ResourcePath":"b","RequestType":"Add","Settings":{"Disks":[{"Path":"DATA.vhdx"},{"Path":"\\\\.\\PhysicalDrive2"}]}},
+		{"ResourcePath":"c","RequestType":"Remove"}
+	]`)
+	if reqs, err = readModifyFile(list); err != nil {
+		t.Fatal(err)
+	}
+	if paths := modifyRequestPaths(reqs); len(reqs) != 3 || len(paths) != 1 {
+		t.Errorf("got %d requests referencing %q, want 3 referencing data.vhdx once", len(reqs), paths)
+	}
+
+	for _, body := range []string{`{"RequestType":"Add"}`, `[]`, `{"ResourcePath":`} {
+		if _, err := readModifyFile(write("bad.json", body)); err == nil {
+			t.Errorf("%s: expected an error", body)
+		}
+	}
+}
+
+func TestNextFreeSlot(t *testing.T) {
+	disk := &ScsiAttachment{Type: "VirtualDisk", Path: "x.vhdx"}
+
+	tests := []struct {
+		used []string
+		want int
+	}{
+		{nil, 0},
+		{[]string{"0"}, 1},
+		{[]string{"0", "1", "3"}, 2},
+		{[]string{"1", "2"}, 0},
+	}
+	for _, tt := range tests {
+		atts := map[string]*ScsiAttachment{}
+		for _, s := range tt.used {
+			atts[s] = disk
+		}
+		got, err := nextFreeSlot(atts)
+		if err != nil || got != tt.want {
+			t.Errorf("nextFreeSlot(%v) = %d, %v; want %d", tt.used, got, err, tt.want)
+		}
+	}
+
+	full := map[string]*ScsiAttachment{}
+	for i := 0; i < maxScsiSlots; i++ {
+		full[strconv.Itoa(i)] = disk
+	}
+	if _, err := nextFreeSlot(full); err == nil {
+		t.Error("nextFreeSlot on a full controller succeeded, want error")
+	}
+}
+
+// TestRecordAttachment checks that attachment changes land in the saved spec
+// and that the next free slot is picked from it.
+func TestRecordAttachment(t *testing.T) {
+	useSavedSpecDir(t)
+	stubEnumeration(t, "[]")
+
+	const id = "AAAAAAAA-0000-0000-0000-000000000001"
+	if _, err := savedScsiAttachments(id, "Primary"); err == nil {
+		t.Error("savedScsiAttachments without a saved spec succeeded")
+	}
+	if err := saveSpec(id, `{"VirtualMachine":{"Devices":{"Scsi":{"Primary":{"Attachments":{"0":{"Type":"VirtualDisk","Path":"C:\\boot.vhdx"}}}}}}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	attachments, err := savedScsiAttachments(id, "Primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slot, err := nextFreeSlot(attachments); err != nil || slot != 1 {
+		t.Fatalf("nextFreeSlot = %d, %v; want 1", slot, err)
+	}
+
+	data := &ScsiAttachment{Type: attachVirtualDisk, Path: `C:\data.vhdx`}
+	recordAttachment(id, "Primary", 1, data)
+	iso := &ScsiAttachment{Type: attachIso, Path: `C:\setup.iso`}
+	recordAttachment(id, "Secondary", 0, iso)
+	if attachments, err = savedScsiAttachments(id, "Primary"); err != nil {
+		t.Fatal(err)
+	}
+	if got := attachments["1"]; got == nil || *got != *data {
+		t.Errorf("slot 1 = %+v, want %+v", got, data)
+	}
+	if slot, _ := nextFreeSlot(attachments); slot != 2 {
+		t.Errorf("next free slot after recording 1 = %d, want 2", slot)
+	}
+	if secondary, err := savedScsiAttachments(id, "Secondary"); err != nil || secondary["0"] == nil || *secondary["0"] != *iso {
+		t.Errorf("Secondary = %+v, %v; want the ISO in slot 0", secondary, err)
+	}
+
+	recordAttachment(id, "Primary", 0, nil)
+	if attachments, _ = savedScsiAttachments(id, "Primary"); attachments["0"] != nil {
+		t.Errorf("slot 0 = %+v after removal, want empty", attachments["0"])
+	}
+}
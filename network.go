@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// normalizeEndpointID validates an HNS endpoint ID given as a GUID, with or
+// without braces, and returns it bare and lowercased as HNS reports it.
+func normalizeEndpointID(id string) (string, error) {
+	bare := id
+	if strings.HasPrefix(id, "{") && strings.HasSuffix(id, "}") {
+		bare = id[1 : len(id)-1]
+	}
+	if !guidRe.MatchString(bare) {
+		return "", fmt.Errorf("invalid --endpoint %q: expected an HNS endpoint GUID like 01234567-89ab-cdef-0123-456789abcdef", id)
+	}
+	return strings.ToLower(bare), nil
+}
+
+// injectEndpoint adds a network adapter attached to an existing HNS
+// endpoint, keyed by the endpoint ID. hcstool neither creates nor deletes
+// the endpoint; its lifetime stays with whoever made it.
+func injectEndpoint(spec *ComputeSystemSpec, endpointID string) error {
+	if spec.VirtualMachine == nil {
+		return fmt.Errorf("--endpoint needs a spec with a VirtualMachine section")
+	}
+	if spec.VirtualMachine.Devices == nil {
+		spec.VirtualMachine.Devices = &DevicesSpec{}
+	}
+	devices := spec.VirtualMachine.Devices
+	for key, nic := range devices.NetworkAdapters {
+		if nic != nil && strings.EqualFold(nic.EndpointId, endpointID) {
+			return fmt.Errorf("the spec already attaches endpoint %s (adapter %q)", endpointID, key)
+		}
+	}
+	if devices.NetworkAdapters == nil {
+		devices.NetworkAdapters = make(map[string]*NetworkAdapter)
+	}
+	devices.NetworkAdapters[endpointID] = &NetworkAdapter{EndpointId: endpointID}
+	return nil
+}
+
+// ListSwitches prints the host's HNS networks (the virtual switches VMs can
+// be attached to), sorted by name, as a table or JSON.
+func ListSwitches(asJSON bool) error {
+	networks, err := enumerateNetworks()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(networks, func(i, j int) bool {
+		return strings.ToLower(networks[i].Name) < strings.ToLower(networks[j].Name)
+	})
+
+	if asJSON {
+		out, err := json.MarshalIndent(networks, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	if len(networks) == 0 {
+		fmt.Println("No HNS networks found.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID\tTYPE")
+	for _, n := range networks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", orDash(n.Name), n.ID, orDash(n.Type))
+	}
+	return w.Flush()
+}
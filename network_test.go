@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"hcstool/hcs"
+)
+
+func TestNormalizeEndpointID(t *testing.T) {
+	const want = "0123abcd-89ab-cdef-0123-456789abcdef"
+	for _, in := range []string{want, "{0123ABCD-89ab-cdef-0123-456789ABCDEF}"} {
+		if got, err := normalizeEndpointID(in); err != nil || got != want {
+			t.Errorf("normalizeEndpointID(%q) = %q, %v", in, got, err)
+		}
+	}
+	for _, in := range []string{"", "my-switch", "{0123abcd-89ab-cdef-0123-456789abcdef", "0123abcd89abcdef0123456789abcdef"} {
+		if _, err := normalizeEndpointID(in); err == nil {
+			t.Errorf("normalizeEndpointID(%q) accepted", in)
+		}
+	}
+}
+
+func TestInjectEndpoint(t *testing.T) {
+	const ep = "0123abcd-89ab-cdef-0123-456789abcdef"
+	if err := injectEndpoint(&ComputeSystemSpec{}, ep); err == nil {
+		t.Error("endpoint injected into a spec without a VirtualMachine section")
+	}
+
+	spec := &ComputeSystemSpec{VirtualMachine: &VirtualMachineSpec{}}
+	if err := injectEndpoint(spec, ep); err != nil {
+		t.Fatal(err)
+	}
+	nic := spec.VirtualMachine.Devices.NetworkAdapters[ep]
+	if nic == nil || nic.EndpointId != ep {
+		t.Fatalf("adapters = %+v", spec.VirtualMachine.Devices.NetworkAdapters)
+	}
+
+	spec.VirtualMachine.Devices.NetworkAdapters = map[string]*NetworkAdapter{
+		"nic0": {EndpointId: "0123ABCD-89AB-CDEF-0123-456789ABCDEF"},
+	}
+	if err := injectEndpoint(spec, ep); err == nil {
+		t.Error("duplicate endpoint accepted")
+	}
+}
+
+func TestListSwitches(t *testing.T) {
+	orig := enumerateNetworks
+	defer func() { enumerateNetworks = orig }()
+	enumerateNetworks = func() ([]hcs.Network, error) {
+		return []hcs.Network{
+			{ID: "2", Name: "nat", Type: "NAT"},
+			{ID: "1", Name: "Default Switch", Type: "ICS"},
+		}, nil
+	}
+
+	out := captureStdout(t, func() {
+		if err := ListSwitches(false); err != nil {
+			t.Error(err)
+		}
+	})
+	want := "NAME            ID  TYPE\nDefault Switch  1   ICS\nnat             2   NAT\n"
+	if out != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+}
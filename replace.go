@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// replaceTimeout bounds how long create --replace waits for each old system
+// to disappear after terminating it.
+const replaceTimeout = 60 * time.Second
+
+// confirmInput is where confirm reads answers; tests replace it.
+var confirmInput io.Reader = os.Stdin
+
+// confirm asks a yes/no question on stderr and reads the answer from
+// confirmInput. Anything but y or yes, including end of input when stdin
+// isn't interactive, is a no.
+func confirm(question string) (bool, error) {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	line, err := bufio.NewReader(confirmInput).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// replaceTargets picks the systems create --replace would collide with: the
+// one with id if id is set, otherwise every system named name. Only systems
+// owned by owner are replaced: an ID match owned by anyone else is an error,
+// and same-named systems of other owners are returned as others instead.
+func replaceTargets(entries []EnumEntry, id, name, owner string) (targets, others []EnumEntry, err error) {
+	for _, e := range entries {
+		switch {
+		case id != "" && strings.EqualFold(e.Id, id):
+			if !strings.EqualFold(e.Owner, owner) {
+				return nil, nil, fmt.Errorf("--replace: %s is owned by %q, not %q; not replacing it", describeEntry(e), e.Owner, owner)
+			}
+			targets = append(targets, e)
+		case id == "" && name != "" && strings.EqualFold(e.Name, name):
+			if !strings.EqualFold(e.Owner, owner) {
+				others = append(others, e)
+				continue
+			}
+			targets = append(targets, e)
+		}
+	}
+	return targets, others, nil
+}
+
+// describeEntry formats an enumerated system for messages, e.g.
+// `running system <id> ("web")`.
+func describeEntry(e EnumEntry) string {
+	desc := fmt.Sprintf("%s system %s", strings.ToLower(e.State), e.Id)
+	if e.Name != "" {
+		desc += fmt.Sprintf(" (%q)", e.Name)
+	}
+	return desc
+}
+
+// ReplaceExisting tears down what create --replace would collide with (see
+// replaceTargets) among the systems of owner, so the create can go ahead.
+// CreateAndStartVM calls it once the spec is fully prepared, right before
+// the create. Unless assumeYes is set it lists the systems and asks first;
+// the owner check applies either way. Each one is terminated and then
+// waited on until HCS has removed it, which also releases its disks.
+func ReplaceExisting(id, name, owner string, assumeYes bool) error {
+	entries, err := listEnumEntries()
+	if err != nil {
+		return err
+	}
+	targets, others, err := replaceTargets(entries, id, name, owner)
+	if err != nil {
+		return err
+	}
+	for _, e := range others {
+		fmt.Fprintf(os.Stderr, "Not replacing %s: it is owned by %q, not %q\n", describeEntry(e), e.Owner, owner)
+	}
+	if len(targets) == 0 {
+		verbosef("--replace: nothing to replace")
+		return nil
+	}
+
+	if !assumeYes {
+		fmt.Fprintln(os.Stderr, "--replace will terminate:")
+		for _, e := range targets {
+			fmt.Fprintf(os.Stderr, "  %s, owner %q\n", describeEntry(e), e.Owner)
+		}
+		ok, err := confirm("Continue?")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("not replacing; pass --yes to skip the confirmation")
+		}
+	}
+
+	for _, e := range targets {
+		fmt.Fprintf(os.Stderr, "Replacing %s...\n", describeEntry(e))
+		// A system that is already stopped may refuse to terminate but still
+		// go away once its last handle closes, so only a system that stays
+		// around turns the terminate error into a failure.
+		killErr := KillVM(e.Id)
+		if err := WaitForGone(e.Id, replaceTimeout); err != nil {
+			if killErr != nil {
+				return fmt.Errorf("terminate %s: %w", e.Id, killErr)
+			}
+			return err
+		}
+	}
+	return nil
+}
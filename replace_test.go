@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReplaceTargets(t *testing.T) {
+	entries := []EnumEntry{
+		{Id: "a", Name: "ci-runner", State: "Running", Owner: "hcstool"},
+		{Id: "b", Name: "CI-Runner", State: "Stopped", Owner: "HCSTOOL"},
+		{Id: "c", Name: "web", State: "Running", Owner: "hcstool"},
+		{Id: "d", Name: "ci-runner", State: "Running", Owner: "docker"},
+	}
+	ids := func(es []EnumEntry) string {
+		var s []string
+		for _, e := range es {
+			s = append(s, e.Id)
+		}
+		return strings.Join(s, ",")
+	}
+
+	targets, others, err := replaceTargets(entries, "", "ci-runner", "hcstool")
+	if err != nil || ids(targets) != "a,b" || ids(others) != "d" {
+		t.Errorf("by name: got targets %q, others %q, err %v; want a,b and d", ids(targets), ids(others), err)
+	}
+	targets, _, err = replaceTargets(entries, "C", "ci-runner", "hcstool")
+	if err != nil || ids(targets) != "c" {
+		t.Errorf("by id: got %q, %v; want c (the id wins over the name)", ids(targets), err)
+	}
+	if _, _, err := replaceTargets(entries, "d", "", "hcstool"); err == nil {
+		t.Error("by id: replacing another owner's system succeeded, want error")
+	}
+	if targets, _, _ := replaceTargets(entries, "", "", "hcstool"); len(targets) != 0 {
+		t.Errorf("no id or name: got %q, want nothing", ids(targets))
+	}
+}
+
+func TestReplaceAfterSpecPreparation(t *testing.T) {
+	orig := enumerateOnce
+	defer func() { enumerateOnce = orig }()
+	enumerateOnce = func(string) (string, error) {
+		t.Error("--replace enumerated systems before the spec was validated")
+		return "[]", nil
+	}
+
+	stop := true
+	err := CreateAndStartVM(`{"Owner":"hcstool"}`, CreateOptions{Name: "web", Replace: true, AssumeYes: true, StopOnReset: &stop})
+	if err == nil || !strings.Contains(err.Error(), "--on-reset") {
+		t.Errorf("CreateAndStartVM = %v, want the --on-reset spec error", err)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	defer func(r io.Reader) { confirmInput = r }(confirmInput)
+
+	for _, tt := range []struct {
+		input string
+		want  bool
+	}{
+		{"y\n", true},
+		{" YES \r\n", true},
+		{"n\n", false},
+		{"\n", false},
+		{"", false}, // non-interactive stdin
+	} {
+		confirmInput = strings.NewReader(tt.input)
+		var got bool
+		captureStderr(t, func() {
+			var err error
+			if got, err = confirm("Continue?"); err != nil {
+				t.Error(err)
+			}
+		})
+		if got != tt.want {
+			t.Errorf("confirm(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
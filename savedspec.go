@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HCS never hands back the document a compute system was created from: the
+// property query has no type for it, and the base properties are runtime
+// state only. create therefore keeps a copy of every spec it launches, named
+// by system ID, for export, clone, inspect, stats and create --open-existing
+// to read back; attach-disk and swap-iso keep it current as they change a
+// running VM's SCSI attachments. Systems created by other tools, or on
+// another host, have none.
+
+// errNoSavedSpec is wrapped by loadSavedSpec when a system has no saved spec.
+var errNoSavedSpec = errors.New("no saved spec")
+
+// savedSpecDir is where create keeps spec copies; "" disables them. Tests
+// point it at a temporary directory.
+var savedSpecDir = defaultSavedSpecDir()
+
+// defaultSavedSpecDir returns %ProgramData%\hcstool\specs, or "" when
+// ProgramData is not set.
+func defaultSavedSpecDir() string {
+	programData := os.Getenv("ProgramData")
+	if programData == "" {
+		return ""
+	}
+	return filepath.Join(programData, "hcstool", "specs")
+}
+
+// savedSpecPath returns the file holding the saved spec of system id.
+func savedSpecPath(id string) string {
+	return filepath.Join(savedSpecDir, strings.ToLower(id)+".json")
+}
+
+// saveSpec records specJSON as the configuration of system id, replacing
+// any older copy, and drops the copies of systems that no longer exist.
+func saveSpec(id, specJSON string) error {
+	if err := writeSavedSpec(id, specJSON); err != nil {
+		return err
+	}
+	pruneSavedSpecs(id)
+	return nil
+}
+
+// updateSavedSpec applies update to the saved spec of system id and saves
+// the result, so the copy follows changes made to the running system. A
+// system without a saved spec yields an error wrapping errNoSavedSpec.
+func updateSavedSpec(id string, update func(spec *ComputeSystemSpec)) error {
+	spec, err := loadSavedSpec(id)
+	if err != nil {
+		return err
+	}
+	update(spec)
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("saving spec of %s: %w", id, err)
+	}
+	return writeSavedSpec(id, string(data))
+}
+
+// writeSavedSpec writes specJSON as the saved spec of system id. The file is
+// written under a temporary name and renamed into place, so readers never
+// see a partial spec.
+func writeSavedSpec(id, specJSON string) error {
+	if savedSpecDir == "" {
+		return fmt.Errorf("saving spec of %s: %%ProgramData%% is not set", id)
+	}
+	if err := os.MkdirAll(savedSpecDir, 0o755); err != nil {
+		return fmt.Errorf("saving spec of %s: %w", id, err)
+	}
+	tmp, err := os.CreateTemp(savedSpecDir, "spec-*.tmp")
+	if err != nil {
+		return fmt.Errorf("saving spec of %s: %w", id, err)
+	}
+	_, err = tmp.WriteString(prettyJSON(specJSON) + "\n")
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), savedSpecPath(id))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("saving spec of %s: %w", id, err)
+	}
+	return nil
+}
+
+// pruneGrace is how long before an enumeration a spec must have been
+// written for pruneSavedSpecs to remove it. File timestamps come from a
+// coarse clock and can lag time.Now, so the enumeration start alone is not
+// a safe cut-off.
+const pruneGrace = time.Minute
+
+// pruneSavedSpecs removes saved specs whose system no longer exists, other
+// than keep's. Without an enumeration nothing is removed. A spec written
+// shortly before or since the enumeration started is kept too: another
+// create (a parallel --spec-dir one, or another hcstool) may have saved it
+// for a system the enumeration did not see.
+func pruneSavedSpecs(keep string) {
+	cutoff := time.Now().Add(-pruneGrace)
+	entries, err := listEnumEntries()
+	if err != nil {
+		verbosef("not pruning saved specs: %v", err)
+		return
+	}
+	live := map[string]bool{strings.ToLower(keep): true}
+	for _, e := range entries {
+		live[strings.ToLower(e.Id)] = true
+	}
+	files, _ := filepath.Glob(filepath.Join(savedSpecDir, "*.json"))
+	for _, f := range files {
+		if live[strings.TrimSuffix(filepath.Base(f), ".json")] {
+			continue
+		}
+		if fi, err := os.Stat(f); err != nil || !fi.ModTime().Before(cutoff) {
+			continue
+		}
+		verbosef("removing saved spec of vanished system: %s", f)
+		os.Remove(f)
+	}
+}
+
+// removeSavedSpec forgets the saved spec of system id, if there is one.
+func removeSavedSpec(id string) {
+	if savedSpecDir == "" {
+		return
+	}
+	if err := os.Remove(savedSpecPath(id)); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Warning: removing saved spec of %s: %v\n", id, err)
+	}
+}
+
+// loadSavedSpec returns the spec system id was created from. A system
+// without one yields an error wrapping errNoSavedSpec.
+func loadSavedSpec(id string) (*ComputeSystemSpec, error) {
+	if savedSpecDir == "" {
+		return nil, fmt.Errorf("%w for %s: %%ProgramData%% is not set", errNoSavedSpec, id)
+	}
+	data, err := os.ReadFile(savedSpecPath(id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w for %s: HCS does not report a system's configuration, and only systems created by hcstool on this host have a saved copy", errNoSavedSpec, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading saved spec of %s: %w", id, err)
+	}
+	var spec ComputeSystemSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("parsing saved spec of %s: %w", id, err)
+	}
+	return &spec, nil
+}
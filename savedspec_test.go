@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useSavedSpecDir points savedSpecDir at a fresh temporary directory for the
+// rest of the test.
+func useSavedSpecDir(t *testing.T) {
+	t.Helper()
+	orig := savedSpecDir
+	savedSpecDir = t.TempDir()
+	t.Cleanup(func() { savedSpecDir = orig })
+}
+
+// stubEnumeration makes enumerations return resultJSON for the rest of the
+// test.
+func stubEnumeration(t *testing.T, resultJSON string) {
+	t.Helper()
+	orig := enumerateOnce
+	enumerateOnce = func(string) (string, error) { return resultJSON, nil }
+	t.Cleanup(func() { enumerateOnce = orig })
+}
+
+func TestSavedSpecRoundTrip(t *testing.T) {
+	useSavedSpecDir(t)
+	stubEnumeration(t, `[{"Id":"11111111-1111-1111-1111-111111111111"}]`)
+
+	const id = "AAAAAAAA-0000-0000-0000-000000000001"
+	if _, err := loadSavedSpec(id); !errors.Is(err, errNoSavedSpec) {
+		t.Fatalf("loadSavedSpec before save: err = %v, want errNoSavedSpec", err)
+	}
+
+	// A spec left behind by a system that no longer exists is pruned; one
+	// whose system is still enumerated is kept.
+	vanished := filepath.Join(savedSpecDir, "22222222-2222-2222-2222-222222222222.json")
+	alive := filepath.Join(savedSpecDir, "11111111-1111-1111-1111-111111111111.json")
+	old := time.Now().Add(-time.Hour)
+	for _, f := range []string{vanished, alive} {
+		if err := os.WriteFile(f, []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := saveSpec(id, `{"Owner":"me","VirtualMachine":{"StopOnReset":true}}`); err != nil {
+		t.Fatalf("saveSpec: %v", err)
+	}
+	spec, err := loadSavedSpec(id)
+	if err != nil {
+		t.Fatalf("loadSavedSpec: %v", err)
+	}
+	if spec.Owner != "me" || spec.VirtualMachine == nil || !spec.VirtualMachine.StopOnReset {
+		t.Errorf("loaded spec = %+v, want the saved one", spec)
+	}
+	if _, err := os.Stat(vanished); !os.IsNotExist(err) {
+		t.Errorf("spec of a vanished system was kept (stat err %v)", err)
+	}
+	if _, err := os.Stat(alive); err != nil {
+		t.Errorf("spec of a live system was pruned: %v", err)
+	}
+
+	removeSavedSpec(id)
+	if _, err := loadSavedSpec(id); !errors.Is(err, errNoSavedSpec) {
+		t.Errorf("loadSavedSpec after remove: err = %v, want errNoSavedSpec", err)
+	}
+}
+
+// TestPruneKeepsConcurrentSpecs checks that a spec another create saves
+// while the prune enumerates survives, although its system was not
+// enumerated.
+func TestPruneKeepsConcurrentSpecs(t *testing.T) {
+	useSavedSpecDir(t)
+	concurrent := filepath.Join(savedSpecDir, "33333333-3333-3333-3333-333333333333.json")
+	orig := enumerateOnce
+	enumerateOnce = func(string) (string, error) {
+		if err := os.WriteFile(concurrent, []byte("{}"), 0o644); err != nil {
+			t.Error(err)
+		}
+		return "[]", nil
+	}
+	defer func() { enumerateOnce = orig }()
+
+	pruneSavedSpecs("AAAAAAAA-0000-0000-0000-000000000001")
+	if _, err := os.Stat(concurrent); err != nil {
+		t.Errorf("spec saved during the enumeration was pruned: %v", err)
+	}
+}
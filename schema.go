@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// baseSchemaVersion is what quick-create needs with no optional features, and
+// the fallback when the host's supported versions can't be queried.
+var baseSchemaVersion = SchemaVersion{Major: 2, Minor: 1}
+
+// Minimum schema versions for optional quick-create features.
+var (
+	secureBootSchemaVersion = SchemaVersion{Major: 2, Minor: 1}
+	tpmSchemaVersion        = SchemaVersion{Major: 2, Minor: 4}
+
+	linuxKernelDirectSchemaVersion = SchemaVersion{Major: 2, Minor: 2}
+)
+
+func (v SchemaVersion) String() string { return fmt.Sprintf("%d.%d", v.Major, v.Minor) }
+
+// less reports whether v is an older schema than w.
+func (v SchemaVersion) less(w SchemaVersion) bool {
+	return v.Major < w.Major || (v.Major == w.Major && v.Minor < w.Minor)
+}
+
+// parseSchemaVersion parses "major.minor", e.g. "2.5".
+func parseSchemaVersion(s string) (SchemaVersion, error) {
+	major, minor, ok := strings.Cut(s, ".")
+	if !ok {
+		return SchemaVersion{}, fmt.Errorf("invalid schema version %q: expected major.minor, e.g. 2.5", s)
+	}
+	maj, err1 := strconv.Atoi(major)
+	min, err2 := strconv.Atoi(minor)
+	if err1 != nil || err2 != nil || maj < 0 || min < 0 {
+		return SchemaVersion{}, fmt.Errorf("invalid schema version %q: expected major.minor, e.g. 2.5", s)
+	}
+	return SchemaVersion{Major: maj, Minor: min}, nil
+}
+
+// hostSchemaVersions asks the HCS service which configuration schema versions
+// it supports, sorted oldest first.
+func hostSchemaVersions() ([]SchemaVersion, error) {
+	resultJSON, err := getServiceProperties(buildPropertyQuery([]string{"Basic"}))
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Properties []struct {
+			SupportedSchemaVersions []SchemaVersion
+		}
+	}
+	if err := json.Unmarshal([]byte(resultJSON), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse service properties: %w", err)
+	}
+	var versions []SchemaVersion
+	for _, p := range result.Properties {
+		versions = append(versions, p.SupportedSchemaVersions...)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].less(versions[j]) })
+	return versions, nil
+}
+
+// pickSchemaVersion chooses the SchemaVersion for a generated spec. With an
+// override, that version is used as long as it meets required and the host
+// supports it. Otherwise the newest version the host advertises is used. If
+// supported is empty (the host couldn't be queried), required is used as is.
+func pickSchemaVersion(supported []SchemaVersion, required SchemaVersion, override *SchemaVersion) (SchemaVersion, error) {
+	if override != nil {
+		if override.less(required) {
+			return SchemaVersion{}, fmt.Errorf("the requested features need schema %s or newer, but --schema is %s", required, override)
+		}
+		if len(supported) > 0 && !containsSchemaVersion(supported, *override) {
+			return SchemaVersion{}, fmt.Errorf("this host does not support schema %s (supported: %s)", override, joinSchemaVersions(supported))
+		}
+		return *override, nil
+	}
+	if len(supported) == 0 {
+		return required, nil
+	}
+
+	newest := supported[0]
+	for _, v := range supported[1:] {
+		if newest.less(v) {
+			newest = v
+		}
+	}
+	if newest.less(required) {
+		return SchemaVersion{}, fmt.Errorf("the requested features need schema %s or newer, but this host supports at most %s", required, newest)
+	}
+	return newest, nil
+}
+
+func containsSchemaVersion(versions []SchemaVersion, v SchemaVersion) bool {
+	for _, s := range versions {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func joinSchemaVersions(versions []SchemaVersion) string {
+	parts := make([]string, len(versions))
+	for i, v := range versions {
+		parts[i] = v.String()
+	}
+	return strings.Join(parts, ", ")
+}
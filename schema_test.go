@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestPickSchemaVersion(t *testing.T) {
+	host := []SchemaVersion{{2, 1}, {2, 4}, {2, 3}}
+	v := func(major, minor int) *SchemaVersion { return &SchemaVersion{major, minor} }
+
+	tests := []struct {
+		name      string
+		supported []SchemaVersion
+		required  SchemaVersion
+		override  *SchemaVersion
+		want      SchemaVersion
+		wantErr   bool
+	}{
+		{"newest advertised", host, baseSchemaVersion, nil, SchemaVersion{2, 4}, false},
+		{"host unknown uses required", nil, tpmSchemaVersion, nil, tpmSchemaVersion, false},
+		{"host too old", []SchemaVersion{{2, 1}}, tpmSchemaVersion, nil, SchemaVersion{}, true},
+		{"override", host, baseSchemaVersion, v(2, 3), SchemaVersion{2, 3}, false},
+		{"override below required", host, tpmSchemaVersion, v(2, 3), SchemaVersion{}, true},
+		{"override not on host", host, baseSchemaVersion, v(2, 5), SchemaVersion{}, true},
+		{"override with host unknown", nil, baseSchemaVersion, v(2, 5), SchemaVersion{2, 5}, false},
+	}
+	for _, tt := range tests {
+		got, err := pickSchemaVersion(tt.supported, tt.required, tt.override)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseSchemaVersion(t *testing.T) {
+	if got, err := parseSchemaVersion("2.5"); err != nil || got != (SchemaVersion{2, 5}) {
+		t.Errorf("parseSchemaVersion(2.5) = %v, %v", got, err)
+	}
+	for _, bad := range []string{"", "2", "2.x", "-1.0", "2.5.1"} {
+		if _, err := parseSchemaVersion(bad); err == nil {
+			t.Errorf("parseSchemaVersion(%q) succeeded, want error", bad)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Plan9Spec is the VirtualMachine.Devices.Plan9 section: host directories
+// served to the guest over the Plan9 protocol.
+type Plan9Spec struct {
+	Shares []*Plan9Share `json:"Shares,omitempty"`
+}
+
+// Plan9Share is one shared host directory. The guest mounts it by
+// AccessName (the 9p aname) on Port.
+type Plan9Share struct {
+	Name       string `json:"Name"`
+	AccessName string `json:"AccessName"`
+	Path       string `json:"Path"`
+	Port       uint32 `json:"Port"`
+	Flags      int32  `json:"Flags,omitempty"`
+}
+
+// plan9Port is the port HCS serves Plan9 shares on. One server handles all
+// shares, told apart by AccessName, so every share uses it and only the
+// names must be unique.
+const plan9Port = 564
+
+// plan9FlagReadOnly is the Plan9ShareFlags value for a read-only share.
+const plan9FlagReadOnly = 0x1
+
+// parseShare parses a --share value such as host=C:\data,name=data,readonly.
+// host is required and must be an existing directory; name defaults to its
+// base name.
+func parseShare(s string) (*Plan9Share, error) {
+	share := &Plan9Share{Port: plan9Port}
+	for _, field := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch strings.ToLower(key) {
+		case "host":
+			share.Path = value
+		case "name":
+			share.Name = value
+		case "readonly", "ro":
+			share.Flags |= plan9FlagReadOnly
+		case "":
+		default:
+			return nil, fmt.Errorf("invalid --share %q: unknown option %q (expected host=, name= or readonly)", s, key)
+		}
+	}
+	if share.Path == "" {
+		return nil, fmt.Errorf("invalid --share %q: host=<directory> is required", s)
+	}
+
+	absPath, err := filepath.Abs(share.Path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve share path: %w", err)
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("share directory not found: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("share path %s is not a directory", absPath)
+	}
+	share.Path = absPath
+
+	if share.Name == "" {
+		share.Name = filepath.Base(absPath)
+	}
+	share.AccessName = share.Name
+	return share, nil
+}
+
+// injectShares adds Plan9 shares to the spec, keeping any it already
+// declares. Share names must be unique across both.
+func injectShares(spec *ComputeSystemSpec, shares []*Plan9Share) error {
+	if spec.VirtualMachine == nil {
+		spec.VirtualMachine = &VirtualMachineSpec{}
+	}
+	if spec.VirtualMachine.Devices == nil {
+		spec.VirtualMachine.Devices = &DevicesSpec{}
+	}
+	devices := spec.VirtualMachine.Devices
+	if devices.Plan9 == nil {
+		devices.Plan9 = &Plan9Spec{}
+	}
+
+	names := make(map[string]bool)
+	for _, s := range devices.Plan9.Shares {
+		if s != nil {
+			names[strings.ToLower(s.Name)] = true
+		}
+	}
+	for _, s := range shares {
+		key := strings.ToLower(s.Name)
+		if names[key] {
+			return fmt.Errorf("duplicate share name %q; pass name= to pick another", s.Name)
+		}
+		names[key] = true
+		devices.Plan9.Shares = append(devices.Plan9.Shares, s)
+	}
+	return nil
+}
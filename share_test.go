@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseShare(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := parseShare("host=" + dir + ",name=data,readonly")
+	if err != nil {
+		t.Fatalf("parseShare: %v", err)
+	}
+	if s.Path != dir || s.Name != "data" || s.AccessName != "data" || s.Port != plan9Port || s.Flags != plan9FlagReadOnly {
+		t.Errorf("parseShare = %+v", s)
+	}
+
+	s, err = parseShare("host=" + dir)
+	if err != nil {
+		t.Fatalf("parseShare: %v", err)
+	}
+	if s.Name != filepath.Base(dir) || s.Flags != 0 {
+		t.Errorf("defaults: got %+v, want name %q and no flags", s, filepath.Base(dir))
+	}
+
+	for _, bad := range []string{
+		"name=data",
+		"host=" + filepath.Join(dir, "missing"),
+		"host=" + file,
+		"host=" + dir + ",mode=rw",
+	} {
+		if _, err := parseShare(bad); err == nil {
+			t.Errorf("parseShare(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestInjectShares(t *testing.T) {
+	existing := &Plan9Share{Name: "logs", AccessName: "logs", Path: `C:\logs`, Port: plan9Port}
+	spec := &ComputeSystemSpec{
+		VirtualMachine: &VirtualMachineSpec{
+			Devices: &DevicesSpec{Plan9: &Plan9Spec{Shares: []*Plan9Share{existing}}},
+		},
+	}
+	data := &Plan9Share{Name: "data", AccessName: "data", Path: `C:\data`, Port: plan9Port}
+	if err := injectShares(spec, []*Plan9Share{data}); err != nil {
+		t.Fatalf("injectShares: %v", err)
+	}
+	shares := spec.VirtualMachine.Devices.Plan9.Shares
+	if len(shares) != 2 || shares[0] != existing || shares[1] != data {
+		t.Errorf("shares = %+v, want the existing share followed by data", shares)
+	}
+
+	dup := &Plan9Share{Name: "LOGS", AccessName: "LOGS", Path: `D:\logs`, Port: plan9Port}
+	if err := injectShares(spec, []*Plan9Share{dup}); err == nil {
+		t.Error("duplicate share name accepted, want error")
+	}
+
+	empty := &ComputeSystemSpec{}
+	if err := injectShares(empty, []*Plan9Share{data}); err != nil {
+		t.Fatalf("injectShares on an empty spec: %v", err)
+	}
+	if got := empty.VirtualMachine.Devices.Plan9.Shares; len(got) != 1 {
+		t.Errorf("empty spec got shares %+v", got)
+	}
+}
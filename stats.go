@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SystemStatistics is the "Statistics" property of a compute system. Only
+// the counters hcstool reports are decoded.
+type SystemStatistics struct {
+	Uptime100ns uint64 `json:"Uptime100ns"`
+	Processor   struct {
+		TotalRuntime100ns  uint64 `json:"TotalRuntime100ns"`
+		RuntimeUser100ns   uint64 `json:"RuntimeUser100ns"`
+		RuntimeKernel100ns uint64 `json:"RuntimeKernel100ns"`
+	} `json:"Processor"`
+	Memory struct {
+		MemoryUsageCommitBytes            uint64 `json:"MemoryUsageCommitBytes"`
+		MemoryUsageCommitPeakBytes        uint64 `json:"MemoryUsageCommitPeakBytes"`
+		MemoryUsagePrivateWorkingSetBytes uint64 `json:"MemoryUsagePrivateWorkingSetBytes"`
+	} `json:"Memory"`
+}
+
+// statsSample is one Statistics query together with the wall-clock time it
+// was taken at.
+type statsSample struct {
+	at    time.Time
+	stats SystemStatistics
+}
+
+// cpuPercent returns the CPU utilization between two samples as the share
+// of one host CPU, like docker stats: a VM keeping two vCPUs busy reads
+// 200%. A runtime counter that went backwards (the system restarted) or a
+// zero interval gives 0.
+func cpuPercent(prev, cur statsSample) float64 {
+	wall := cur.at.Sub(prev.at)
+	if wall <= 0 || cur.stats.Processor.TotalRuntime100ns < prev.stats.Processor.TotalRuntime100ns {
+		return 0
+	}
+	busy := time.Duration(cur.stats.Processor.TotalRuntime100ns-prev.stats.Processor.TotalRuntime100ns) * 100
+	return float64(busy) / float64(wall) * 100
+}
+
+// cpuSummary holds min/avg/max CPU utilization over a series of samples.
+type cpuSummary struct {
+	Min, Avg, Max float64
+	Intervals     int
+}
+
+// summarizeCPU computes utilization for each consecutive pair of samples.
+// Fewer than two samples yield a zero summary with no intervals.
+func summarizeCPU(samples []statsSample) cpuSummary {
+	var s cpuSummary
+	var total float64
+	for i := 1; i < len(samples); i++ {
+		pct := cpuPercent(samples[i-1], samples[i])
+		if s.Intervals == 0 || pct < s.Min {
+			s.Min = pct
+		}
+		if pct > s.Max {
+			s.Max = pct
+		}
+		total += pct
+		s.Intervals++
+	}
+	if s.Intervals > 0 {
+		s.Avg = total / float64(s.Intervals)
+	}
+	return s
+}
+
+// sampleStatistics queries the Statistics property of an open system.
+func sampleStatistics(sys HcsSystem) (statsSample, error) {
+	resultJSON, err := getComputeSystemPropertiesQuery(sys, buildPropertyQuery([]string{"Statistics"}))
+	at := time.Now()
+	if err != nil {
+		return statsSample{}, err
+	}
+	var props struct {
+		Statistics *SystemStatistics
+	}
+	if err := json.Unmarshal([]byte(resultJSON), &props); err != nil {
+		return statsSample{}, fmt.Errorf("failed to parse statistics: %w", err)
+	}
+	if props.Statistics == nil {
+		return statsSample{}, fmt.Errorf("compute system did not report statistics")
+	}
+	return statsSample{at: at, stats: *props.Statistics}, nil
+}
+
+// VMMemoryInfo is the "Memory" property of a VM: what the host has actually
+// assigned to the guest right now, which drops below the configured size as
+// ballooning reclaims memory. Sizes are in MB; AvailableMemoryBuffer is a
+// percentage.
+type VMMemoryInfo struct {
+	VirtualMachineMemory *struct {
+		AvailableMemory       int64 `json:"AvailableMemory"`
+		AvailableMemoryBuffer int64 `json:"AvailableMemoryBuffer"`
+		ReservedMemory        int64 `json:"ReservedMemory"`
+		AssignedMemory        int64 `json:"AssignedMemory"`
+		BalancingEnabled      bool  `json:"BalancingEnabled"`
+	} `json:"VirtualMachineMemory"`
+}
+
+// specMemory returns the memory topology a spec configures, or nil when it
+// has none. A nil spec has none.
+func specMemory(spec *ComputeSystemSpec) *memoryTopology {
+	if spec == nil || spec.VirtualMachine == nil || len(spec.VirtualMachine.ComputeTopology) == 0 {
+		return nil
+	}
+	var topo computeTopology
+	if json.Unmarshal(spec.VirtualMachine.ComputeTopology, &topo) != nil {
+		return nil
+	}
+	return &topo.Memory
+}
+
+// DynamicMemoryInfo is the "DynamicMemory" section inspect adds: the
+// configured dynamic memory settings next to what the host reports right
+// now. HCS does not report the configuration, so it comes from the spec
+// saved at create and is left out for systems without one. Zero buffer or
+// priority means the HCS default.
+type DynamicMemoryInfo struct {
+	SizeInMB         int    `json:"SizeInMB,omitempty"`
+	Ballooning       *bool  `json:"Ballooning,omitempty"`
+	BufferPercentage int    `json:"BufferPercentage,omitempty"`
+	Priority         int    `json:"Priority,omitempty"`
+	AssignedMB       *int64 `json:"AssignedMB,omitempty"`
+	EffectiveBuffer  *int64 `json:"EffectiveBufferPercentage,omitempty"`
+}
+
+// inspectMemory combines configured and live memory into the inspect
+// section, or returns nil when neither is known.
+func inspectMemory(cfg *memoryTopology, live *VMMemoryInfo) *DynamicMemoryInfo {
+	if cfg == nil && live == nil {
+		return nil
+	}
+	info := &DynamicMemoryInfo{}
+	if cfg != nil {
+		ballooning := cfg.EnableHotHint || cfg.EnableColdHint
+		info.SizeInMB = cfg.SizeInMB
+		info.Ballooning = &ballooning
+		info.BufferPercentage = cfg.MemoryBufferPercentage
+		info.Priority = cfg.Priority
+	}
+	if live != nil && live.VirtualMachineMemory != nil {
+		m := live.VirtualMachineMemory
+		info.AssignedMB = &m.AssignedMemory
+		info.EffectiveBuffer = &m.AvailableMemoryBuffer
+	}
+	return info
+}
+
+// liveMemory queries the Memory property of a VM, or nil when the system
+// doesn't report it (containers, or older hosts).
+func liveMemory(sys HcsSystem) *VMMemoryInfo {
+	resultJSON, err := getComputeSystemPropertiesQuery(sys, buildPropertyQuery([]string{"Memory"}))
+	if err != nil {
+		verbosef("Memory property unavailable: %v", err)
+		return nil
+	}
+	var props struct {
+		Memory *VMMemoryInfo
+	}
+	if json.Unmarshal([]byte(resultJSON), &props) != nil || props.Memory == nil || props.Memory.VirtualMachineMemory == nil {
+		return nil
+	}
+	return props.Memory
+}
+
+// onOff renders a flag for stats output.
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// memoryLines formats the stats lines comparing configured memory with what
+// is currently assigned; either half is left out when unknown.
+func memoryLines(cfg *memoryTopology, live *VMMemoryInfo) []string {
+	var lines []string
+	if cfg != nil {
+		lines = append(lines, fmt.Sprintf("Configured:  %d MB, ballooning %s", cfg.SizeInMB, onOff(cfg.EnableHotHint || cfg.EnableColdHint)))
+	}
+	if live != nil {
+		m := live.VirtualMachineMemory
+		lines = append(lines, fmt.Sprintf("Assigned:    %d MB (available %d MB, reserved %d MB, buffer %d%%, balancing %s)",
+			m.AssignedMemory, m.AvailableMemory, m.ReservedMemory, m.AvailableMemoryBuffer, onOff(m.BalancingEnabled)))
+	}
+	return lines
+}
+
+// ShowStats samples a compute system's statistics n times, interval apart,
+// and prints CPU utilization (min/avg/max across the intervals), the memory
+// counters from the final sample, and for VMs the configured memory (from
+// the spec saved at create) next to what is currently assigned, to show
+// ballooning at work. With a single sample only the raw counters are
+// printed, since utilization needs a delta.
+func ShowStats(id string, n int, interval time.Duration) error {
+	sys, err := openComputeSystem(id, accessRead)
+	if err != nil {
+		return err
+	}
+	defer closeComputeSystem(sys)
+
+	samples := make([]statsSample, 0, n)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		s, err := sampleStatistics(sys)
+		if err != nil {
+			return err
+		}
+		verbosef("sample %d: runtime %d00ns", i+1, s.stats.Processor.TotalRuntime100ns)
+		samples = append(samples, s)
+	}
+
+	last := samples[len(samples)-1].stats
+	if cpu := summarizeCPU(samples); cpu.Intervals > 0 {
+		fmt.Printf("CPU:         min %.1f%%  avg %.1f%%  max %.1f%%  (%d samples over %s)\n",
+			cpu.Min, cpu.Avg, cpu.Max, len(samples), samples[len(samples)-1].at.Sub(samples[0].at).Round(time.Millisecond))
+	} else {
+		cpuTime := time.Duration(last.Processor.TotalRuntime100ns) * 100
+		fmt.Printf("CPU time:    %s (use --samples 2 or more for utilization)\n", cpuTime.Truncate(time.Millisecond))
+	}
+	fmt.Printf("Working set: %s\n", formatMB(last.Memory.MemoryUsagePrivateWorkingSetBytes))
+	fmt.Printf("Commit:      %s (peak %s)\n", formatMB(last.Memory.MemoryUsageCommitBytes), formatMB(last.Memory.MemoryUsageCommitPeakBytes))
+
+	for _, line := range memoryLines(specMemory(configuredSpec(id)), liveMemory(sys)) {
+		fmt.Println(line)
+	}
+	return nil
+}
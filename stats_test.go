@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sampleAt(sec int, runtime100ns uint64) statsSample {
+	s := statsSample{at: time.Unix(1700000000, 0).Add(time.Duration(sec) * time.Second)}
+	s.stats.Processor.TotalRuntime100ns = runtime100ns
+	return s
+}
+
+func TestCPUPercent(t *testing.T) {
+	const second = 10_000_000 // in 100ns units
+	tests := []struct {
+		name      string
+		prev, cur statsSample
+		want      float64
+	}{
+		{"idle", sampleAt(0, 5*second), sampleAt(1, 5*second), 0},
+		{"half a CPU", sampleAt(0, 0), sampleAt(2, second), 50},
+		{"two busy vCPUs", sampleAt(0, 0), sampleAt(1, 2*second), 200},
+		{"counter reset", sampleAt(0, 9*second), sampleAt(1, second), 0},
+		{"zero interval", sampleAt(1, 0), sampleAt(1, second), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cpuPercent(tt.prev, tt.cur); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("cpuPercent = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarizeCPU(t *testing.T) {
+	const second = 10_000_000
+	samples := []statsSample{
+		sampleAt(0, 0),
+		sampleAt(1, second/4), // 25%
+		sampleAt(2, second),   // 75%
+		sampleAt(3, second),   // 0%
+	}
+	got := summarizeCPU(samples)
+	want := cpuSummary{Min: 0, Avg: 100.0 / 3, Max: 75, Intervals: 3}
+	if got.Intervals != want.Intervals || got.Min != want.Min || got.Max != want.Max || math.Abs(got.Avg-want.Avg) > 1e-9 {
+		t.Errorf("summarizeCPU = %+v, want %+v", got, want)
+	}
+
+	if s := summarizeCPU(samples[:1]); s.Intervals != 0 {
+		t.Errorf("single sample gave %+v, want no intervals", s)
+	}
+}
+
+func TestInspectMemory(t *testing.T) {
+	if inspectMemory(nil, nil) != nil {
+		t.Error("no memory information should give no section")
+	}
+
+	cfg := &memoryTopology{SizeInMB: 4096, EnableHotHint: true, MemoryBufferPercentage: 20, Priority: 8000}
+	var live VMMemoryInfo
+	if err := json.Unmarshal([]byte(`{"VirtualMachineMemory":{"AssignedMemory":1536,"AvailableMemoryBuffer":18}}`), &live); err != nil {
+		t.Fatal(err)
+	}
+	info := inspectMemory(cfg, &live)
+	if info.SizeInMB != 4096 || info.Ballooning == nil || !*info.Ballooning || info.BufferPercentage != 20 || info.Priority != 8000 {
+		t.Errorf("configured settings = %+v", info)
+	}
+	if info.AssignedMB == nil || *info.AssignedMB != 1536 || info.EffectiveBuffer == nil || *info.EffectiveBuffer != 18 {
+		t.Errorf("live settings = %+v", info)
+	}
+
+	// Without a saved spec only the live half is reported.
+	data, err := json.Marshal(inspectMemory(specMemory(nil), &live))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"AssignedMB":1536,"EffectiveBufferPercentage":18}`; string(data) != want {
+		t.Errorf("live-only section = %s, want %s", data, want)
+	}
+}
+
+func TestStatsMemoryLines(t *testing.T) {
+	useSavedSpecDir(t)
+	stubEnumeration(t, "[]")
+	const id = "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee"
+	if err := saveSpec(id, `{"VirtualMachine":{"ComputeTopology":{"Memory":{"SizeInMB":4096,"EnableHotHint":true}}}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	orig := getComputeSystemPropertiesQuery
+	defer func() { getComputeSystemPropertiesQuery = orig }()
+	getComputeSystemPropertiesQuery = func(HcsSystem, string) (string, error) {
+		return `{"Memory":{"VirtualMachineMemory":{"AvailableMemory":512,"AvailableMemoryBuffer":20,"ReservedMemory":64,"AssignedMemory":1536,"BalancingEnabled":true}}}`, nil
+	}
+
+	got := memoryLines(specMemory(configuredSpec(id)), liveMemory(HcsSystem{}))
+	want := []string{
+		"Configured:  4096 MB, ballooning on",
+		"Assigned:    1536 MB (available 512 MB, reserved 64 MB, buffer 20%, balancing on)",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("memoryLines =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// A system hcstool didn't create only shows what is assigned.
+	if got := memoryLines(specMemory(configuredSpec("00000000-bbbb-cccc-dddd-eeeeeeeeeeee")), liveMemory(HcsSystem{})); len(got) != 1 {
+		t.Errorf("without a saved spec got %q, want only the Assigned line", got)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// minMemoryMB is the smallest VM memory size accepted by --memory.
+const minMemoryMB = 256
+
+// sizeSuffixesMB maps size suffixes to their value in MB. A bare number
+// means MB for backward compatibility with the original --memory flag.
+var sizeSuffixesMB = []struct {
+	suffix string
+	mb     float64
+}{
+	{"TB", 1024 * 1024},
+	{"GB", 1024},
+	{"MB", 1},
+	{"KB", 1.0 / 1024},
+	{"T", 1024 * 1024},
+	{"G", 1024},
+	{"M", 1},
+	{"K", 1.0 / 1024},
+}
+
+// parseSizeMB parses a size such as "4G", "2048M", "1500MB" or "2048" (MB)
+// and returns it in whole MB. Values that don't come out to a whole number of
+// MB (e.g. "512K") are rejected.
+func parseSizeMB(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	if str == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	factor := 1.0
+	for _, sfx := range sizeSuffixesMB {
+		if strings.HasSuffix(str, sfx.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, sfx.suffix))
+			factor = sfx.mb
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	mb := n * factor
+	if mb != math.Trunc(mb) {
+		return 0, fmt.Errorf("size %q is not a whole number of MB", s)
+	}
+	if mb > math.MaxInt32 {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return int64(mb), nil
+}
+
+// parseMemoryMB parses a --memory value and enforces the minimum VM size.
+func parseMemoryMB(s string) (int, error) {
+	mb, err := parseSizeMB(s)
+	if err != nil {
+		return 0, fmt.Errorf("--memory: %w", err)
+	}
+	if mb < minMemoryMB {
+		return 0, fmt.Errorf("--memory: %d MB is below the minimum of %d MB", mb, minMemoryMB)
+	}
+	return int(mb), nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestParseMemoryMB(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"2048", 2048, false},
+		{"2048M", 2048, false},
+		{"1500MB", 1500, false},
+		{"4G", 4096, false},
+		{"4gb", 4096, false},
+		{"1.5G", 1536, false},
+		{"1T", 1024 * 1024, false},
+		{"524288K", 512, false},
+		{"512K", 0, true}, // fractional MB
+		{"1.1G", 0, true}, // 1126.4 MB
+		{"100", 0, true},  // below minimum
+		{"-1G", 0, true},  // negative
+		{"lots", 0, true}, // not a number
+		{"", 0, true},     // empty
+		{"4X", 0, true},   // unknown suffix
+	}
+	for _, tt := range tests {
+		got, err := parseMemoryMB(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMemoryMB(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseMemoryMB(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
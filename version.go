@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/sys/windows"
+)
+
+// version is hcstool's build version, set at link time with
+//
+//	go build -ldflags "-X main.version=v1.2.3"
+//
+// When unset, the module version recorded by go install is used, if any.
+var version string
+
+// buildVersion returns the version hcstool reports for itself.
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		return bi.Main.Version
+	}
+	return "dev"
+}
+
+// VersionInfo is what the version command reports: everything a bug report
+// needs to tell which tool, Windows build and HCS schema were involved.
+type VersionInfo struct {
+	Version string `json:"version"`
+	Go      string `json:"go"`
+	Windows string `json:"windows"`
+
+	// SchemaVersions are the HCS schema versions the host supports, oldest
+	// first; SchemaError says why they couldn't be read.
+	SchemaVersions []string `json:"schemaVersions,omitempty"`
+	SchemaError    string   `json:"schemaError,omitempty"`
+}
+
+// collectVersionInfo gathers VersionInfo. HCS being unavailable is reported
+// in SchemaError rather than failing, since that is often what is being
+// triaged.
+func collectVersionInfo() VersionInfo {
+	osv := windows.RtlGetVersion()
+	info := VersionInfo{
+		Version: buildVersion(),
+		Go:      fmt.Sprintf("%s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH),
+		Windows: fmt.Sprintf("%d.%d.%d", osv.MajorVersion, osv.MinorVersion, osv.BuildNumber),
+	}
+	versions, err := hostSchemaVersions()
+	if err != nil {
+		info.SchemaError = err.Error()
+	}
+	for _, v := range versions {
+		info.SchemaVersions = append(info.SchemaVersions, v.String())
+	}
+	return info
+}
+
+// PrintVersion prints collectVersionInfo as a table or JSON.
+func PrintVersion(asJSON bool) error {
+	info := collectVersionInfo()
+	if asJSON {
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	schemas := orDash(strings.Join(info.SchemaVersions, ", "))
+	if info.SchemaError != "" {
+		schemas = "unavailable: " + info.SchemaError
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "hcstool:\t%s\n", info.Version)
+	fmt.Fprintf(w, "Go:\t%s\n", info.Go)
+	fmt.Fprintf(w, "Windows:\t%s\n", info.Windows)
+	fmt.Fprintf(w, "HCS schemas:\t%s\n", schemas)
+	return w.Flush()
+}
@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestBuildVersion(t *testing.T) {
+	defer func(v string) { version = v }(version)
+
+	version = "v1.2.3"
+	if got := buildVersion(); got != "v1.2.3" {
+		t.Errorf("buildVersion() = %q, want the -ldflags version", got)
+	}
+	version = ""
+	if got := buildVersion(); got == "" {
+		t.Error("buildVersion() is empty without -ldflags")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modVirtDisk           = windows.NewLazySystemDLL("virtdisk.dll")
+	procCreateVirtualDisk = modVirtDisk.NewProc("CreateVirtualDisk")
+)
+
+// VIRTUAL_STORAGE_TYPE device IDs.
+const (
+	virtualStorageTypeDeviceVHD  = 2
+	virtualStorageTypeDeviceVHDX = 3
+)
+
+// virtualStorageTypeVendorMicrosoft is VIRTUAL_STORAGE_TYPE_VENDOR_MICROSOFT.
+var virtualStorageTypeVendorMicrosoft = windows.GUID{
+	Data1: 0xec984aec,
+	Data2: 0xa0f9,
+	Data3: 0x47e9,
+	Data4: [8]byte{0x90, 0x1f, 0x71, 0x41, 0x5a, 0x66, 0x34, 0x5b},
+}
+
+const (
+	createVirtualDiskVersion2                   = 2
+	createVirtualDiskFlagNone                   = 0x0
+	createVirtualDiskFlagFullPhysicalAllocation = 0x1
+)
+
+// Largest disk each format allows: 64 TB for VHDX, 2040 GB for VHD.
+const (
+	maxVHDXSizeMB = 64 << 20
+	maxVHDSizeMB  = 2040 << 10
+)
+
+type virtualStorageType struct {
+	DeviceID uint32
+	VendorID windows.GUID
+}
+
+// createVirtualDiskParameters mirrors CREATE_VIRTUAL_DISK_PARAMETERS with the
+// Version2 union member. The union is 8-byte aligned in C on every
+// architecture, so the padding after Version is spelled out for 386, where
+// Go aligns uint64 to 4.
+type createVirtualDiskParameters struct {
+	Version  uint32
+	_        uint32
+	Version2 struct {
+		UniqueID                  windows.GUID
+		MaximumSize               uint64
+		BlockSizeInBytes          uint32
+		SectorSizeInBytes         uint32
+		PhysicalSectorSizeInBytes uint32
+		ParentPath                *uint16
+		SourcePath                *uint16
+		OpenFlags                 uint32
+		ParentVirtualStorageType  virtualStorageType
+		SourceVirtualStorageType  virtualStorageType
+		ResiliencyGUID            windows.GUID
+	}
+}
+
+// VHDOptions describes a new virtual disk for CreateVHD.
+type VHDOptions struct {
+	Path    string
+	SizeMB  int64  // Ignored for differencing disks, which take the parent's size
+	Dynamic bool   // Grow on demand instead of allocating the full size up front
+	Force   bool   // Replace an existing file at Path
+	Parent  string // Create a differencing disk on top of this VHD(X)
+}
+
+// vhdStorageType picks the disk format from the file extension, which
+// virtdisk requires to match: .vhdx or .vhd.
+func vhdStorageType(path string) (virtualStorageType, error) {
+	st := virtualStorageType{VendorID: virtualStorageTypeVendorMicrosoft}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".vhdx":
+		st.DeviceID = virtualStorageTypeDeviceVHDX
+	case ".vhd":
+		st.DeviceID = virtualStorageTypeDeviceVHD
+	default:
+		return st, fmt.Errorf("%s: the file extension must be .vhdx or .vhd", path)
+	}
+	return st, nil
+}
+
+// checkVHDSize validates the size of a new disk of the given format.
+func checkVHDSize(sizeMB int64, st virtualStorageType) error {
+	if st.DeviceID == virtualStorageTypeDeviceVHD {
+		if sizeMB <= 0 || sizeMB > maxVHDSizeMB {
+			return fmt.Errorf("--size must be between 1 MB and 2040 GB for a .vhd")
+		}
+		return nil
+	}
+	if sizeMB <= 0 || sizeMB > maxVHDXSizeMB {
+		return fmt.Errorf("--size must be between 1 MB and 64 TB")
+	}
+	return nil
+}
+
+// tempVHDPath returns an unused name next to path with the same extension,
+// to create a disk under before it replaces path.
+func tempVHDPath(path string) (string, error) {
+	ext := filepath.Ext(path)
+	f, err := os.CreateTemp(filepath.Dir(path), "."+strings.TrimSuffix(filepath.Base(path), ext)+".*.tmp"+ext)
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	f.Close()
+	// CreateVirtualDisk refuses to overwrite, so only the name is kept.
+	if err := os.Remove(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// CreateVHD creates a blank VHD or VHDX (chosen by the file extension) with
+// CreateVirtualDisk and returns its absolute path. With opts.Parent set it
+// creates a differencing disk instead: writes go to the new file and reads
+// fall through to the parent, so many VMs can share one base image. With
+// opts.Force an existing file is only replaced once the new disk has been
+// created next to it, so a failed create leaves it untouched.
+func CreateVHD(opts VHDOptions) (string, error) {
+	absPath, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve path: %w", err)
+	}
+	storageType, err := vhdStorageType(absPath)
+	if err != nil {
+		return "", err
+	}
+
+	var parentPtr *uint16
+	if opts.Parent != "" {
+		absParent, err := checkParentVHD(opts.Parent)
+		if err != nil {
+			return "", err
+		}
+		if parentPtr, err = windows.UTF16PtrFromString(absParent); err != nil {
+			return "", fmt.Errorf("invalid parent path: %w", err)
+		}
+	} else if err := checkVHDSize(opts.SizeMB, storageType); err != nil {
+		return "", err
+	}
+
+	target := absPath
+	if _, err := os.Stat(absPath); err == nil {
+		if !opts.Force {
+			return "", fmt.Errorf("%s already exists (use --force to replace it)", absPath)
+		}
+		if target, err = tempVHDPath(absPath); err != nil {
+			return "", err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	if err := procCreateVirtualDisk.Find(); err != nil {
+		return "", fmt.Errorf("virtdisk.dll is not available on this system: %w", err)
+	}
+
+	var params createVirtualDiskParameters
+	params.Version = createVirtualDiskVersion2
+	flags := uint32(createVirtualDiskFlagFullPhysicalAllocation)
+	if parentPtr != nil {
+		// Size and allocation come from the parent; differencing disks are
+		// always dynamic.
+		params.Version2.ParentPath = parentPtr
+		flags = createVirtualDiskFlagNone
+	} else {
+		params.Version2.MaximumSize = uint64(opts.SizeMB) << 20
+		if opts.Dynamic {
+			flags = createVirtualDiskFlagNone
+		}
+	}
+
+	pathPtr, err := windows.UTF16PtrFromString(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid path: %w", err)
+	}
+
+	defer timed("CreateVirtualDisk")()
+	var handle windows.Handle
+	// CreateVirtualDisk(storageType, path, accessMask, securityDescriptor,
+	//     flags, providerSpecificFlags, parameters, overlapped, handle)
+	r1, _, _ := procCreateVirtualDisk.Call(
+		uintptr(unsafe.Pointer(&storageType)),
+		uintptr(unsafe.Pointer(pathPtr)),
+		0, // VIRTUAL_DISK_ACCESS_NONE, required with Version2 parameters
+		0, // security descriptor — NULL
+		uintptr(flags),
+		0,
+		uintptr(unsafe.Pointer(&params)),
+		0, // synchronous
+		uintptr(unsafe.Pointer(&handle)),
+	)
+	if r1 != 0 {
+		if target != absPath {
+			os.Remove(target)
+		}
+		return "", fmt.Errorf("CreateVirtualDisk %s: %w", absPath, syscall.Errno(r1))
+	}
+	windows.CloseHandle(handle)
+
+	if target != absPath {
+		if err := os.Rename(target, absPath); err != nil {
+			os.Remove(target)
+			return "", fmt.Errorf("replacing %s: %w", absPath, err)
+		}
+	}
+	return absPath, nil
+}
+
+// checkParentVHD validates a differencing disk's parent and returns its
+// absolute path. The parent must exist and be a VHD(X). Any write to it
+// afterwards corrupts every child, so a writable parent gets a warning
+// suggesting it be marked read-only.
+func checkParentVHD(parent string) (string, error) {
+	absParent, err := filepath.Abs(parent)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve parent path: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(absParent)) {
+	case ".vhd", ".vhdx":
+	default:
+		return "", fmt.Errorf("parent %s is not a .vhd or .vhdx file", absParent)
+	}
+	info, err := os.Stat(absParent)
+	if err != nil {
+		return "", fmt.Errorf("parent not found: %w", err)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("parent %s is a directory", absParent)
+	}
+	if info.Mode().Perm()&0200 != 0 {
+		fmt.Fprintf(os.Stderr, "Warning: parent %s is writable; changing it will corrupt its differencing disks. Consider: attrib +R %q\n", absParent, absParent)
+	}
+	return absParent, nil
+}
+
+// Format signatures: a VHDX starts with the file type identifier
+// "vhdxfile"; a VHD ends with a 512-byte footer starting with the cookie
+// "conectix", which dynamic VHDs also copy to offset 0.
+const (
+	vhdxSignature   = "vhdxfile"
+	vhdFooterCookie = "conectix"
+	vhdFooterSize   = 512
+)
+
+// checkDiskFormat reads the signature of a disk file and rejects anything
+// that is not a VHD or VHDX, such as raw images or empty files, which HCS
+// would otherwise fail on with an unhelpful error deep inside create.
+func checkDiskFormat(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory, not a virtual disk", path)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%s is empty, not a virtual disk", path)
+	}
+
+	sig := make([]byte, len(vhdxSignature))
+	if _, err := f.ReadAt(sig, 0); err == nil {
+		if s := string(sig); s == vhdxSignature || s == vhdFooterCookie {
+			return nil
+		}
+	}
+	if info.Size() >= vhdFooterSize {
+		if _, err := f.ReadAt(sig, info.Size()-vhdFooterSize); err == nil && string(sig) == vhdFooterCookie {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a VHD or VHDX file (no %q signature); convert raw images with Convert-VHD or qemu-img first", path, vhdxSignature)
+}
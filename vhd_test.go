@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckDiskFormat(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	vhdx := append([]byte(vhdxSignature), make([]byte, 1024)...)
+	fixedVHD := make([]byte, 2048)
+	copy(fixedVHD[len(fixedVHD)-vhdFooterSize:], vhdFooterCookie)
+	dynamicVHD := append([]byte(vhdFooterCookie), make([]byte, 100)...)
+
+	valid := map[string][]byte{
+		"disk.vhdx":    vhdx,
+		"fixed.vhd":    fixedVHD,
+		"dynamic.vhd":  dynamicVHD,
+		"renamed.disk": vhdx,
+	}
+	for name, data := range valid {
+		if err := checkDiskFormat(write(name, data)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	invalid := map[string][]byte{
+		"empty.vhdx": nil,
+		"raw.img":    make([]byte, 4096),
+		"short.vhdx": []byte("vhd"),
+	}
+	for name, data := range invalid {
+		if err := checkDiskFormat(write(name, data)); err == nil {
+			t.Errorf("%s: accepted, want error", name)
+		}
+	}
+	if err := checkDiskFormat(dir); err == nil {
+		t.Errorf("directory accepted, want error")
+	}
+}
+
+func TestVHDStorageTypeAndSize(t *testing.T) {
+	vhdx, err := vhdStorageType(`C:\vm\disk.VHDX`)
+	if err != nil || vhdx.DeviceID != virtualStorageTypeDeviceVHDX {
+		t.Errorf(".VHDX: got %+v, %v", vhdx, err)
+	}
+	vhd, err := vhdStorageType(`C:\vm\disk.vhd`)
+	if err != nil || vhd.DeviceID != virtualStorageTypeDeviceVHD {
+		t.Errorf(".vhd: got %+v, %v", vhd, err)
+	}
+	for _, p := range []string{`C:\vm\disk.img`, `C:\vm\disk`} {
+		if _, err := vhdStorageType(p); err == nil {
+			t.Errorf("%s: accepted, want error", p)
+		}
+	}
+
+	tests := []struct {
+		sizeMB int64
+		st     virtualStorageType
+		ok     bool
+	}{
+		{1, vhdx, true},
+		{maxVHDXSizeMB, vhdx, true},
+		{maxVHDXSizeMB + 1, vhdx, false},
+		{0, vhdx, false},
+		{-1, vhdx, false},
+		{maxVHDSizeMB, vhd, true},
+		{maxVHDSizeMB + 1, vhd, false},
+		{0, vhd, false},
+	}
+	for _, tt := range tests {
+		if err := checkVHDSize(tt.sizeMB, tt.st); (err == nil) != tt.ok {
+			t.Errorf("checkVHDSize(%d, device %d) = %v, want ok=%v", tt.sizeMB, tt.st.DeviceID, err, tt.ok)
+		}
+	}
+}
+
+func TestTempVHDPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "disk.vhdx")
+	tmp, err := tempVHDPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(tmp) != dir || filepath.Ext(tmp) != ".vhdx" || tmp == path {
+		t.Errorf("tempVHDPath(%s) = %s, want another .vhdx in the same directory", path, tmp)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("temporary name %s exists (stat err %v); CreateVirtualDisk needs it free", tmp, err)
+	}
+}
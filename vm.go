@@ -1,14 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/tabwriter"
+	"text/template"
+	"time"
 
 	"golang.org/x/sys/windows"
+
+	"hcstool/hcs"
 )
 
 // --- HCS v2 JSON spec structs (partially typed) ---
@@ -31,6 +42,7 @@ type VirtualMachineSpec struct {
 	StopOnReset bool                  `json:"StopOnReset"`
 	Chipset     json.RawMessage       `json:"Chipset,omitempty"`
 	ComputeTopology json.RawMessage   `json:"ComputeTopology,omitempty"`
+	SecuritySettings json.RawMessage  `json:"SecuritySettings,omitempty"`
 	Devices     *DevicesSpec          `json:"Devices,omitempty"`
 }
 
@@ -43,6 +55,13 @@ type DevicesSpec struct {
 	Keyboard          json.RawMessage      `json:"Keyboard,omitempty"`
 	Mouse             json.RawMessage      `json:"Mouse,omitempty"`
 	VideoMonitor      json.RawMessage      `json:"VideoMonitor,omitempty"`
+	NetworkAdapters   map[string]*NetworkAdapter `json:"NetworkAdapters,omitempty"`
+	Plan9             *Plan9Spec                 `json:"Plan9,omitempty"`
+}
+
+type NetworkAdapter struct {
+	EndpointId string `json:"EndpointId,omitempty"`
+	MacAddress string `json:"MacAddress,omitempty"`
 }
 
 type ScsiController struct {
@@ -50,8 +69,34 @@ type ScsiController struct {
 }
 
 type ScsiAttachment struct {
-	Type   string `json:"Type"`
-	Path   string `json:"Path"`
+	Type        string `json:"Type"`
+	Path        string `json:"Path"`
+	CachingMode string `json:"CachingMode,omitempty"` // Uncached, Cached or ReadOnlyCached
+	ReadOnly    bool   `json:"ReadOnly,omitempty"`
+}
+
+// SCSI attachment types. PassThru is HCS' name for a raw host disk; its Path
+// is a device path like \\.\PhysicalDrive2 rather than a file.
+const (
+	attachVirtualDisk = "VirtualDisk"
+	attachIso         = "Iso"
+	attachPassThru    = "PassThru"
+)
+
+// diskTypes maps the --disk-type values to attachment types.
+var diskTypes = map[string]string{
+	"virtual":  attachVirtualDisk,
+	"physical": attachPassThru,
+	"iso":      attachIso,
+}
+
+// physicalDriveRe matches the device paths accepted for pass-through disks.
+var physicalDriveRe = regexp.MustCompile(`(?i)^\\\\\.\\PhysicalDrive[0-9]+$`)
+
+// hostFile reports whether the attachment's Path is a host file, as opposed
+// to a pass-through device. Only files are path-rewritten and ACL-granted.
+func (a *ScsiAttachment) hostFile() bool {
+	return a != nil && a.Path != "" && a.Type != attachPassThru
 }
 
 type VirtualPciDev struct {
@@ -59,6 +104,13 @@ type VirtualPciDev struct {
 	VirtualFunction    int    `json:"VirtualFunction,omitempty"`
 }
 
+// ShutdownOptions is the options document for HcsShutDownComputeSystem.
+type ShutdownOptions struct {
+	Mechanism string `json:"Mechanism,omitempty"` // GuestConnection or IntegrationService
+	Type      string `json:"Type,omitempty"`      // Shutdown, Hibernate or Reboot
+	Force     bool   `json:"Force,omitempty"`
+}
+
 // --- Enumeration result structs ---
 
 type EnumEntry struct {
@@ -68,11 +120,18 @@ type EnumEntry struct {
 	State        string `json:"State"`
 	Name         string `json:"Name,omitempty"`
 	Owner        string `json:"Owner,omitempty"`
+
+	// Statistics is only present when the host includes it in the
+	// enumeration document; list --format wide shows it if so.
+	Statistics *SystemStatistics `json:"Statistics,omitempty"`
 }
 
 // --- VM lifecycle operations ---
 
-// extractVHDPaths walks the spec to find all VHD(X) paths from SCSI attachments.
+// extractVHDPaths walks the spec to find all VHD(X) and ISO paths from SCSI
+// attachments. Pass-through disks are skipped: HcsGrantVmAccess applies to
+// files, and a physical disk is handed to the VM by taking it offline on the
+// host instead.
 func extractVHDPaths(spec *ComputeSystemSpec) []string {
 	var paths []string
 	if spec.VirtualMachine == nil || spec.VirtualMachine.Devices == nil {
@@ -83,7 +142,7 @@ func extractVHDPaths(spec *ComputeSystemSpec) []string {
 			continue
 		}
 		for _, att := range ctrl.Attachments {
-			if att != nil && att.Path != "" {
+			if att.hostFile() {
 				paths = append(paths, att.Path)
 			}
 		}
@@ -91,8 +150,27 @@ func extractVHDPaths(spec *ComputeSystemSpec) []string {
 	return paths
 }
 
+// extractKernelPaths returns the kernel and initrd of a direct-boot spec,
+// which the VM needs access to just like its disks.
+func extractKernelPaths(spec *ComputeSystemSpec) []string {
+	var chipset uefiChipset
+	if spec.VirtualMachine == nil || len(spec.VirtualMachine.Chipset) == 0 ||
+		json.Unmarshal(spec.VirtualMachine.Chipset, &chipset) != nil || chipset.LinuxKernelDirect == nil {
+		return nil
+	}
+	var paths []string
+	for _, p := range []string{chipset.LinuxKernelDirect.KernelFilePath, chipset.LinuxKernelDirect.InitRdPath} {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
 // makePathsAbsolute converts all VHD paths in the spec to absolute paths.
-func makePathsAbsolute(spec *ComputeSystemSpec) error {
+// Relative paths are resolved against baseDir, or the working directory if
+// baseDir is empty. Paths that are already absolute are left untouched.
+func makePathsAbsolute(spec *ComputeSystemSpec, baseDir string) error {
 	if spec.VirtualMachine == nil || spec.VirtualMachine.Devices == nil {
 		return nil
 	}
@@ -101,8 +179,12 @@ func makePathsAbsolute(spec *ComputeSystemSpec) error {
 			continue
 		}
 		for _, att := range ctrl.Attachments {
-			if att != nil && att.Path != "" {
-				abs, err := filepath.Abs(att.Path)
+			if att.hostFile() {
+				p := att.Path
+				if baseDir != "" && !filepath.IsAbs(p) {
+					p = filepath.Join(baseDir, p)
+				}
+				abs, err := filepath.Abs(p)
 				if err != nil {
 					return fmt.Errorf("cannot resolve path %q: %w", att.Path, err)
 				}
@@ -113,8 +195,8 @@ func makePathsAbsolute(spec *ComputeSystemSpec) error {
 	return nil
 }
 
-// injectGPU adds or replaces the VirtualPci section in the spec with GPU-PV
-// devices from the provided GPU list.
+// injectGPU adds GPU-PV devices from the provided GPU list to the spec's
+// VirtualPci section, keeping devices the spec already declares.
 func injectGPU(spec *ComputeSystemSpec, gpus []GpuDevice) {
 	if spec.VirtualMachine == nil {
 		spec.VirtualMachine = &VirtualMachineSpec{}
@@ -123,20 +205,195 @@ func injectGPU(spec *ComputeSystemSpec, gpus []GpuDevice) {
 		spec.VirtualMachine.Devices = &DevicesSpec{}
 	}
 
-	pciDevs := make(map[string]*VirtualPciDev)
-	for i, gpu := range gpus {
-		key := fmt.Sprintf("gpu-%d", i)
-		pciDevs[key] = &VirtualPciDev{
+	pciDevs := spec.VirtualMachine.Devices.VirtualPci
+	if pciDevs == nil {
+		pciDevs = make(map[string]*VirtualPciDev)
+	}
+	for key, dev := range newGPUDevices(pciDevs, gpus) {
+		pciDevs[key] = dev
+	}
+	spec.VirtualMachine.Devices.VirtualPci = pciDevs
+}
+
+// gpuHotAddRequests returns the modify requests that hot-add the GPUs not
+// already in existing, in gpu-N key order so GPUs are added in the order
+// they were selected.
+func gpuHotAddRequests(existing map[string]*VirtualPciDev, gpus []GpuDevice) []ModifySettingRequest {
+	devs := newGPUDevices(existing, gpus)
+	keys := make([]string, 0, len(devs))
+	for key := range devs {
+		keys = append(keys, key)
+	}
+	// Keys are all gpu-N: a shorter key has the smaller N.
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) < len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+
+	reqs := make([]ModifySettingRequest, 0, len(keys))
+	for _, key := range keys {
+		reqs = append(reqs, ModifySettingRequest{
+			ResourcePath: "VirtualMachine/Devices/VirtualPci/" + key,
+			RequestType:  "Add",
+			Settings:     devs[key],
+		})
+	}
+	return reqs
+}
+
+// newGPUDevices returns VirtualPci entries for the GPUs not already in
+// existing. A GPU whose instance path is present isn't added twice, and new
+// entries get the first free gpu-N keys so they never collide with the
+// spec's own names.
+func newGPUDevices(existing map[string]*VirtualPciDev, gpus []GpuDevice) map[string]*VirtualPciDev {
+	present := make(map[string]bool)
+	for _, dev := range existing {
+		if dev != nil {
+			present[strings.ToUpper(dev.DeviceInstancePath)] = true
+		}
+	}
+
+	added := make(map[string]*VirtualPciDev)
+	next := 0
+	for _, gpu := range gpus {
+		if present[strings.ToUpper(gpu.InstanceID)] {
+			continue
+		}
+		key := fmt.Sprintf("gpu-%d", next)
+		for existing[key] != nil {
+			next++
+			key = fmt.Sprintf("gpu-%d", next)
+		}
+		next++
+		present[strings.ToUpper(gpu.InstanceID)] = true
+		added[key] = &VirtualPciDev{
 			DeviceInstancePath: gpu.InstanceID,
 			VirtualFunction:    0xFFFF, // auto-assign GPU partition
 		}
 	}
-	spec.VirtualMachine.Devices.VirtualPci = pciDevs
+	return added
+}
+
+// ownerEnvVar names the environment variable holding the default Owner.
+const ownerEnvVar = "HCSTOOL_OWNER"
+
+// resolveOwner picks the Owner for a new system. Precedence is: explicit
+// --owner flag, then $HCSTOOL_OWNER, then the spec file's Owner, then
+// "hcstool".
+func resolveOwner(flagOwner, envOwner, specOwner string) string {
+	switch {
+	case flagOwner != "":
+		return flagOwner
+	case envOwner != "":
+		return envOwner
+	case specOwner != "":
+		return specOwner
+	default:
+		return "hcstool"
+	}
+}
+
+// CreateOptions controls how CreateAndStartVM creates a VM from a spec.
+type CreateOptions struct {
+	Name    string // Friendly name, used for progress output
+	ID      string // Pinned system ID; a fresh GUID is generated per attempt if empty
+	Owner   string // Explicit --owner; see resolveOwner for precedence
+	AddGPU  bool   // Inject all GPU-PV capable adapters into the spec
+	// HotAddGPU adds the GPU-PV adapters with HcsModifyComputeSystem once
+	// the VM is running, instead of baking them into the create spec.
+	HotAddGPU bool
+	// IgnoreMissingGPU creates the VM without GPU-PV, with a warning, when
+	// AddGPU or HotAddGPU finds no capable adapter on the host.
+	IgnoreMissingGPU bool
+	// GPUInstances limits AddGPU or HotAddGPU to exactly these adapter
+	// instance IDs instead of every capable adapter.
+	GPUInstances []string
+	BaseDir string // Directory relative disk paths are resolved against ("" = CWD)
+
+	// SDDL is a security descriptor restricting who can open and control
+	// the system, e.g. "O:BAG:BAD:(A;;GA;;;BA)" ("" = HCS default).
+	SDDL string
+
+	// PrintJSON prints {"id","name","owner"} on success instead of the
+	// bare ID.
+	PrintJSON bool
+
+	// KeepACLs leaves granted VM access in place when create fails, so the
+	// failure can be investigated or retried by hand.
+	KeepACLs bool
+
+	// Retries is how many extra create+start attempts to make when a
+	// failure's HRESULT is in RetryOn (defaultTransientHRESULTs if nil).
+	Retries int
+	RetryOn map[uint32]bool
+
+	// Shares are host directories exposed to the guest over Plan9.
+	Shares []*Plan9Share
+
+	// OpenExisting makes create with a pinned ID idempotent: if a system
+	// with that ID already exists it is started if needed and reported as
+	// created, with a warning if the spec saved when hcstool created it
+	// differs from this one, or if there is no saved spec to compare.
+	OpenExisting bool
+
+	// Replace terminates an existing system with ID, or else every one
+	// named Name, owned by the resolved owner once the spec is prepared and
+	// right before the create, asking first unless AssumeYes is set. See
+	// ReplaceExisting.
+	Replace   bool
+	AssumeYes bool
+
+	// StopOnReset overrides the spec's VirtualMachine.StopOnReset when set:
+	// true powers the VM off when the guest resets (reboots, or restarts
+	// after a crash), false lets it restart.
+	StopOnReset *bool
+
+	// Endpoint attaches a network adapter to this existing HNS endpoint
+	// (a bare GUID). The endpoint is not created or deleted.
+	Endpoint string
+
+	// PostCreateModify are modify requests applied, in order, once the VM
+	// is running. The VM is granted access to the files they reference.
+	PostCreateModify []ModifySettingRequest
+
+	// OnStart is a host command line run once the VM is running, with its
+	// ID in HCSTOOL_VM_ID. A failing hook only warns unless
+	// OnStartRequired is set, which fails (and undoes) the create instead.
+	OnStart         string
+	OnStartRequired bool
+}
+
+// resetActions maps --on-reset values to VirtualMachine.StopOnReset. HCS has
+// no separate crash action: a guest that crashes and reboots is a reset.
+var resetActions = map[string]bool{
+	"stop":    true,
+	"restart": false,
+}
+
+// createdVM is what create --print-json reports for each new VM.
+type createdVM struct {
+	ID    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Owner string `json:"owner"`
 }
 
 // CreateAndStartVM creates and starts a VM from a JSON spec string. It handles
-// granting VM access to VHD files, and cleans up on failure.
-func CreateAndStartVM(specJSON string, name string, addGPU bool) error {
+// granting VM access to VHD files, and cleans up on failure. Transient
+// failures are retried per opts.Retries, cleaning up between attempts.
+func CreateAndStartVM(specJSON string, opts CreateOptions) error {
+	if opts.ID != "" && !guidRe.MatchString(opts.ID) {
+		return fmt.Errorf("invalid --id %q: expected a GUID like 01234567-89ab-cdef-0123-456789abcdef", opts.ID)
+	}
+	var sd *windows.SECURITY_DESCRIPTOR
+	if opts.SDDL != "" {
+		var err error
+		if sd, err = windows.SecurityDescriptorFromString(opts.SDDL); err != nil {
+			return fmt.Errorf("invalid --sddl %q: %w", opts.SDDL, err)
+		}
+	}
+
 	// Parse the spec
 	var spec ComputeSystemSpec
 	if err := json.Unmarshal([]byte(specJSON), &spec); err != nil {
@@ -144,29 +401,35 @@ func CreateAndStartVM(specJSON string, name string, addGPU bool) error {
 	}
 
 	// Set owner/name
-	if spec.Owner == "" {
-		spec.Owner = "hcstool"
-	}
+	spec.Owner = resolveOwner(opts.Owner, os.Getenv(ownerEnvVar), spec.Owner)
 
 	// Resolve VHD paths to absolute
-	if err := makePathsAbsolute(&spec); err != nil {
+	if err := makePathsAbsolute(&spec, opts.BaseDir); err != nil {
 		return err
 	}
 
-	// Inject GPU if requested
-	if addGPU {
-		gpus, err := enumerateGPUs()
-		if err != nil {
-			return fmt.Errorf("GPU enumeration failed: %w", err)
+	if len(opts.Shares) > 0 {
+		if err := injectShares(&spec, opts.Shares); err != nil {
+			return err
 		}
-		if len(gpus) == 0 {
-			return fmt.Errorf("no GPUs found for GPU-PV")
+	}
+
+	if opts.Endpoint != "" {
+		if err := injectEndpoint(&spec, opts.Endpoint); err != nil {
+			return err
 		}
-		fmt.Fprintf(os.Stderr, "Found %d GPU(s) for GPU-PV:\n", len(gpus))
-		for _, g := range gpus {
-			fmt.Fprintf(os.Stderr, "  %s (%s)\n", g.Name, g.InstanceID)
+	}
+
+	if opts.StopOnReset != nil {
+		if spec.VirtualMachine == nil {
+			return fmt.Errorf("--on-reset needs a spec with a VirtualMachine section")
 		}
-		injectGPU(&spec, gpus)
+		spec.VirtualMachine.StopOnReset = *opts.StopOnReset
+	}
+
+	postStart, err := applyCreateGPUs(&spec, opts)
+	if err != nil {
+		return err
 	}
 
 	// Re-serialize the spec
@@ -176,366 +439,1900 @@ func CreateAndStartVM(specJSON string, name string, addGPU bool) error {
 	}
 	finalJSON := string(specBytes)
 
-	// Generate a GUID for this VM
-	guid, err := windows.GenerateGUID()
-	if err != nil {
-		return fmt.Errorf("GenerateGUID failed: %w", err)
+	// Everything that can reject the spec has run; only now is it safe to
+	// tear down what the create would collide with.
+	if opts.Replace {
+		if err := ReplaceExisting(opts.ID, opts.Name, spec.Owner, opts.AssumeYes); err != nil {
+			return err
+		}
 	}
-	// GUID.String() returns "{...}" but HCS expects bare GUID without braces
-	vmID := strings.Trim(guid.String(), "{}")
 
-	if name != "" {
-		fmt.Fprintf(os.Stderr, "Creating VM %q (ID: %s)...\n", name, vmID)
-	} else {
-		fmt.Fprintf(os.Stderr, "Creating VM (ID: %s)...\n", vmID)
-	}
-
-	// Grant VM access to all VHD paths
-	vhdPaths := extractVHDPaths(&spec)
-	var grantedPaths []string
-	for _, p := range vhdPaths {
-		fmt.Fprintf(os.Stderr, "  Granting VM access to %s\n", p)
-		if err := grantVmAccess(vmID, p); err != nil {
-			// Cleanup: revoke already-granted paths
-			for _, gp := range grantedPaths {
-				_ = revokeVmAccess(vmID, gp)
-			}
-			return fmt.Errorf("grant VM access: %w", err)
+	retryOn := opts.RetryOn
+	if retryOn == nil {
+		retryOn = defaultTransientHRESULTs
+	}
+	attempts := opts.Retries + 1
+	for attempt := 1; ; attempt++ {
+		err = launchVM(&spec, finalJSON, sd, postStart, opts)
+		if err == nil || attempt >= attempts || !isTransient(err, retryOn) {
+			return err
 		}
-		grantedPaths = append(grantedPaths, p)
+		backoff := time.Duration(attempt) * time.Second
+		progress(progressEvent{Event: "retry", Name: opts.Name, Attempt: attempt, Error: err.Error()},
+			"Attempt %d/%d failed with a transient error, retrying in %s: %v", attempt, attempts, backoff, err)
+		time.Sleep(backoff)
 	}
+}
 
-	// Create the compute system
-	op, err := createOperation()
-	if err != nil {
-		revokeAll(vmID, grantedPaths)
-		return err
+// applyCreateGPUs injects the GPUs of a create with --gpu into spec, or, with
+// --gpu-hotadd, returns the modify requests that add them after start.
+func applyCreateGPUs(spec *ComputeSystemSpec, opts CreateOptions) ([]ModifySettingRequest, error) {
+	if opts.AddGPU {
+		gpus, err := selectCreateGPUs(opts.IgnoreMissingGPU, opts.GPUInstances)
+		if err != nil {
+			return nil, err
+		}
+		if len(gpus) > 0 {
+			injectGPU(spec, gpus)
+		}
 	}
 
-	sys, err := createComputeSystem(vmID, finalJSON, op)
-	resultJSON, waitErr := waitForResult(op, infinite)
-	closeOperation(op)
+	var postStart []ModifySettingRequest
+	if opts.HotAddGPU {
+		gpus, err := selectCreateGPUs(opts.IgnoreMissingGPU, opts.GPUInstances)
+		if err != nil {
+			return nil, err
+		}
+		var existing map[string]*VirtualPciDev
+		if spec.VirtualMachine != nil && spec.VirtualMachine.Devices != nil {
+			existing = spec.VirtualMachine.Devices.VirtualPci
+		}
+		postStart = gpuHotAddRequests(existing, gpus)
+	}
+	return postStart, nil
+}
 
-	if err != nil {
-		revokeAll(vmID, grantedPaths)
-		return err
+// selectCreateGPUs picks the GPUs for a create with --gpu or --gpu-hotadd:
+// the adapters named in instances, or else every capable one. A host
+// without a capable GPU fails the create unless ignoreMissing is set, in
+// which case it warns and returns none. Named adapters must always exist.
+func selectCreateGPUs(ignoreMissing bool, instances []string) ([]GpuDevice, error) {
+	if len(instances) > 0 {
+		gpus, err := enumerateGPUs()
+		if err != nil {
+			return nil, fmt.Errorf("GPU enumeration failed: %w", err)
+		}
+		return selectGPUInstances(gpus, instances)
 	}
-	if waitErr != nil {
-		revokeAll(vmID, grantedPaths)
-		if resultJSON != "" {
-			fmt.Fprintf(os.Stderr, "Create result: %s\n", resultJSON)
+	gpus, err := selectGPUs()
+	if errors.Is(err, errNoGPUs) && ignoreMissing {
+		fmt.Fprintf(os.Stderr, "Warning: %v; creating the VM without GPU-PV\n", err)
+		return nil, nil
+	}
+	return gpus, err
+}
+
+// launchVM performs one create+start attempt of a prepared spec: it picks the
+// system ID, grants disk access, creates and starts the system, applies the
+// postStart modify requests, and undoes whatever it did if any step fails.
+func launchVM(spec *ComputeSystemSpec, finalJSON string, sd *windows.SECURITY_DESCRIPTOR, postStart []ModifySettingRequest, opts CreateOptions) error {
+	name := opts.Name
+
+	vmID := opts.ID
+	if vmID == "" {
+		// Generate a GUID for this VM
+		guid, err := windows.GenerateGUID()
+		if err != nil {
+			return fmt.Errorf("GenerateGUID failed: %w", err)
+		}
+		if vmID, err = bareGUID(guid); err != nil {
+			return err
 		}
-		return fmt.Errorf("create compute system: %w", waitErr)
 	}
 
-	// Start the compute system
-	op2, err := createOperation()
-	if err != nil {
-		terminateAndClose(sys)
-		revokeAll(vmID, grantedPaths)
-		return err
+	creating := progressEvent{Event: "creating", ID: vmID, Name: name}
+	if name != "" {
+		progress(creating, "Creating VM %q (ID: %s)...", name, vmID)
+	} else {
+		progress(creating, "Creating VM (ID: %s)...", vmID)
 	}
 
-	if err := startComputeSystem(sys, op2); err != nil {
-		closeOperation(op2)
-		terminateAndClose(sys)
-		revokeAll(vmID, grantedPaths)
+	// Track what has been done so far so Ctrl-C mid-create can undo it.
+	grants := newGrantTxn(vmID)
+	pc := trackCreate(vmID, opts.KeepACLs, grants)
+
+	// Grant VM access to all VHD paths and direct-boot files
+	vhdPaths := append(extractVHDPaths(spec), extractKernelPaths(spec)...)
+	for _, p := range modifyRequestPaths(opts.PostCreateModify) {
+		if !stringSliceContains(vhdPaths, p) {
+			vhdPaths = append(vhdPaths, p)
+		}
+	}
+	releaseACLs := func() {
+		if !opts.KeepACLs {
+			if err := grants.Rollback(); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+			return
+		}
+		if paths := grants.Paths(); len(paths) > 0 {
+			fmt.Fprintf(os.Stderr, "Keeping VM access for %s on:\n", vmID)
+			for _, p := range paths {
+				fmt.Fprintf(os.Stderr, "  %s\n", p)
+			}
+		}
+	}
+	// fail undoes a partial create and returns err, terminating sys if it is
+	// a started system.
+	saved := false
+	fail := func(sys HcsSystem, err error) error {
+		progress(progressEvent{Event: "failed", ID: vmID, Name: name, Error: err.Error()}, "")
+		pc.untrack()
+		if saved {
+			removeSavedSpec(vmID)
+		}
+		if sys.Valid() {
+			terminateAndClose(sys)
+		}
+		releaseACLs()
 		return err
 	}
 
-	_, waitErr = waitForResult(op2, infinite)
-	closeOperation(op2)
+	// Grant, create and start. The grants are made in our own transaction,
+	// which also backs interrupt cleanup and --keep-acls, so rolling them
+	// back is left to fail.
+	traceHCSDocument("HcsCreateComputeSystem", vmID, finalJSON)
+	done := timed("create and start")
+	sys, err := hcs.CreateAndStart(vmID, finalJSON, hcs.CreateOptions{
+		GrantPaths:         vhdPaths,
+		Grants:             grants,
+		SecurityDescriptor: sd,
+		Granting: func(p string) {
+			progress(progressEvent{Event: "grant", ID: vmID, Path: p}, "  Granting VM access to %s", p)
+		},
+		Created: pc.created,
+		CreateDone: func() {
+			progress(progressEvent{Event: "created", ID: vmID}, "")
+			if err := saveSpec(vmID, finalJSON); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v; export, clone and inspect will not know its configuration\n", err)
+				return
+			}
+			saved = true
+			pc.specSaved()
+		},
+	}, infinite)
+	done()
+
+	if opts.OpenExisting && isHRESULT(err, hcsESystemAlreadyExists) {
+		// The grants above are the ones the existing system needs too, so
+		// they stay in place.
+		pc.untrack()
+		grants.Commit()
+		return openExistingVM(vmID, spec, opts)
+	}
+	if err != nil {
+		// CreateAndStart has already terminated or closed the system.
+		return fail(HcsSystem{}, err)
+	}
+
+	// Hot-add what must only be attached to a running system
+	for _, req := range postStart {
+		progress(progressEvent{Event: "hotadd", ID: vmID, Path: req.ResourcePath}, "  Hot-adding %s", req.ResourcePath)
+		if err := modifyRunningSystem(sys, req); err != nil {
+			return fail(sys, fmt.Errorf("hot-add %s: %w", req.ResourcePath, err))
+		}
+	}
+
+	// Then whatever --post-create-modify asked for
+	for _, req := range opts.PostCreateModify {
+		progress(progressEvent{Event: "modify", ID: vmID, Path: req.ResourcePath}, "  Applying %s %s", req.RequestType, req.ResourcePath)
+		if err := modifyRunningSystem(sys, req); err != nil {
+			return fail(sys, fmt.Errorf("post-create modify %s: %w", req.ResourcePath, err))
+		}
+	}
 
-	if waitErr != nil {
-		terminateAndClose(sys)
-		revokeAll(vmID, grantedPaths)
-		return fmt.Errorf("start compute system: %w", waitErr)
+	if err := runOnStartHook(vmID, opts); err != nil {
+		return fail(sys, err)
 	}
 
 	// Success — close our handle (VM keeps running)
+	pc.untrack()
+	grants.Commit()
 	closeComputeSystem(sys)
 
-	// Print the VM ID to stdout for scripting
-	fmt.Println(vmID)
-	fmt.Fprintf(os.Stderr, "VM started successfully.\n")
-	return nil
+	return reportCreated(createdVM{ID: vmID, Name: name, Owner: spec.Owner}, opts)
 }
 
-// terminateAndClose attempts to terminate and then close a compute system.
-func terminateAndClose(sys HcsSystem) {
-	op, err := createOperation()
-	if err != nil {
-		closeComputeSystem(sys)
-		return
+// reportCreated prints a running VM's ID to stdout for scripting, or its
+// createdVM record with opts.PrintJSON.
+func reportCreated(vm createdVM, opts CreateOptions) error {
+	if opts.PrintJSON {
+		data, err := json.Marshal(vm)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	} else {
+		fmt.Println(vm.ID)
 	}
-	_ = terminateComputeSystem(sys, op)
-	_, _ = waitForResult(op, 5000)
-	closeOperation(op)
-	closeComputeSystem(sys)
+	progress(progressEvent{Event: "started", ID: vm.ID, Name: vm.Name}, "VM started successfully.")
+	return nil
 }
 
-// revokeAll revokes VM access for all paths.
-func revokeAll(vmID string, paths []string) {
-	for _, p := range paths {
-		_ = revokeVmAccess(vmID, p)
+// openExistingVM adopts the already existing system vmID for an idempotent
+// create: it warns about configuration that differs from spec, starts the
+// system if it was created but never started, and reports it as created.
+// The existing configuration is the spec saved when hcstool created it; a
+// system without one is adopted with a warning that it was not compared.
+func openExistingVM(vmID string, spec *ComputeSystemSpec, opts CreateOptions) error {
+	progress(progressEvent{Event: "exists", ID: vmID}, "Compute system %s already exists, opening it", vmID)
+
+	if have, err := loadSavedSpec(vmID); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: cannot compare existing system %s with the spec: %v\n", vmID, err)
+	} else {
+		for _, d := range specDifferences(spec, have) {
+			fmt.Fprintf(os.Stderr, "Warning: existing system %s differs from the spec: %s\n", vmID, d)
+		}
 	}
-}
 
-// ListVMs enumerates all HCS compute systems and prints them as a table.
-func ListVMs() error {
-	resultJSON, err := enumerateComputeSystems()
+	entry, err := findEnumEntry(vmID)
 	if err != nil {
 		return err
 	}
+	switch entry.State {
+	case "Running":
+	case "Created":
+		if err := hcs.Start(vmID, infinite); err != nil {
+			return fmt.Errorf("start existing compute system: %w", err)
+		}
+	default:
+		return fmt.Errorf("existing compute system %s is %s and cannot be started; remove it or use another --id", vmID, entry.State)
+	}
 
-	if resultJSON == "" || resultJSON == "[]" {
-		fmt.Println("No compute systems found.")
-		return nil
+	// The system was already there, so a required hook failing leaves it be.
+	if err := runOnStartHook(vmID, opts); err != nil {
+		return err
 	}
 
-	var entries []EnumEntry
-	if err := json.Unmarshal([]byte(resultJSON), &entries); err != nil {
-		return fmt.Errorf("failed to parse enumeration result: %w\n  raw: %s", err, resultJSON)
+	return reportCreated(createdVM{ID: vmID, Name: entry.Name, Owner: entry.Owner}, opts)
+}
+
+// specDifferences lists what an existing system's saved configuration does
+// not share with the spec it was expected to match: owner, disks, memory
+// size and CPU count. Fields the saved spec leaves out are skipped.
+func specDifferences(want, have *ComputeSystemSpec) []string {
+	var diffs []string
+	if want.Owner != "" && have.Owner != "" && !strings.EqualFold(want.Owner, have.Owner) {
+		diffs = append(diffs, fmt.Sprintf("owner %q, spec has %q", have.Owner, want.Owner))
+	}
+	if want.VirtualMachine == nil || have.VirtualMachine == nil {
+		if want.VirtualMachine != nil {
+			diffs = append(diffs, "it is not a VM")
+		}
+		return diffs
 	}
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
-	fmt.Fprintln(w, "ID\tTYPE\tSTATE\tOWNER\tNAME")
-	for _, e := range entries {
-		name := e.Name
-		if name == "" {
-			name = "-"
+	wantDisks, haveDisks := extractVHDPaths(want), extractVHDPaths(have)
+	sort.Strings(wantDisks)
+	sort.Strings(haveDisks)
+	if !stringSlicesEqualFold(wantDisks, haveDisks) {
+		diffs = append(diffs, fmt.Sprintf("disks %q, spec has %q", haveDisks, wantDisks))
+	}
+
+	var wantTopo, haveTopo computeTopology
+	if json.Unmarshal(want.VirtualMachine.ComputeTopology, &wantTopo) == nil &&
+		json.Unmarshal(have.VirtualMachine.ComputeTopology, &haveTopo) == nil {
+		if wantTopo.Memory.SizeInMB != haveTopo.Memory.SizeInMB {
+			diffs = append(diffs, fmt.Sprintf("memory %d MB, spec has %d MB", haveTopo.Memory.SizeInMB, wantTopo.Memory.SizeInMB))
 		}
-		owner := e.Owner
-		if owner == "" {
-			owner = "-"
+		if wantTopo.Processor.Count != haveTopo.Processor.Count {
+			diffs = append(diffs, fmt.Sprintf("%d vCPU, spec has %d", haveTopo.Processor.Count, wantTopo.Processor.Count))
 		}
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Id, e.SystemType, e.State, owner, name)
 	}
-	w.Flush()
-	return nil
+	return diffs
 }
 
-// InspectVM opens a compute system and prints its properties as pretty JSON.
-func InspectVM(id string) error {
-	sys, err := openComputeSystem(id)
-	if err != nil {
-		return err
+// stringSlicesEqualFold reports whether a and b hold the same strings in the
+// same order, ignoring case.
+func stringSlicesEqualFold(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
 	}
-	defer closeComputeSystem(sys)
-
-	propsJSON, err := getComputeSystemProperties(sys)
-	if err != nil {
-		return err
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
 	}
+	return true
+}
 
-	// Pretty-print the JSON
-	var raw json.RawMessage
-	if err := json.Unmarshal([]byte(propsJSON), &raw); err != nil {
-		// If it's not valid JSON, just print it raw
-		fmt.Println(propsJSON)
-		return nil
+// CreateCopies creates count identical VMs from the same spec, each with a
+// fresh GUID and, if a name is set, a "-1", "-2", ... suffix. It keeps going
+// past individual failures and returns an error if any create failed.
+func CreateCopies(specJSON string, opts CreateOptions, count int) error {
+	failed := 0
+	for i := 1; i <= count; i++ {
+		o := opts
+		if opts.Name != "" {
+			o.Name = fmt.Sprintf("%s-%d", opts.Name, i)
+		}
+		if err := CreateAndStartVM(specJSON, o); err != nil {
+			fmt.Fprintf(os.Stderr, "Error (%d/%d): %v\n", i, count, err)
+			failed++
+		}
 	}
-	pretty, err := json.MarshalIndent(raw, "", "  ")
-	if err != nil {
-		fmt.Println(propsJSON)
-		return nil
+
+	fmt.Fprintf(os.Stderr, "Summary: %d succeeded, %d failed.\n", count-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d VM(s) failed to create", failed, count)
 	}
-	fmt.Println(string(pretty))
 	return nil
 }
 
-// allPropertyTypes lists every known HCS PropertyType for maximum extraction.
-var allPropertyTypes = []string{
-	"Memory",
-	"GuestMemory",
-	"Statistics",
-	"ProcessList",
-	"TerminateOnLastHandleClosed",
-	"SharedMemoryRegion",
-	"GuestConnection",
-	"ICHeartbeatStatus",
-	"ProcessorTopology",
-	"CpuGroup",
-	"SystemGUID",
-}
-
-// DumpVM queries a compute system with all known property types and outputs
-// the combined result as pretty JSON. If the all-at-once query fails, it
-// falls back to querying each property type individually and merging results.
-func DumpVM(id string) error {
-	sys, err := openComputeSystem(id)
+// CreateFromSpecDir creates one VM per *.json spec in dir, named after the
+// file, with up to parallel creates in flight. Each spec's relative disk paths
+// resolve against its own directory. Failures are reported and skipped; IDs
+// of created VMs go to stdout one per line.
+func CreateFromSpecDir(dir string, opts CreateOptions, parallel int, env envExpansion) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
 	if err != nil {
 		return err
 	}
-	defer closeComputeSystem(sys)
+	if len(files) == 0 {
+		return fmt.Errorf("no *.json spec files in %s", dir)
+	}
 
-	// Try querying all property types at once
-	queryJSON := buildPropertyQuery(allPropertyTypes)
-	result, err := getComputeSystemPropertiesQuery(sys, queryJSON)
-	if err == nil && result != "" {
-		prettyPrint(result)
-		return nil
+	var (
+		mu     sync.Mutex
+		failed int
+		wg     sync.WaitGroup
+		slots  = make(chan struct{}, parallel)
+	)
+	for _, file := range files {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(file string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			o := opts
+			o.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+			o.BaseDir = filepath.Dir(file)
+
+			specJSON, err := readSpecFile(file, env)
+			if err == nil {
+				err = CreateAndStartVM(specJSON, o)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error (%s): %v\n", filepath.Base(file), err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}(file)
 	}
+	wg.Wait()
 
-	// Fallback: query each type individually and merge
-	fmt.Fprintf(os.Stderr, "Bulk query failed (%v), querying properties individually...\n", err)
+	fmt.Fprintf(os.Stderr, "Summary: %d succeeded, %d failed.\n", len(files)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d VM(s) failed to create", failed, len(files))
+	}
+	return nil
+}
 
-	merged := make(map[string]json.RawMessage)
+// listEnumEntries enumerates all HCS compute systems and parses the result.
+func listEnumEntries() ([]EnumEntry, error) {
+	return queryEnumEntries("")
+}
 
-	// First get the base properties (NULL query)
-	baseJSON, err := getComputeSystemProperties(sys)
+// queryEnumEntries enumerates the compute systems matching a SystemQuery
+// document ("" for all) and parses the result.
+func queryEnumEntries(queryJSON string) ([]EnumEntry, error) {
+	resultJSON, err := enumerateComputeSystems(queryJSON)
 	if err != nil {
-		return fmt.Errorf("base property query failed: %w", err)
-	}
-	if err := json.Unmarshal([]byte(baseJSON), &merged); err != nil {
-		return fmt.Errorf("failed to parse base properties: %w", err)
+		return nil, err
 	}
+	return parseEnumResult(resultJSON)
+}
 
-	// Then query each property type individually
-	for _, pt := range allPropertyTypes {
-		queryJSON := buildPropertyQuery([]string{pt})
-		result, err := getComputeSystemPropertiesQuery(sys, queryJSON)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "  %-30s  skipped (%v)\n", pt, err)
-			continue
-		}
-		// Merge the result fields into our combined map
-		var partial map[string]json.RawMessage
-		if err := json.Unmarshal([]byte(result), &partial); err != nil {
-			fmt.Fprintf(os.Stderr, "  %-30s  skipped (bad JSON)\n", pt)
-			continue
-		}
-		for k, v := range partial {
-			merged[k] = v
-		}
-		fmt.Fprintf(os.Stderr, "  %-30s  ok\n", pt)
-	}
+// systemTypes are the HCS SystemType values list --type accepts.
+var systemTypes = []string{"VirtualMachine", "Container"}
 
-	// Pretty-print the merged result
-	out, err := json.MarshalIndent(merged, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to serialize merged properties: %w", err)
+// canonicalSystemType returns the canonical spelling of a system type, or
+// an error for an unknown one.
+func canonicalSystemType(t string) (string, error) {
+	for _, known := range systemTypes {
+		if strings.EqualFold(t, known) {
+			return known, nil
+		}
 	}
-	fmt.Println(string(out))
-	return nil
+	return "", fmt.Errorf("invalid system type %q (expected %s)", t, strings.Join(systemTypes, " or "))
 }
 
-// buildPropertyQuery constructs a PropertyQuery JSON document.
-func buildPropertyQuery(types []string) string {
+// systemTypeQuery builds the SystemQuery document selecting one system type.
+func systemTypeQuery(systemType string) string {
 	q := struct {
-		PropertyTypes []string `json:"PropertyTypes"`
-	}{PropertyTypes: types}
+		Types []string `json:"Types"`
+	}{Types: []string{systemType}}
 	data, _ := json.Marshal(q)
 	return string(data)
 }
 
-// prettyPrint outputs a JSON string with indentation.
-func prettyPrint(jsonStr string) {
-	var raw json.RawMessage
-	if err := json.Unmarshal([]byte(jsonStr), &raw); err != nil {
-		fmt.Println(jsonStr)
-		return
-	}
-	pretty, err := json.MarshalIndent(raw, "", "  ")
-	if err != nil {
-		fmt.Println(jsonStr)
-		return
+// filterEntriesByType keeps the entries of the given system type. Hosts
+// that ignore the Types query still return everything, so list filters the
+// result itself as well.
+func filterEntriesByType(entries []EnumEntry, systemType string) []EnumEntry {
+	kept := entries[:0]
+	for _, e := range entries {
+		if strings.EqualFold(e.SystemType, systemType) {
+			kept = append(kept, e)
+		}
 	}
-	fmt.Println(string(pretty))
+	return kept
 }
 
-// StopVM performs a graceful shutdown of a compute system.
-func StopVM(id string, timeoutMs uint32) error {
-	sys, err := openComputeSystem(id)
-	if err != nil {
-		return err
-	}
-	defer closeComputeSystem(sys)
-
-	op, err := createOperation()
-	if err != nil {
-		return err
+// enumWrapperKeys are the fields some HCS versions wrap the enumeration
+// array in instead of returning it bare.
+var enumWrapperKeys = []string{"ComputeSystems", "Systems", "Value"}
+
+// parseEnumResult parses an enumeration result document. Besides the usual
+// bare array it accepts an empty document or null (no systems), an object
+// wrapping the array in one of enumWrapperKeys, and a lone entry object.
+func parseEnumResult(resultJSON string) ([]EnumEntry, error) {
+	trimmed := strings.TrimSpace(resultJSON)
+	if trimmed == "" || trimmed == "null" {
+		return nil, nil
 	}
-	defer closeOperation(op)
 
-	if err := shutdownComputeSystem(sys, op); err != nil {
-		return err
+	var entries []EnumEntry
+	arrErr := json.Unmarshal([]byte(trimmed), &entries)
+	if arrErr == nil {
+		return entries, nil
 	}
 
-	_, err = waitForResult(op, timeoutMs)
-	return err
+	var wrapper map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(trimmed), &wrapper); err == nil {
+		for key, raw := range wrapper {
+			for _, known := range enumWrapperKeys {
+				if !strings.EqualFold(key, known) {
+					continue
+				}
+				if s := strings.TrimSpace(string(raw)); s == "null" {
+					return nil, nil
+				}
+				if err := json.Unmarshal(raw, &entries); err != nil {
+					return nil, fmt.Errorf("failed to parse enumeration result field %s: %w\n  raw: %s", key, err, resultJSON)
+				}
+				return entries, nil
+			}
+		}
+		if _, ok := wrapper["Id"]; ok {
+			var entry EnumEntry
+			if err := json.Unmarshal([]byte(trimmed), &entry); err == nil {
+				return []EnumEntry{entry}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("failed to parse enumeration result: %w\n  raw: %s", arrErr, resultJSON)
+}
+
+// findEnumEntry returns the enumeration entry for the system with the given ID.
+func findEnumEntry(id string) (*EnumEntry, error) {
+	entries, err := listEnumEntries()
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if strings.EqualFold(entries[i].Id, id) {
+			return &entries[i], nil
+		}
+	}
+	return nil, &HcsError{Op: "find " + id, HR: hcsESystemNotFound}
+}
+
+// guidRe matches a bare (brace-less) GUID string.
+var guidRe = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// bareGUID formats g the way HCS expects compute system IDs. GUID.String()
+// returns "{...}"; exactly one leading and one trailing brace are removed and
+// the result is checked against guidRe.
+func bareGUID(g windows.GUID) (string, error) {
+	s := strings.TrimSuffix(strings.TrimPrefix(g.String(), "{"), "}")
+	if !guidRe.MatchString(s) {
+		return "", fmt.Errorf("unexpected GUID format %q", g.String())
+	}
+	return s, nil
+}
+
+// enumCache holds one enumeration for the ID and name resolvers, so a
+// command resolving several systems (diff a b) enumerates once. It is safe
+// for concurrent use; concurrent first callers share a single enumeration.
+// Failed enumerations are not cached.
+type enumCache struct {
+	mu      sync.Mutex
+	entries []EnumEntry
+	valid   bool
+}
+
+// get returns the cached enumeration, enumerating on first use. A nil cache
+// always enumerates afresh.
+func (c *enumCache) get() ([]EnumEntry, error) {
+	if c == nil {
+		return listEnumEntries()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.valid {
+		return c.entries, nil
+	}
+	entries, err := listEnumEntries()
+	if err != nil {
+		return nil, err
+	}
+	c.entries, c.valid = entries, true
+	return entries, nil
+}
+
+// resolverCache is the enumeration cache of the running command, or nil
+// outside a command scope. It never outlives one invocation.
+var resolverCache *enumCache
+
+// scopeResolverCache starts a fresh resolver cache and returns the func that
+// discards it. main wraps each command run in one.
+func scopeResolverCache() (end func()) {
+	resolverCache = &enumCache{}
+	return func() { resolverCache = nil }
+}
+
+// resolveVMID expands a unique ID prefix to the full compute system ID. A
+// complete GUID is returned as is without enumerating. Zero or multiple
+// matches are errors listing the candidates.
+func resolveVMID(prefix string) (string, error) {
+	if guidRe.MatchString(prefix) {
+		return prefix, nil
+	}
+	if prefix == "" {
+		return "", fmt.Errorf("empty VM ID")
+	}
+
+	entries, err := resolverCache.get()
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, e := range entries {
+		if strings.HasPrefix(strings.ToLower(e.Id), strings.ToLower(prefix)) {
+			matches = append(matches, e.Id)
+		}
+	}
+
+	switch len(matches) {
+	case 1:
+		return matches[0], nil
+	case 0:
+		return "", fmt.Errorf("no compute system ID starts with %q", prefix)
+	default:
+		return "", fmt.Errorf("ID prefix %q is ambiguous, candidates:\n  %s", prefix, strings.Join(matches, "\n  "))
+	}
+}
+
+// resolveVMName finds the compute system whose Name matches name
+// (case-insensitive). An ambiguous name is an error listing the matching IDs.
+func resolveVMName(name string) (string, error) {
+	entries, err := resolverCache.get()
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, e := range entries {
+		if stringSliceContains([]string{e.Name}, name) {
+			matches = append(matches, e.Id)
+		}
+	}
+
+	switch len(matches) {
+	case 1:
+		return matches[0], nil
+	case 0:
+		return "", fmt.Errorf("no compute system named %q", name)
+	default:
+		return "", fmt.Errorf("name %q is ambiguous, matching IDs:\n  %s", name, strings.Join(matches, "\n  "))
+	}
+}
+
+// ListOptions controls how ListVMs renders the enumeration.
+type ListOptions struct {
+	Format string // Go text/template applied to each EnumEntry ("" = table)
+	Quiet  bool   // Print only IDs, one per line
+	Wide   bool   // Table with OS, memory and uptime columns
+	Sort   string // Sort key: name (default), state, owner or id
+	Type   string // Only list systems of this SystemType ("" = all)
+}
+
+// filtered reports whether any option narrows which systems are listed.
+func (o ListOptions) filtered() bool {
+	return o.Type != ""
+}
+
+// emptyListMessage is what list prints when no system is left to show,
+// telling an empty host apart from filters that matched nothing.
+func emptyListMessage(opts ListOptions) string {
+	if opts.filtered() {
+		return "No compute systems match the given filters."
+	}
+	return "No compute systems found."
+}
+
+// enumSortKeys maps list --sort values to the EnumEntry field they sort by.
+var enumSortKeys = map[string]func(EnumEntry) string{
+	"name":  func(e EnumEntry) string { return e.Name },
+	"state": func(e EnumEntry) string { return e.State },
+	"owner": func(e EnumEntry) string { return e.Owner },
+	"id":    func(e EnumEntry) string { return e.Id },
+}
+
+// sortEntries stably sorts entries by key (case-insensitive), breaking ties
+// by ID. An empty key sorts by name.
+func sortEntries(entries []EnumEntry, key string) error {
+	if key == "" {
+		key = "name"
+	}
+	field, ok := enumSortKeys[strings.ToLower(key)]
+	if !ok {
+		return fmt.Errorf("invalid --sort %q (expected name, state, owner or id)", key)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := strings.ToLower(field(entries[i])), strings.ToLower(field(entries[j]))
+		if a != b {
+			return a < b
+		}
+		return strings.ToLower(entries[i].Id) < strings.ToLower(entries[j].Id)
+	})
+	return nil
+}
+
+// ListVMs enumerates all HCS compute systems and prints them as a table,
+// renders each entry with opts.Format, or prints bare IDs with opts.Quiet.
+func ListVMs(opts ListOptions) error {
+	var tmpl *template.Template
+	if opts.Format != "" {
+		var err error
+		if tmpl, err = parseFormat(opts.Format); err != nil {
+			return err
+		}
+	}
+
+	var entries []EnumEntry
+	var err error
+	if opts.Type != "" {
+		entries, err = queryEnumEntries(systemTypeQuery(opts.Type))
+		if err != nil {
+			verbosef("enumeration by type failed, filtering a full enumeration: %v", err)
+			entries, err = listEnumEntries()
+		}
+		entries = filterEntriesByType(entries, opts.Type)
+	} else {
+		entries, err = listEnumEntries()
+	}
+	if err != nil {
+		return err
+	}
+	if err := sortEntries(entries, opts.Sort); err != nil {
+		return err
+	}
+
+	if tmpl != nil {
+		for _, e := range entries {
+			if err := executeFormat(tmpl, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if opts.Quiet {
+		for _, e := range entries {
+			fmt.Println(e.Id)
+		}
+		return nil
+	}
+
+	if len(entries) == 0 {
+		fmt.Println(emptyListMessage(opts))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if opts.Wide {
+		fmt.Fprintln(w, "ID\tTYPE\tSTATE\tOWNER\tNAME\tOS\tMEMORY\tUPTIME")
+	} else {
+		fmt.Fprintln(w, "ID\tTYPE\tSTATE\tOWNER\tNAME")
+	}
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s", e.Id, e.SystemType, e.State, orDash(e.Owner), orDash(e.Name))
+		if opts.Wide {
+			mem, uptime := wideStats(e.Statistics)
+			fmt.Fprintf(w, "\t%s\t%s\t%s", orDash(e.RuntimeOsType), mem, uptime)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+	return nil
+}
+
+// orDash returns s, or "-" for an empty table cell.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// wideStats renders the MEMORY (private working set) and UPTIME cells of
+// list --format wide. They are best-effort: most hosts leave Statistics out
+// of the enumeration document, and list doesn't query each system for it,
+// so both show "-" then.
+func wideStats(st *SystemStatistics) (mem, uptime string) {
+	if st == nil {
+		return "-", "-"
+	}
+	mem, uptime = "-", "-"
+	if b := st.Memory.MemoryUsagePrivateWorkingSetBytes; b > 0 {
+		mem = formatMB(b)
+	}
+	if st.Uptime100ns > 0 {
+		uptime = (time.Duration(st.Uptime100ns) * 100).Truncate(time.Second).String()
+	}
+	return mem, uptime
+}
+
+// parseFormat parses a user-supplied --format template.
+func parseFormat(format string) (*template.Template, error) {
+	tmpl, err := template.New("format").Funcs(templateFuncs).Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --format template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// executeFormat renders data with a --format template followed by a newline.
+func executeFormat(tmpl *template.Template, data interface{}) error {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("executing --format template: %w", err)
+	}
+	fmt.Println(buf.String())
+	return nil
+}
+
+// InspectVM opens a compute system and prints its properties as pretty JSON,
+// or renders them with a --format template when format is set.
+func InspectVM(id, format string) error {
+	var tmpl *template.Template
+	if format != "" {
+		var err error
+		if tmpl, err = parseFormat(format); err != nil {
+			return err
+		}
+	}
+
+	sys, err := openComputeSystem(id, accessRead)
+	if err != nil {
+		return err
+	}
+	defer closeComputeSystem(sys)
+
+	propsJSON, err := getComputeSystemProperties(sys)
+	if err != nil {
+		return err
+	}
+
+	var props map[string]interface{}
+	if err := json.Unmarshal([]byte(propsJSON), &props); err != nil {
+		if tmpl != nil {
+			return fmt.Errorf("failed to parse properties: %w", err)
+		}
+		// If it's not valid JSON, just print it raw
+		fmt.Println(propsJSON)
+		return nil
+	}
+
+	// Guest details are best-effort: systems without integration services
+	// reject the query, and inspect still shows the basic properties.
+	guestJSON, err := getComputeSystemPropertiesQuery(sys, buildPropertyQuery(guestPropertyTypes))
+	if err != nil {
+		verbosef("guest properties unavailable: %v", err)
+	} else {
+		var guestProps map[string]interface{}
+		if json.Unmarshal([]byte(guestJSON), &guestProps) == nil {
+			for k, v := range guestProps {
+				if _, ok := props[k]; !ok {
+					props[k] = v
+				}
+			}
+		}
+	}
+	if guest := extractGuestInfo(props); guest != nil {
+		props["Guest"] = guest
+	}
+
+	saved := configuredSpec(id)
+	if mem := inspectMemory(specMemory(saved), liveMemory(sys)); mem != nil {
+		props["DynamicMemory"] = mem
+	}
+	if disks := inspectDisks(saved); len(disks) > 0 {
+		props["Disks"] = disks
+		for _, d := range disks {
+			if d.Missing {
+				fmt.Fprintf(os.Stderr, "Warning: %s slot %s: backing file %s is missing\n", d.Controller, d.Slot, d.Path)
+			}
+		}
+	}
+
+	if tmpl != nil {
+		return executeFormat(tmpl, props)
+	}
+
+	pretty, err := json.MarshalIndent(props, "", "  ")
+	if err != nil {
+		fmt.Println(propsJSON)
+		return nil
+	}
+	fmt.Println(string(pretty))
+	return nil
+}
+
+// DiskInfo describes one SCSI attachment for inspect: where it sits, what
+// backs it and how large the backing file currently is on the host. HCS does
+// not report attachments, so inspect lists those of the spec saved at create,
+// as attach-disk and swap-iso have updated it; changes made by other tools
+// are not reflected.
+type DiskInfo struct {
+	Controller string `json:"Controller"`
+	Slot       string `json:"Slot"`
+	Type       string `json:"Type"`
+	Path       string `json:"Path"`
+	SizeBytes  int64  `json:"SizeBytes,omitempty"`
+	Missing    bool   `json:"Missing,omitempty"`
+	Error      string `json:"Error,omitempty"`
+}
+
+// configuredSpec returns the spec saved when hcstool created system id, or
+// nil when it has none (logged with --verbose).
+func configuredSpec(id string) *ComputeSystemSpec {
+	spec, err := loadSavedSpec(id)
+	if err != nil {
+		verbosef("configuration unavailable: %v", err)
+		return nil
+	}
+	return spec
+}
+
+// inspectDisks lists the spec's SCSI attachments sorted by controller and
+// slot, stat-ing each host file for its current size. A backing file that no
+// longer exists is flagged Missing; pass-through disks are listed without a
+// size. A nil spec has no disks.
+func inspectDisks(spec *ComputeSystemSpec) []DiskInfo {
+	if spec == nil || spec.VirtualMachine == nil || spec.VirtualMachine.Devices == nil {
+		return nil
+	}
+	var disks []DiskInfo
+	for name, ctrl := range spec.VirtualMachine.Devices.Scsi {
+		if ctrl == nil {
+			continue
+		}
+		for slot, att := range ctrl.Attachments {
+			if att == nil {
+				continue
+			}
+			d := DiskInfo{Controller: name, Slot: slot, Type: att.Type, Path: att.Path}
+			if att.hostFile() {
+				fi, err := os.Stat(att.Path)
+				switch {
+				case os.IsNotExist(err):
+					d.Missing = true
+				case err != nil:
+					d.Error = err.Error()
+				default:
+					d.SizeBytes = fi.Size()
+				}
+			}
+			disks = append(disks, d)
+		}
+	}
+	sort.Slice(disks, func(i, j int) bool {
+		if disks[i].Controller != disks[j].Controller {
+			return disks[i].Controller < disks[j].Controller
+		}
+		si, _ := strconv.Atoi(disks[i].Slot)
+		sj, _ := strconv.Atoi(disks[j].Slot)
+		return si < sj
+	})
+	return disks
+}
+
+// allPropertyTypes lists every known HCS PropertyType for maximum extraction.
+var allPropertyTypes = []string{
+	"Memory",
+	"GuestMemory",
+	"Statistics",
+	"ProcessList",
+	"TerminateOnLastHandleClosed",
+	"SharedMemoryRegion",
+	"GuestConnection",
+	"ICHeartbeatStatus",
+	"ProcessorTopology",
+	"CpuGroup",
+	"SystemGUID",
+}
+
+// propertyBundles maps dump --properties names to the property types they
+// request. "basic" requests none: the base document HCS always returns
+// (state, owner, runtime IDs) is included with every bundle.
+var propertyBundles = map[string][]string{
+	"basic":   {},
+	"stats":   {"Statistics"},
+	"memory":  {"Memory", "GuestMemory", "SharedMemoryRegion"},
+	"devices": {"ProcessorTopology", "CpuGroup", "SystemGUID"},
+	"guest":   {"GuestConnection", "ICHeartbeatStatus", "ProcessList"},
+	"all":     allPropertyTypes,
+}
+
+// defaultDumpBundles is what dump reports without --properties: enough to
+// see what a system is doing without the full property firehose.
+var defaultDumpBundles = []string{"basic", "stats", "memory"}
+
+// resolvePropertyBundles expands bundle names into the property types to
+// query, in bundle order with duplicates removed.
+func resolvePropertyBundles(names []string) ([]string, error) {
+	types := []string{}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		bundle, ok := propertyBundles[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown property bundle %q (expected basic, stats, memory, devices, guest or all)", name)
+		}
+		for _, t := range bundle {
+			if !seen[t] {
+				seen[t] = true
+				types = append(types, t)
+			}
+		}
+	}
+	return types, nil
+}
+
+// DumpVM queries a compute system with the property types of the named
+// bundles (defaultDumpBundles when none are given), or with query when it is
+// set, and writes the result as pretty JSON to outPath, or stdout if outPath
+// is "" or "-". Parent directories of outPath are created as needed.
+func DumpVM(id, outPath, query string, bundles []string) error {
+	var out string
+	var err error
+	if query != "" {
+		out, err = queryProperties(id, query)
+	} else {
+		if len(bundles) == 0 {
+			bundles = defaultDumpBundles
+		}
+		var types []string
+		if types, err = resolvePropertyBundles(bundles); err != nil {
+			return err
+		}
+		out, err = collectProperties(id, types)
+	}
+	if err != nil {
+		return err
+	}
+
+	if outPath == "" || outPath == "-" {
+		fmt.Println(out)
+		return nil
+	}
+	if dir := filepath.Dir(outPath); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("creating output directory: %w", err)
+		}
+	}
+	if err := os.WriteFile(outPath, []byte(out+"\n"), 0o644); err != nil {
+		return fmt.Errorf("writing properties: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, outPath)
+	return nil
 }
 
-// KillVM forcibly terminates a compute system.
-func KillVM(id string) error {
-	sys, err := openComputeSystem(id)
+// queryProperties passes a raw property query document straight to HCS, so
+// property types hcstool has no name for can still be read. The query must
+// be a JSON object.
+func queryProperties(id, query string) (string, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(query), &doc); err != nil {
+		return "", fmt.Errorf("invalid --query JSON: %w", err)
+	}
+
+	result, err := hcs.Properties(id, query)
+	if err != nil {
+		return "", err
+	}
+	return prettyJSON(result), nil
+}
+
+// collectProperties returns the given property types of a compute system as
+// pretty JSON; with no types only the base properties are returned. If the
+// all-at-once query fails, it falls back to querying each property type
+// individually and merging results.
+func collectProperties(id string, types []string) (string, error) {
+	sys, err := openComputeSystem(id, accessRead)
+	if err != nil {
+		return "", err
+	}
+	defer closeComputeSystem(sys)
+
+	if len(types) == 0 {
+		result, err := getComputeSystemProperties(sys)
+		if err != nil {
+			return "", err
+		}
+		return prettyJSON(result), nil
+	}
+
+	// Try querying all property types at once
+	queryJSON := buildPropertyQuery(types)
+	result, err := getComputeSystemPropertiesQuery(sys, queryJSON)
+	if err == nil && result != "" {
+		return prettyJSON(result), nil
+	}
+
+	// Fallback: query each type individually and merge
+	fmt.Fprintf(os.Stderr, "Bulk query failed (%v), querying properties individually...\n", err)
+
+	merged := make(map[string]json.RawMessage)
+
+	// First get the base properties (NULL query)
+	baseJSON, err := getComputeSystemProperties(sys)
+	if err != nil {
+		return "", fmt.Errorf("base property query failed: %w", err)
+	}
+	if err := json.Unmarshal([]byte(baseJSON), &merged); err != nil {
+		return "", fmt.Errorf("failed to parse base properties: %w", err)
+	}
+
+	// Then query each property type individually
+	for _, pt := range types {
+		queryJSON := buildPropertyQuery([]string{pt})
+		result, err := getComputeSystemPropertiesQuery(sys, queryJSON)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "  %-30s  skipped (%v)\n", pt, err)
+			continue
+		}
+		// Merge the result fields into our combined map
+		var partial map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(result), &partial); err != nil {
+			fmt.Fprintf(os.Stderr, "  %-30s  skipped (bad JSON)\n", pt)
+			continue
+		}
+		for k, v := range partial {
+			merged[k] = v
+		}
+		fmt.Fprintf(os.Stderr, "  %-30s  ok\n", pt)
+	}
+
+	// Pretty-print the merged result
+	out, err := json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize merged properties: %w", err)
+	}
+	return string(out), nil
+}
+
+// buildPropertyQuery constructs a PropertyQuery JSON document.
+func buildPropertyQuery(types []string) string {
+	q := struct {
+		PropertyTypes []string `json:"PropertyTypes"`
+	}{PropertyTypes: types}
+	data, _ := json.Marshal(q)
+	return string(data)
+}
+
+// prettyPrint outputs a JSON string with indentation.
+func prettyPrint(jsonStr string) {
+	fmt.Println(prettyJSON(jsonStr))
+}
+
+// prettyJSON indents a JSON string, returning it unchanged if it isn't JSON.
+func prettyJSON(jsonStr string) string {
+	var raw json.RawMessage
+	if err := json.Unmarshal([]byte(jsonStr), &raw); err != nil {
+		return jsonStr
+	}
+	pretty, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return jsonStr
+	}
+	return string(pretty)
+}
+
+// StopVM performs a graceful shutdown of a compute system. A nil opts keeps
+// the HCS default (clean power-off); otherwise the options document is sent.
+func StopVM(id string, timeoutMs uint32, opts *ShutdownOptions) error {
+	defer timed("stop phase")()
+
+	var optionsJSON string
+	if opts != nil {
+		data, err := json.Marshal(opts)
+		if err != nil {
+			return fmt.Errorf("failed to serialize shutdown options: %w", err)
+		}
+		optionsJSON = string(data)
+	}
+	return hcs.Shutdown(id, optionsJSON, timeoutMs)
+}
+
+// KillVM forcibly terminates a compute system and forgets its saved spec.
+func KillVM(id string) error {
+	defer timed("kill phase")()
+	if err := hcs.Terminate(id, 10000); err != nil {
+		return err
+	}
+	removeSavedSpec(id)
+	return nil
+}
+
+// describeSystem opens a compute system to confirm it exists and is
+// accessible, and returns a phrase such as `running system <id> ("web")` for
+// dry-run previews of operations on it.
+func describeSystem(id string) (string, error) {
+	sys, err := openComputeSystem(id, accessRead)
+	if err != nil {
+		return "", err
+	}
+	closeComputeSystem(sys)
+
+	entry, err := findEnumEntry(id)
+	if err != nil {
+		return "", err
+	}
+	return describeEntry(*entry), nil
+}
+
+// CrashVM forces a guest crash (bugcheck) so the guest writes a crash dump
+// for kernel debugging, and waits for HCS to deliver it. What gets written
+// is up to the guest: it must have crash dumps enabled (Startup and Recovery
+// settings, or CrashControl\CrashDumpEnabled in the registry) and enough
+// page file for the dump type. The VM is left crashed or rebooting per the
+// guest's recovery settings.
+func CrashVM(id string) error {
+	defer timed("crash phase")()
+
+	sys, err := openComputeSystem(id, accessAll)
+	if err != nil {
+		return err
+	}
+	defer closeComputeSystem(sys)
+
+	op, err := createOperation()
+	if err != nil {
+		return err
+	}
+	defer closeOperation(op)
+
+	if err := crashComputeSystem(sys, op); err != nil {
+		return err
+	}
+	resultJSON, err := waitForResult(op, infinite)
+	return withResult(err, resultJSON)
+}
+
+// ExportVM reads the saved configuration of an existing compute system and writes it
+// as a spec that can be fed back to `create --spec`. Runtime-only fields are
+// dropped by round-tripping through ComputeSystemSpec, and generated network
+// endpoint IDs are cleared since they are host-specific. With relative set,
+// disk paths are rewritten relative to the output file's directory.
+func ExportVM(id, outPath string, relative bool) error {
+	spec, err := readSystemSpec(id)
+	if err != nil {
+		return err
+	}
+
+	if relative {
+		baseDir := "."
+		if outPath != "-" {
+			baseDir = filepath.Dir(outPath)
+		}
+		if err := makePathsRelative(spec, baseDir); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize spec: %w", err)
+	}
+
+	if outPath == "-" {
+		fmt.Println(string(data))
+		return nil
+	}
+	if err := os.WriteFile(outPath, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing spec file: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %s to %s\n", id, outPath)
+	return nil
+}
+
+// readSystemSpec returns the spec an existing compute system was created
+// from (see saveSpec), with volatile per-host fields stripped so it can be
+// used to create another VM. Changes made after create, such as hot-added
+// devices, are not included.
+func readSystemSpec(id string) (*ComputeSystemSpec, error) {
+	sys, err := openComputeSystem(id, accessRead)
+	if err != nil {
+		return nil, err
+	}
+	closeComputeSystem(sys)
+
+	spec, err := loadSavedSpec(id)
+	if err != nil {
+		return nil, fmt.Errorf("cannot export or clone %s: %w", id, err)
+	}
+	if spec.VirtualMachine == nil {
+		return nil, fmt.Errorf("compute system %s is not a VM; it cannot be exported or cloned", id)
+	}
+
+	stripVolatileFields(spec)
+	return spec, nil
+}
+
+// stripVolatileFields clears values that are generated per host or per run
+// and would make an exported spec fail or collide when re-imported.
+func stripVolatileFields(spec *ComputeSystemSpec) {
+	if spec.VirtualMachine == nil || spec.VirtualMachine.Devices == nil {
+		return
+	}
+	for _, nic := range spec.VirtualMachine.Devices.NetworkAdapters {
+		if nic != nil {
+			nic.EndpointId = ""
+		}
+	}
+}
+
+// makePathsRelative rewrites absolute disk paths relative to baseDir. Paths
+// that cannot be expressed relatively (e.g. on another drive) are kept as is.
+func makePathsRelative(spec *ComputeSystemSpec, baseDir string) error {
+	if spec.VirtualMachine == nil || spec.VirtualMachine.Devices == nil {
+		return nil
+	}
+	absBase, err := filepath.Abs(baseDir)
+	if err != nil {
+		return fmt.Errorf("cannot resolve path %q: %w", baseDir, err)
+	}
+	for _, ctrl := range spec.VirtualMachine.Devices.Scsi {
+		if ctrl == nil {
+			continue
+		}
+		for _, att := range ctrl.Attachments {
+			if !att.hostFile() || !filepath.IsAbs(att.Path) {
+				continue
+			}
+			if rel, err := filepath.Rel(absBase, att.Path); err == nil {
+				att.Path = rel
+			}
+		}
+	}
+	return nil
+}
+
+// rebindDiskPaths points every SCSI attachment at diskDir, keeping each
+// disk's base name. All rebound paths are checked and every missing one is
+// reported together so the user can fix them in one pass.
+func rebindDiskPaths(spec *ComputeSystemSpec, diskDir string) error {
+	if spec.VirtualMachine == nil || spec.VirtualMachine.Devices == nil {
+		return nil
+	}
+	var missing []string
+	for _, ctrl := range spec.VirtualMachine.Devices.Scsi {
+		if ctrl == nil {
+			continue
+		}
+		for _, att := range ctrl.Attachments {
+			if !att.hostFile() {
+				continue
+			}
+			att.Path = filepath.Join(diskDir, filepath.Base(att.Path))
+			if _, err := os.Stat(att.Path); err != nil {
+				missing = append(missing, att.Path)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("rebound disk(s) not found:\n  %s", strings.Join(missing, "\n  "))
+	}
+	return nil
+}
+
+// rebindSpec loads a spec file and rebinds its disk paths to diskDir,
+// returning the resulting spec JSON.
+func rebindSpec(specFile, diskDir string) (string, error) {
+	specJSON, err := readSpecFile(specFile, envExpansion{})
+	if err != nil {
+		return "", err
+	}
+	var spec ComputeSystemSpec
+	if err := json.Unmarshal([]byte(specJSON), &spec); err != nil {
+		return "", fmt.Errorf("invalid JSON spec: %w", err)
+	}
+	if err := rebindDiskPaths(&spec, diskDir); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(&spec, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize spec: %w", err)
+	}
+	return string(data), nil
+}
+
+// ConsoleVM launches vmconnect.exe against a compute system so its video
+// console can be used without looking the VM up in Hyper-V Manager.
+func ConsoleVM(id string) error {
+	entry, err := findEnumEntry(id)
+	if err != nil {
+		return err
+	}
+
+	vmconnect, err := exec.LookPath("vmconnect.exe")
 	if err != nil {
-		return err
+		vmconnect = filepath.Join(os.Getenv("SystemRoot"), "System32", "vmconnect.exe")
+		if _, statErr := os.Stat(vmconnect); statErr != nil {
+			return fmt.Errorf("vmconnect.exe not found — install the Hyper-V management tools")
+		}
 	}
-	defer closeComputeSystem(sys)
 
-	op, err := createOperation()
+	if entry.Name != "" {
+		fmt.Fprintf(os.Stderr, "Connecting to %q (ID: %s)...\n", entry.Name, entry.Id)
+	} else {
+		fmt.Fprintf(os.Stderr, "Connecting to %s...\n", entry.Id)
+	}
+
+	cmd := exec.Command(vmconnect, "localhost", "-G", entry.Id)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("launching vmconnect: %w", err)
+	}
+	return cmd.Process.Release()
+}
+
+// SetServiceSettings validates and applies a global HCS service settings
+// document, printing any result document HCS returns.
+func SetServiceSettings(settingsJSON string) error {
+	var raw json.RawMessage
+	if err := json.Unmarshal([]byte(settingsJSON), &raw); err != nil {
+		return fmt.Errorf("settings are not valid JSON: %w", err)
+	}
+
+	traceHCSDocument("HcsModifyServiceSettings", "service", settingsJSON)
+	resultJSON, err := modifyServiceSettings(settingsJSON)
 	if err != nil {
 		return err
 	}
-	defer closeOperation(op)
+	if resultJSON != "" {
+		prettyPrint(resultJSON)
+	}
+	return nil
+}
 
-	if err := terminateComputeSystem(sys, op); err != nil {
-		return err
+// SetVMAccess grants a VM access to each host path, or revokes it when
+// revoke is set, so ACLs can be repaired on an existing VM or prepared
+// before a manual create. Relative paths are resolved against the working
+// directory. Every path is attempted; the failures are returned together.
+func SetVMAccess(id string, paths []string, revoke bool) error {
+	apply, verb := grantVmAccess, "Granted"
+	if revoke {
+		apply, verb = revokeVmAccess, "Revoked"
 	}
 
-	_, err = waitForResult(op, 10000)
-	return err
+	var errs []error
+	for _, p := range paths {
+		absPath, err := filepath.Abs(p)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot resolve %s: %w", p, err))
+			continue
+		}
+		if err := apply(id, absPath); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s %s access to %s\n", verb, id, absPath)
+	}
+	return errors.Join(errs...)
 }
 
 // --- Spec builder for quick-create mode ---
 
-func buildMinimalSpec(vhdxPath string, memoryMB, cpuCount int, gpuDevices []GpuDevice) (string, error) {
-	absPath, err := filepath.Abs(vhdxPath)
+// Allowed ranges for the HCS Processor scheduling fields. Limit and
+// Reservation are expressed in thousandths of a percent of one host CPU
+// (100000 = 100%); Weight is a relative share with HCS' default at 100.
+const (
+	maxCPUWeight  = 10000
+	maxCPULimit   = 100000
+	maxCPUReserve = 100000
+)
+
+// Allowed ranges for the dynamic memory tuning fields. The buffer is the
+// share of extra memory, as a percentage of what the guest is using, that
+// the host tries to keep assigned; priority decides which VMs give memory
+// back first when the host runs short, with the highest keeping theirs.
+const (
+	minMemoryBuffer   = 5
+	maxMemoryBuffer   = 2000
+	maxMemoryPriority = 10000
+)
+
+// quickSpecOptions holds the quick-create parameters used to build a spec.
+// Zero values for the CPU scheduling fields mean "leave to HCS default".
+type quickSpecOptions struct {
+	VhdxPaths       []string // First disk is the boot disk
+	DiskType        string   // --disk-type value: virtual (default), physical or iso
+	ScsiControllers int      // Controllers to spread disks across (0 = 1)
+	Schema          string   // --schema override ("" = newest the host supports)
+	SecureBoot      bool     // Apply the Microsoft Windows secure boot template
+	TPM             bool     // Give the VM a virtual TPM
+	ISOPaths        []string // ISOs attached as DVD drives after the disks
+	BootOrder       []string // Device classes ("disk", "dvd") in boot order
+	Kernel          string   // Direct-boot this Linux kernel instead of UEFI
+	Initrd          string   // Initial ramdisk for Kernel
+	KernelCmdline   string   // Kernel command line for Kernel
+	Ballooning      bool     // Enable hot/cold memory hints so idle memory is reclaimed
+	MemoryBuffer    int      // Dynamic memory buffer percentage (0 = HCS default)
+	MemoryPriority  int      // Dynamic memory priority (0 = HCS default)
+	MemoryMB        int
+	CPUCount        int
+	CPUWeight       int
+	CPULimit        int
+	CPUReserve      int
+	Generation      int    // 2, or 0 for the default; 1 is rejected
+	ApicMode        string // --apic value: default, legacy or x2apic
+	RTC             string // --rtc value: local (default) or utc
+
+	// Access holds --read-only and --cache-mode for the --vhdx disks.
+	Access diskAccess
+}
+
+// cachingModes maps lowercased --cache-mode values to the attachment
+// CachingMode HCS expects. Cached caches writes as well as reads.
+var cachingModes = map[string]string{
+	"uncached":       "Uncached",
+	"cached":         "Cached",
+	"readonlycached": "ReadOnlyCached",
+}
+
+// diskAccess is how disks are attached, from --read-only and --cache-mode.
+type diskAccess struct {
+	ReadOnly  bool
+	CacheMode string // --cache-mode value ("" = HCS default)
+}
+
+// cachingMode validates a and returns the CachingMode it selects. A
+// read-only disk, such as a shared base image booted by several VMs, can't
+// be given write caching, and ReadOnlyCached needs --read-only.
+func (a diskAccess) cachingMode() (string, error) {
+	if a.CacheMode == "" {
+		return "", nil
+	}
+	mode, ok := cachingModes[strings.ToLower(a.CacheMode)]
+	if !ok {
+		return "", fmt.Errorf("invalid --cache-mode %q: expected uncached, cached or readonlycached", a.CacheMode)
+	}
+	switch {
+	case a.ReadOnly && mode == "Cached":
+		return "", fmt.Errorf("--cache-mode cached caches writes and can't be used with --read-only; use readonlycached")
+	case !a.ReadOnly && mode == "ReadOnlyCached":
+		return "", fmt.Errorf("--cache-mode readonlycached needs --read-only")
+	}
+	return mode, nil
+}
+
+// attachment returns an attachment of path with a's options applied.
+func (a diskAccess) attachment(attachType, path string) (*ScsiAttachment, error) {
+	mode, err := a.cachingMode()
+	if err != nil {
+		return nil, err
+	}
+	return &ScsiAttachment{Type: attachType, Path: path, CachingMode: mode, ReadOnly: a.ReadOnly}, nil
+}
+
+// scsiControllerNames are the controller keys used by quick-create, in order.
+// Hyper-V VMs support at most four SCSI controllers.
+var scsiControllerNames = []string{"Primary", "Secondary", "Tertiary", "Quaternary"}
+
+// distributeDisks builds n SCSI controllers and attaches paths round-robin as
+// attachments of the given type: disk i goes to controller i%n at slot i/n,
+// so the first disk is always Primary slot 0 (the UEFI boot device).
+func distributeDisks(paths []string, attachType string, n int) (map[string]*ScsiController, error) {
+	atts := make([]*ScsiAttachment, len(paths))
+	for i, path := range paths {
+		atts[i] = &ScsiAttachment{Type: attachType, Path: path}
+	}
+	return distributeAttachments(atts, n)
+}
+
+// distributeAttachments is distributeDisks for attachments of mixed types.
+func distributeAttachments(atts []*ScsiAttachment, n int) (map[string]*ScsiController, error) {
+	if n == 0 {
+		n = 1
+	}
+	if n < 1 || n > len(scsiControllerNames) {
+		return nil, fmt.Errorf("--scsi-controllers must be between 1 and %d", len(scsiControllerNames))
+	}
+
+	controllers := make(map[string]*ScsiController, n)
+	for _, name := range scsiControllerNames[:n] {
+		controllers[name] = &ScsiController{Attachments: map[string]*ScsiAttachment{}}
+	}
+	for i, att := range atts {
+		c := controllers[scsiControllerNames[i%n]]
+		c.Attachments[strconv.Itoa(i/n)] = att
+	}
+	return controllers, nil
+}
+
+// bootDeviceClasses are the --boot-order names and the attachments each one
+// selects.
+var bootDeviceClasses = map[string]func(*ScsiAttachment) bool{
+	"disk": func(a *ScsiAttachment) bool { return a.Type != attachIso },
+	"dvd":  func(a *ScsiAttachment) bool { return a.Type == attachIso },
+}
+
+// orderForBoot reorders attachments so the device classes in order come
+// first, in that order, keeping the relative order within each class. The
+// first attachment lands on Primary slot 0, which BootThis points at; the
+// UEFI fallback scan then follows controller and slot order, so later
+// entries are honoured too. Each class named must match an attachment.
+func orderForBoot(atts []*ScsiAttachment, order []string) ([]*ScsiAttachment, error) {
+	if len(order) == 0 {
+		return atts, nil
+	}
+	ordered := make([]*ScsiAttachment, 0, len(atts))
+	placed := make(map[*ScsiAttachment]bool, len(atts))
+	seen := map[string]bool{}
+	for _, class := range order {
+		class = strings.ToLower(class)
+		match, ok := bootDeviceClasses[class]
+		if !ok {
+			return nil, fmt.Errorf("invalid --boot-order entry %q: expected disk or dvd", class)
+		}
+		if seen[class] {
+			return nil, fmt.Errorf("--boot-order lists %q twice", class)
+		}
+		seen[class] = true
+		found := false
+		for _, a := range atts {
+			if match(a) {
+				ordered = append(ordered, a)
+				placed[a] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("--boot-order names %s, but no %s is attached", class, class)
+		}
+	}
+	for _, a := range atts {
+		if !placed[a] {
+			ordered = append(ordered, a)
+		}
+	}
+	return ordered, nil
+}
+
+type memoryTopology struct {
+	SizeInMB        int  `json:"SizeInMB"`
+	AllowOvercommit bool `json:"AllowOvercommit"`
+	// Hot and cold hints let the guest report free pages so the host can
+	// reclaim them, which is how HCS VMs balloon.
+	EnableHotHint  bool `json:"EnableHotHint,omitempty"`
+	EnableColdHint bool `json:"EnableColdHint,omitempty"`
+	// Dynamic memory tuning, only meaningful with the hints enabled.
+	MemoryBufferPercentage int `json:"MemoryBufferPercentage,omitempty"`
+	Priority               int `json:"Priority,omitempty"`
+}
+
+type processorTopology struct {
+	Count       int    `json:"Count"`
+	Limit       int    `json:"Limit,omitempty"`
+	Weight      int    `json:"Weight,omitempty"`
+	Reservation int    `json:"Reservation,omitempty"`
+	ApicMode    string `json:"ApicMode,omitempty"`
+}
+
+type computeTopology struct {
+	Memory    memoryTopology    `json:"Memory"`
+	Processor processorTopology `json:"Processor"`
+}
+
+// validateCPUScheduling checks the weight/limit/reserve values are in the
+// ranges HCS accepts.
+func validateCPUScheduling(opts quickSpecOptions) error {
+	if opts.CPUWeight < 0 || opts.CPUWeight > maxCPUWeight {
+		return fmt.Errorf("--cpu-weight must be between 0 and %d, got %d", maxCPUWeight, opts.CPUWeight)
+	}
+	if opts.CPULimit < 0 || opts.CPULimit > maxCPULimit {
+		return fmt.Errorf("--cpu-limit must be between 0 and %d, got %d", maxCPULimit, opts.CPULimit)
+	}
+	if opts.CPUReserve < 0 || opts.CPUReserve > maxCPUReserve {
+		return fmt.Errorf("--cpu-reserve must be between 0 and %d, got %d", maxCPUReserve, opts.CPUReserve)
+	}
+	if opts.CPULimit != 0 && opts.CPUReserve > opts.CPULimit {
+		return fmt.Errorf("--cpu-reserve (%d) cannot exceed --cpu-limit (%d)", opts.CPUReserve, opts.CPULimit)
+	}
+	return nil
+}
+
+// apicModes maps --apic values to the Processor ApicMode HCS expects; the
+// default leaves the field out so the host picks.
+var apicModes = map[string]string{
+	"":        "",
+	"default": "",
+	"legacy":  "Legacy",
+	"x2apic":  "X2Apic",
+}
+
+// validateFirmware checks the generation, APIC and clock options, returning
+// the ApicMode to emit and whether the RTC runs in UTC.
+func validateFirmware(opts quickSpecOptions) (apicMode string, useUTC bool, err error) {
+	switch opts.Generation {
+	case 0, 2:
+	case 1:
+		if opts.SecureBoot {
+			return "", false, fmt.Errorf("--secure-boot needs UEFI and cannot be combined with --generation 1")
+		}
+		return "", false, fmt.Errorf("--generation 1 (legacy BIOS) is not available: HCS compute systems boot UEFI or a Linux kernel directly; create generation 1 VMs with Hyper-V instead")
+	default:
+		return "", false, fmt.Errorf("invalid --generation %d (expected 2)", opts.Generation)
+	}
+
+	apicMode, ok := apicModes[strings.ToLower(opts.ApicMode)]
+	if !ok {
+		return "", false, fmt.Errorf("invalid --apic %q (expected default, legacy or x2apic)", opts.ApicMode)
+	}
+
+	switch strings.ToLower(opts.RTC) {
+	case "", "local":
+	case "utc":
+		useUTC = true
+	default:
+		return "", false, fmt.Errorf("invalid --rtc %q (expected local or utc)", opts.RTC)
+	}
+	return apicMode, useUTC, nil
+}
+
+// allHostCPUs is the --cpus sentinel for "every logical processor on the
+// host"; it never means a VM with zero CPUs.
+const allHostCPUs = 0
+
+// manyCPUsThreshold is the vCPU count above which --cpus 0 warns: guests and
+// older hosts often cope poorly with VMs that large.
+const manyCPUsThreshold = 64
+
+// hostProcessorCount returns the number of logical processors across all
+// processor groups; tests replace it.
+var hostProcessorCount = func() int {
+	return int(windows.GetActiveProcessorCount(windows.ALL_PROCESSOR_GROUPS))
+}
+
+// resolveCPUCount turns the --cpus value into the concrete count written to
+// the spec, expanding allHostCPUs to the host's logical processor count.
+func resolveCPUCount(n int) (int, error) {
+	if n < 0 {
+		return 0, fmt.Errorf("--cpus must not be negative, got %d", n)
+	}
+	if n != allHostCPUs {
+		return n, nil
+	}
+	n = hostProcessorCount()
+	if n < 1 {
+		return 0, fmt.Errorf("--cpus 0: cannot determine the host's processor count")
+	}
+	verbosef("--cpus 0 resolved to %d host processors", n)
+	if n > manyCPUsThreshold {
+		fmt.Fprintf(os.Stderr, "Warning: --cpus 0 gives the VM %d virtual CPUs; some guests don't support more than %d\n", n, manyCPUsThreshold)
+	}
+	return n, nil
+}
+
+// validateMemoryTuning checks the dynamic memory tuning options against
+// their allowed ranges. Both only apply when memory can be reclaimed, so
+// they need ballooning.
+func validateMemoryTuning(opts quickSpecOptions) error {
+	if opts.MemoryBuffer != 0 && (opts.MemoryBuffer < minMemoryBuffer || opts.MemoryBuffer > maxMemoryBuffer) {
+		return fmt.Errorf("--memory-buffer must be between %d and %d percent, got %d", minMemoryBuffer, maxMemoryBuffer, opts.MemoryBuffer)
+	}
+	if opts.MemoryPriority < 0 || opts.MemoryPriority > maxMemoryPriority {
+		return fmt.Errorf("--memory-priority must be between 0 and %d, got %d", maxMemoryPriority, opts.MemoryPriority)
+	}
+	if (opts.MemoryBuffer != 0 || opts.MemoryPriority != 0) && !opts.Ballooning {
+		return fmt.Errorf("--memory-buffer and --memory-priority need --memory-ballooning")
+	}
+	return nil
+}
+
+// microsoftWindowsSecureBootTemplate is the Hyper-V "Microsoft Windows"
+// secure boot template ID.
+const microsoftWindowsSecureBootTemplate = "1734c6e8-3154-4dda-ba5f-a874cc483422"
+
+// requiredSchemaVersion is the oldest schema that supports every feature opts
+// asks for.
+func requiredSchemaVersion(opts quickSpecOptions) SchemaVersion {
+	required := baseSchemaVersion
+	for _, f := range []struct {
+		on bool
+		v  SchemaVersion
+	}{
+		{opts.SecureBoot, secureBootSchemaVersion},
+		{opts.TPM, tpmSchemaVersion},
+		{opts.Kernel != "", linuxKernelDirectSchemaVersion},
+	} {
+		if f.on && required.less(f.v) {
+			required = f.v
+		}
+	}
+	return required
+}
+
+func buildMinimalSpec(opts quickSpecOptions, schema SchemaVersion, gpuDevices []GpuDevice) (string, error) {
+	if err := validateCPUScheduling(opts); err != nil {
+		return "", err
+	}
+	if err := validateMemoryTuning(opts); err != nil {
+		return "", err
+	}
+	cpuCount, err := resolveCPUCount(opts.CPUCount)
+	if err != nil {
+		return "", err
+	}
+	apicMode, useUTC, err := validateFirmware(opts)
+	if err != nil {
+		return "", err
+	}
+
+	if len(opts.VhdxPaths) == 0 && opts.Kernel == "" {
+		return "", fmt.Errorf("no VHDX or kernel given")
+	}
+	kernel, err := kernelDirect(opts)
+	if err != nil {
+		return "", err
+	}
+	diskType := opts.DiskType
+	if diskType == "" {
+		diskType = "virtual"
+	}
+	attachType, ok := diskTypes[diskType]
+	if !ok {
+		return "", fmt.Errorf("invalid --disk-type %q: expected virtual, physical or iso", opts.DiskType)
+	}
+	absPaths := make([]string, len(opts.VhdxPaths))
+	for i, p := range opts.VhdxPaths {
+		if attachType == attachPassThru {
+			if !physicalDriveRe.MatchString(p) {
+				return "", fmt.Errorf("invalid physical disk %q: expected a device path like \\\\.\\PhysicalDrive2", p)
+			}
+			absPaths[i] = p
+			continue
+		}
+		absPath, err := filepath.Abs(p)
+		if err != nil {
+			return "", fmt.Errorf("cannot resolve VHDX path: %w", err)
+		}
+		// Verify file exists
+		if _, err := os.Stat(absPath); err != nil {
+			return "", fmt.Errorf("VHDX not found: %w", err)
+		}
+		if attachType == attachVirtualDisk {
+			if err := checkDiskFormat(absPath); err != nil {
+				return "", err
+			}
+		}
+		absPaths[i] = absPath
+	}
+
+	if attachType == attachIso && opts.Access != (diskAccess{}) {
+		return "", fmt.Errorf("--read-only and --cache-mode don't apply to --disk-type iso, which is always read-only")
+	}
+	atts := make([]*ScsiAttachment, 0, len(absPaths)+len(opts.ISOPaths))
+	for _, p := range absPaths {
+		att, err := opts.Access.attachment(attachType, p)
+		if err != nil {
+			return "", err
+		}
+		atts = append(atts, att)
+	}
+	for _, p := range opts.ISOPaths {
+		absPath, err := filepath.Abs(p)
+		if err != nil {
+			return "", fmt.Errorf("cannot resolve ISO path: %w", err)
+		}
+		if _, err := os.Stat(absPath); err != nil {
+			return "", fmt.Errorf("ISO not found: %w", err)
+		}
+		atts = append(atts, &ScsiAttachment{Type: attachIso, Path: absPath})
+	}
+	atts, err = orderForBoot(atts, opts.BootOrder)
+	if err != nil {
+		return "", err
+	}
+
+	scsi, err := distributeAttachments(atts, opts.ScsiControllers)
+	if err != nil {
+		return "", err
+	}
+
+	topology, err := json.Marshal(computeTopology{
+		Memory: memoryTopology{
+			SizeInMB:        opts.MemoryMB,
+			AllowOvercommit: true,
+			EnableHotHint:   opts.Ballooning,
+			EnableColdHint:  opts.Ballooning,
+
+			MemoryBufferPercentage: opts.MemoryBuffer,
+			Priority:               opts.MemoryPriority,
+		},
+		Processor: processorTopology{
+			Count:       cpuCount,
+			Limit:       opts.CPULimit,
+			Weight:      opts.CPUWeight,
+			Reservation: opts.CPUReserve,
+			ApicMode:    apicMode,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	type bootEntry struct {
+		DevicePath string `json:"DevicePath"`
+		DeviceType string `json:"DeviceType"`
+		DiskNumber int    `json:"DiskNumber"`
+	}
+	type uefi struct {
+		BootThis                bootEntry `json:"BootThis"`
+		ApplySecureBootTemplate string    `json:"ApplySecureBootTemplate,omitempty"`
+		SecureBootTemplateId    string    `json:"SecureBootTemplateId,omitempty"`
+	}
+	var chipset []byte
+	if kernel != nil {
+		chipset, err = json.Marshal(struct {
+			LinuxKernelDirect *linuxKernelDirect `json:"LinuxKernelDirect"`
+			UseUtc            bool               `json:"UseUtc,omitempty"`
+		}{kernel, useUTC})
+	} else {
+		u := uefi{BootThis: bootEntry{DevicePath: "Primary", DeviceType: "ScsiDrive", DiskNumber: 0}}
+		if opts.SecureBoot {
+			u.ApplySecureBootTemplate = "Apply"
+			u.SecureBootTemplateId = microsoftWindowsSecureBootTemplate
+		}
+		chipset, err = json.Marshal(struct {
+			Uefi   uefi `json:"Uefi"`
+			UseUtc bool `json:"UseUtc,omitempty"`
+		}{u, useUTC})
+	}
 	if err != nil {
-		return "", fmt.Errorf("cannot resolve VHDX path: %w", err)
+		return "", err
 	}
 
-	// Verify file exists
-	if _, err := os.Stat(absPath); err != nil {
-		return "", fmt.Errorf("VHDX not found: %w", err)
+	var security json.RawMessage
+	if opts.TPM {
+		security = json.RawMessage(`{"EnableTpm": true}`)
 	}
 
 	spec := ComputeSystemSpec{
 		Owner: "hcstool",
-		SchemaVersion: &SchemaVersion{Major: 2, Minor: 1},
+		SchemaVersion: &schema,
 		ShouldTerminateOnLastHandleClosed: false,
 		VirtualMachine: &VirtualMachineSpec{
 			StopOnReset: true,
-			Chipset: json.RawMessage(`{
-				"Uefi": {
-					"BootThis": {
-						"DevicePath": "Primary",
-						"DeviceType": "ScsiDrive",
-						"DiskNumber": 0
-					}
-				}
-			}`),
-			ComputeTopology: json.RawMessage(fmt.Sprintf(`{
-				"Memory": {
-					"SizeInMB": %d,
-					"AllowOvercommit": true
-				},
-				"Processor": {
-					"Count": %d
-				}
-			}`, memoryMB, cpuCount)),
+			Chipset: json.RawMessage(chipset),
+			ComputeTopology: json.RawMessage(topology),
+			SecuritySettings: security,
 			Devices: &DevicesSpec{
-				Scsi: map[string]*ScsiController{
-					"Primary": {
-						Attachments: map[string]*ScsiAttachment{
-							"0": {
-								Type: "VirtualDisk",
-								Path: absPath,
-							},
-						},
-					},
-				},
+				Scsi: scsi,
 			},
 		},
 	}
@@ -551,33 +2348,149 @@ func buildMinimalSpec(vhdxPath string, memoryMB, cpuCount int, gpuDevices []GpuD
 	return string(data), nil
 }
 
-// buildSpecFromFlags creates a JSON spec from CLI flags.
-func buildSpecFromFlags(vhdxPath string, memoryMB, cpuCount int, addGPU bool) (string, error) {
+// linuxKernelDirect is the Chipset.LinuxKernelDirect section, which boots a
+// Linux kernel directly instead of going through UEFI.
+type linuxKernelDirect struct {
+	KernelFilePath string `json:"KernelFilePath"`
+	InitRdPath     string `json:"InitRdPath,omitempty"`
+	KernelCmdLine  string `json:"KernelCmdLine,omitempty"`
+}
+
+// kernelDirect resolves and checks the direct-boot files in opts, returning
+// nil when no kernel is given. Direct boot bypasses UEFI, so it can't be
+// combined with secure boot or a boot order.
+func kernelDirect(opts quickSpecOptions) (*linuxKernelDirect, error) {
+	if opts.Kernel == "" {
+		if opts.Initrd != "" || opts.KernelCmdline != "" {
+			return nil, fmt.Errorf("--initrd and --cmdline need --kernel")
+		}
+		return nil, nil
+	}
+	if opts.SecureBoot || len(opts.BootOrder) > 0 {
+		return nil, fmt.Errorf("--kernel boots without UEFI and cannot be combined with --secure-boot or --boot-order")
+	}
+
+	k := &linuxKernelDirect{KernelCmdLine: opts.KernelCmdline}
+	for _, f := range []struct {
+		flag, path string
+		dst        *string
+	}{
+		{"--kernel", opts.Kernel, &k.KernelFilePath},
+		{"--initrd", opts.Initrd, &k.InitRdPath},
+	} {
+		if f.path == "" {
+			continue
+		}
+		absPath, err := filepath.Abs(f.path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve %s path: %w", f.flag, err)
+		}
+		if _, err := os.Stat(absPath); err != nil {
+			return nil, fmt.Errorf("%s file not found: %w", f.flag, err)
+		}
+		*f.dst = absPath
+	}
+	return k, nil
+}
+
+// buildSpecFromFlags creates a JSON spec from CLI flags, picking the schema
+// version from what the host supports and the features requested.
+func buildSpecFromFlags(opts quickSpecOptions, addGPU, ignoreMissingGPU bool, gpuInstances []string) (string, error) {
+	var override *SchemaVersion
+	if opts.Schema != "" {
+		v, err := parseSchemaVersion(opts.Schema)
+		if err != nil {
+			return "", err
+		}
+		override = &v
+	}
+	supported, err := hostSchemaVersions()
+	if err != nil {
+		verbosef("cannot query supported schema versions, assuming the minimum needed: %v", err)
+	}
+	schema, err := pickSchemaVersion(supported, requiredSchemaVersion(opts), override)
+	if err != nil {
+		return "", err
+	}
+	verbosef("using schema version %s", schema)
+
 	var gpuDevices []GpuDevice
 	if addGPU {
 		var err error
-		gpuDevices, err = enumerateGPUs()
+		gpuDevices, err = selectCreateGPUs(ignoreMissingGPU, gpuInstances)
 		if err != nil {
-			return "", fmt.Errorf("GPU enumeration failed: %w", err)
+			return "", err
 		}
-		if len(gpuDevices) == 0 {
-			return "", fmt.Errorf("no GPUs found for GPU-PV")
+	}
+
+	return buildMinimalSpec(opts, schema, gpuDevices)
+}
+
+// envExpansion controls environment variable expansion in spec files.
+type envExpansion struct {
+	Enabled    bool // Expand ${VAR} and %VAR% references
+	AllowEmpty bool // Expand undefined variables to "" instead of failing
+}
+
+// envRefRe matches ${VAR} and %VAR% references. Windows variable names may
+// contain parentheses, as in %ProgramFiles(x86)%.
+var envRefRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|%([A-Za-z_][A-Za-z0-9_()]*)%`)
+
+// expandSpecEnv replaces ${VAR} and %VAR% references in spec text with the
+// variable's value. References are expected inside JSON strings, so values
+// are JSON-escaped: a path like C:\vms becomes C:\\vms in the document.
+// Undefined variables are an error listing every missing name, unless
+// allowEmpty is set.
+func expandSpecEnv(text string, allowEmpty bool) (string, error) {
+	var missing []string
+	out := envRefRe.ReplaceAllStringFunc(text, func(ref string) string {
+		m := envRefRe.FindStringSubmatch(ref)
+		name := m[1]
+		if name == "" {
+			name = m[2]
 		}
-		fmt.Fprintf(os.Stderr, "Found %d GPU(s) for GPU-PV:\n", len(gpuDevices))
-		for _, g := range gpuDevices {
-			fmt.Fprintf(os.Stderr, "  %s (%s)\n", g.Name, g.InstanceID)
+		value, ok := os.LookupEnv(name)
+		if !ok && !allowEmpty {
+			missing = append(missing, name)
+			return ref
 		}
+		quoted, _ := json.Marshal(value)
+		return string(quoted[1 : len(quoted)-1])
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("undefined environment variable(s) in spec: %s (use --expand-env-allow-empty to expand them to \"\")", strings.Join(missing, ", "))
 	}
-
-	return buildMinimalSpec(vhdxPath, memoryMB, cpuCount, gpuDevices)
+	return out, nil
 }
 
-// readSpecFile reads a JSON spec file and returns its contents.
-func readSpecFile(path string) (string, error) {
+// relaxedJSON lets spec files carry // and /* */ comments and trailing
+// commas, which readSpecFile strips before validating. Set by create
+// --relaxed-json; strict JSON stays the default.
+var relaxedJSON bool
+
+// readSpecFile reads a JSON spec file, expanding environment variables when
+// env asks for it, and returns its contents. With relaxedJSON the returned
+// document is the canonical JSON left after stripping comments.
+func readSpecFile(path string, env envExpansion) (string, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return "", fmt.Errorf("reading spec file: %w", err)
 	}
+	if relaxedJSON {
+		traceSpecSource(path, string(data))
+		stripped, err := stripJSONComments(string(data))
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", path, err)
+		}
+		data = []byte(stripped)
+	}
+	if env.Enabled {
+		expanded, err := expandSpecEnv(string(data), env.AllowEmpty)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", path, err)
+		}
+		data = []byte(expanded)
+	}
 
 	// Validate it's valid JSON
 	var raw json.RawMessage
@@ -588,6 +2501,121 @@ func readSpecFile(path string) (string, error) {
 	return string(data), nil
 }
 
+// stripJSONComments removes // line comments, /* */ block comments and
+// trailing commas before } or ] from text, leaving string literals intact.
+// Newlines inside comments are kept so JSON error offsets stay on the
+// original line.
+func stripJSONComments(text string) (string, error) {
+	var out strings.Builder
+	comma := -1 // offset in out of a comma that may turn out to be trailing
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '"':
+			comma = -1
+			j := i + 1
+			for ; j < len(text) && text[j] != '"'; j++ {
+				if text[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(text) {
+				return "", fmt.Errorf("unterminated string")
+			}
+			out.WriteString(text[i : j+1])
+			i = j
+		case c == '/' && i+1 < len(text) && text[i+1] == '/':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+			if i < len(text) {
+				out.WriteByte('\n')
+			}
+		case c == '/' && i+1 < len(text) && text[i+1] == '*':
+			end := strings.Index(text[i+2:], "*/")
+			if end < 0 {
+				return "", fmt.Errorf("unterminated /* comment")
+			}
+			out.WriteString(strings.Repeat("\n", strings.Count(text[i:i+2+end], "\n")))
+			i += end + 3
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			out.WriteByte(c)
+		case (c == '}' || c == ']') && comma >= 0:
+			s := out.String()
+			out.Reset()
+			out.WriteString(s[:comma])
+			out.WriteString(s[comma+1:])
+			out.WriteByte(c)
+			comma = -1
+		default:
+			comma = -1
+			if c == ',' {
+				comma = out.Len()
+			}
+			out.WriteByte(c)
+		}
+	}
+	return out.String(), nil
+}
+
+// templateFuncs are available in spec templates and --format templates.
+// json renders a value as JSON, e.g. {{json .disk}} for an escaped path.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// templateLineRe extracts the line number from text/template error messages
+// ("template: name:LINE:COL: ..." or "template: name:LINE: ...").
+var templateLineRe = regexp.MustCompile(`^template: [^:]*:(\d+)`)
+
+// renderSpecTemplate renders a text/template spec with the given key/values
+// and validates the result is JSON. Values are available as {{.key}}; use
+// {{json .key}} to emit a value as a quoted, escaped JSON string (needed for
+// Windows paths). Referencing an unset key is an error.
+func renderSpecTemplate(path string, vars map[string]string) (string, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading spec template: %w", err)
+	}
+
+	tmpl, err := template.New(filepath.Base(path)).
+		Funcs(templateFuncs).
+		Option("missingkey=error").
+		Parse(string(src))
+	if err != nil {
+		return "", templateError("parsing spec template", err, src)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", templateError("rendering spec template", err, src)
+	}
+
+	var raw json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &raw); err != nil {
+		return "", fmt.Errorf("rendered spec template is not valid JSON: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// templateError wraps a template error, quoting the offending source line
+// when the error carries a line number.
+func templateError(what string, err error, src []byte) error {
+	m := templateLineRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	n, _ := strconv.Atoi(m[1])
+	lines := strings.Split(string(src), "\n")
+	if n < 1 || n > len(lines) {
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	return fmt.Errorf("%s: %w\n  %d | %s", what, err, n, strings.TrimRight(lines[n-1], "\r"))
+}
+
 // printSpec prints a spec to stderr without actually creating a VM (for debugging).
 func printSpec(specJSON string) {
 	var raw json.RawMessage
@@ -603,6 +2631,65 @@ func printSpec(specJSON string) {
 	fmt.Fprintln(os.Stderr, string(pretty))
 }
 
+// uefiChipset is the subset of the Chipset fragment needed to describe the
+// boot device, or the kernel for direct-boot VMs.
+type uefiChipset struct {
+	Uefi *struct {
+		BootThis *struct {
+			DevicePath string `json:"DevicePath"`
+			DeviceType string `json:"DeviceType"`
+			DiskNumber int    `json:"DiskNumber"`
+		} `json:"BootThis"`
+	} `json:"Uefi"`
+	LinuxKernelDirect *linuxKernelDirect `json:"LinuxKernelDirect"`
+}
+
+// summarizeSpec renders a one-line human summary of a spec: boot device and
+// its backing path, vCPU count, memory and whether GPU-PV is configured.
+// gpuPending reports a GPU that will be injected at create time.
+func summarizeSpec(specJSON string, gpuPending bool) (string, error) {
+	var spec ComputeSystemSpec
+	if err := json.Unmarshal([]byte(specJSON), &spec); err != nil {
+		return "", fmt.Errorf("invalid JSON spec: %w", err)
+	}
+	vm := spec.VirtualMachine
+	if vm == nil {
+		return "", fmt.Errorf("spec has no VirtualMachine section")
+	}
+
+	boot := "unknown"
+	var chipset uefiChipset
+	if len(vm.Chipset) > 0 && json.Unmarshal(vm.Chipset, &chipset) == nil &&
+		chipset.Uefi != nil && chipset.Uefi.BootThis != nil {
+		b := chipset.Uefi.BootThis
+		boot = fmt.Sprintf("%s %s/%d", b.DeviceType, b.DevicePath, b.DiskNumber)
+		if vm.Devices != nil {
+			if ctrl := vm.Devices.Scsi[b.DevicePath]; ctrl != nil {
+				if att := ctrl.Attachments[strconv.Itoa(b.DiskNumber)]; att != nil {
+					boot += " → " + att.Path
+				}
+			}
+		}
+	} else if chipset.LinuxKernelDirect != nil {
+		boot = "kernel " + chipset.LinuxKernelDirect.KernelFilePath
+	}
+
+	var topo computeTopology
+	if len(vm.ComputeTopology) > 0 {
+		if err := json.Unmarshal(vm.ComputeTopology, &topo); err != nil {
+			return "", fmt.Errorf("invalid ComputeTopology: %w", err)
+		}
+	}
+
+	gpu := "off"
+	if gpuPending || (vm.Devices != nil && len(vm.Devices.VirtualPci) > 0) {
+		gpu = "on"
+	}
+
+	return fmt.Sprintf("boot: %s, %d vCPU, %d MB, GPU: %s",
+		boot, topo.Processor.Count, topo.Memory.SizeInMB, gpu), nil
+}
+
 // stringSliceContains checks if a string slice contains a value.
 func stringSliceContains(slice []string, val string) bool {
 	for _, s := range slice {
@@ -0,0 +1,873 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestMakePathsAbsoluteBaseDir(t *testing.T) {
+	dir := t.TempDir()
+	absDisk := filepath.Join(os.TempDir(), "other.vhdx")
+
+	spec := &ComputeSystemSpec{
+		VirtualMachine: &VirtualMachineSpec{
+			Devices: &DevicesSpec{
+				Scsi: map[string]*ScsiController{
+					"Primary": {
+						Attachments: map[string]*ScsiAttachment{
+							"0": {Type: "VirtualDisk", Path: "boot.vhdx"},
+							"1": {Type: "VirtualDisk", Path: filepath.Join("disks", "data.vhdx")},
+							"2": {Type: "VirtualDisk", Path: absDisk},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := makePathsAbsolute(spec, dir); err != nil {
+		t.Fatalf("makePathsAbsolute: %v", err)
+	}
+
+	atts := spec.VirtualMachine.Devices.Scsi["Primary"].Attachments
+	want := map[string]string{
+		"0": filepath.Join(dir, "boot.vhdx"),
+		"1": filepath.Join(dir, "disks", "data.vhdx"),
+		"2": absDisk,
+	}
+	for slot, path := range want {
+		if got := atts[slot].Path; got != path {
+			t.Errorf("slot %s: got %q, want %q", slot, got, path)
+		}
+	}
+}
+
+func TestExtractVHDPaths(t *testing.T) {
+	tests := []struct {
+		name string
+		spec *ComputeSystemSpec
+		want []string
+	}{
+		{"nil VirtualMachine", &ComputeSystemSpec{}, nil},
+		{"nil Devices", &ComputeSystemSpec{VirtualMachine: &VirtualMachineSpec{}}, nil},
+		{"empty SCSI map", &ComputeSystemSpec{VirtualMachine: &VirtualMachineSpec{
+			Devices: &DevicesSpec{Scsi: map[string]*ScsiController{}},
+		}}, nil},
+		{"multiple controllers", &ComputeSystemSpec{VirtualMachine: &VirtualMachineSpec{
+			Devices: &DevicesSpec{Scsi: map[string]*ScsiController{
+				"Primary": {Attachments: map[string]*ScsiAttachment{
+					"0": {Type: attachVirtualDisk, Path: `C:\vms\boot.vhdx`},
+					"1": {Type: attachIso, Path: `C:\iso\setup.iso`},
+					"2": {Type: attachVirtualDisk, Path: ""},
+				}},
+				"Secondary": {Attachments: map[string]*ScsiAttachment{
+					"0": {Type: attachVirtualDisk, Path: `D:\data.vhdx`},
+					"1": {Type: attachPassThru, Path: `\\.\PhysicalDrive2`},
+					"2": nil,
+				}},
+				"Tertiary": nil,
+			}},
+		}}, []string{`C:\iso\setup.iso`, `C:\vms\boot.vhdx`, `D:\data.vhdx`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := extractVHDPaths(tt.spec)
+			sort.Strings(got)
+			if len(got) != len(tt.want) {
+				t.Fatalf("extractVHDPaths = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("extractVHDPaths = %q, want %q", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestMakePathsAbsoluteWorkingDir(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	absDisk := filepath.Join(os.TempDir(), "abs.vhdx")
+
+	spec := &ComputeSystemSpec{
+		VirtualMachine: &VirtualMachineSpec{
+			Devices: &DevicesSpec{
+				Scsi: map[string]*ScsiController{
+					"Primary": {Attachments: map[string]*ScsiAttachment{
+						"0": {Type: attachVirtualDisk, Path: "boot.vhdx"},
+						"1": {Type: attachVirtualDisk, Path: absDisk},
+						"2": {Type: attachVirtualDisk, Path: ""},
+						"3": {Type: attachPassThru, Path: `\\.\PhysicalDrive2`},
+					}},
+				},
+			},
+		},
+	}
+	if err := makePathsAbsolute(spec, ""); err != nil {
+		t.Fatalf("makePathsAbsolute: %v", err)
+	}
+
+	atts := spec.VirtualMachine.Devices.Scsi["Primary"].Attachments
+	want := map[string]string{
+		"0": filepath.Join(wd, "boot.vhdx"),
+		"1": absDisk,
+		"2": "",
+		"3": `\\.\PhysicalDrive2`,
+	}
+	for slot, path := range want {
+		if got := atts[slot].Path; got != path {
+			t.Errorf("slot %s: got %q, want %q", slot, got, path)
+		}
+	}
+
+	for _, spec := range []*ComputeSystemSpec{{}, {VirtualMachine: &VirtualMachineSpec{}}} {
+		if err := makePathsAbsolute(spec, dir); err != nil {
+			t.Errorf("makePathsAbsolute on %+v: %v", spec, err)
+		}
+	}
+}
+
+func TestBareGUID(t *testing.T) {
+	g := windows.GUID{
+		Data1: 0x2f1d6c5e,
+		Data2: 0x0a1b,
+		Data3: 0x4c2d,
+		Data4: [8]byte{0x9e, 0x3f, 0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+	}
+	if s := g.String(); s[0] != '{' || s[len(s)-1] != '}' {
+		t.Fatalf("GUID.String() = %q, expected the braced form", s)
+	}
+	got, err := bareGUID(g)
+	if err != nil {
+		t.Fatalf("bareGUID: %v", err)
+	}
+	if want := "2F1D6C5E-0A1B-4C2D-9E3F-001122334455"; !strings.EqualFold(got, want) {
+		t.Errorf("bareGUID = %q, want %q", got, want)
+	}
+	if !guidRe.MatchString(got) {
+		t.Errorf("bareGUID = %q does not match guidRe", got)
+	}
+}
+
+func TestResolveOwner(t *testing.T) {
+	tests := []struct {
+		name                  string
+		flag, env, spec, want string
+	}{
+		{"flag wins over all", "flag", "env", "spec", "flag"},
+		{"env wins over spec", "", "env", "spec", "env"},
+		{"spec used when no flag or env", "", "", "spec", "spec"},
+		{"default when nothing set", "", "", "", "hcstool"},
+		{"flag wins with no env", "flag", "", "spec", "flag"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveOwner(tt.flag, tt.env, tt.spec); got != tt.want {
+				t.Errorf("resolveOwner(%q, %q, %q) = %q, want %q", tt.flag, tt.env, tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDistributeDisks(t *testing.T) {
+	scsi, err := distributeDisks([]string{"boot", "d1", "d2", "d3", "d4"}, attachVirtualDisk, 3)
+	if err != nil {
+		t.Fatalf("distributeDisks: %v", err)
+	}
+
+	want := map[string]map[string]string{
+		"Primary":   {"0": "boot", "1": "d3"},
+		"Secondary": {"0": "d1", "1": "d4"},
+		"Tertiary":  {"0": "d2"},
+	}
+	if len(scsi) != len(want) {
+		t.Fatalf("got %d controllers, want %d", len(scsi), len(want))
+	}
+	for ctrl, slots := range want {
+		c := scsi[ctrl]
+		if c == nil {
+			t.Fatalf("missing controller %s", ctrl)
+		}
+		if len(c.Attachments) != len(slots) {
+			t.Errorf("%s has %d attachments, want %d", ctrl, len(c.Attachments), len(slots))
+		}
+		for slot, path := range slots {
+			if a := c.Attachments[slot]; a == nil || a.Path != path {
+				t.Errorf("%s slot %s = %+v, want %s", ctrl, slot, a, path)
+			}
+		}
+	}
+
+	// More controllers than disks leaves the extras empty.
+	scsi, err = distributeDisks([]string{"boot"}, attachVirtualDisk, 2)
+	if err != nil {
+		t.Fatalf("distributeDisks: %v", err)
+	}
+	if len(scsi["Secondary"].Attachments) != 0 {
+		t.Errorf("Secondary should be empty, got %+v", scsi["Secondary"].Attachments)
+	}
+
+	for _, n := range []int{-1, 5} {
+		if _, err := distributeDisks([]string{"boot"}, attachVirtualDisk, n); err == nil {
+			t.Errorf("distributeDisks(n=%d) succeeded, want error", n)
+		}
+	}
+}
+
+func TestInjectGPUKeepsExistingDevices(t *testing.T) {
+	existing := &VirtualPciDev{DeviceInstancePath: `PCI\VEN_1234&DEV_0001\1`}
+	spec := &ComputeSystemSpec{
+		VirtualMachine: &VirtualMachineSpec{
+			Devices: &DevicesSpec{
+				VirtualPci: map[string]*VirtualPciDev{"gpu-0": existing},
+			},
+		},
+	}
+
+	injectGPU(spec, []GpuDevice{
+		{InstanceID: `PCI\VEN_10DE&DEV_2204\4&1`},
+		{InstanceID: `pci\ven_1234&dev_0001\1`}, // already in the spec
+		{InstanceID: `PCI\VEN_1002&DEV_73BF\4&2`},
+	})
+
+	pci := spec.VirtualMachine.Devices.VirtualPci
+	if pci["gpu-0"] != existing {
+		t.Errorf("gpu-0 = %+v, want the spec's own device", pci["gpu-0"])
+	}
+	want := map[string]string{
+		"gpu-1": `PCI\VEN_10DE&DEV_2204\4&1`,
+		"gpu-2": `PCI\VEN_1002&DEV_73BF\4&2`,
+	}
+	if len(pci) != 1+len(want) {
+		t.Errorf("got %d VirtualPci devices, want %d: %+v", len(pci), 1+len(want), pci)
+	}
+	for key, path := range want {
+		if dev := pci[key]; dev == nil || dev.DeviceInstancePath != path {
+			t.Errorf("%s = %+v, want %s", key, dev, path)
+		}
+	}
+}
+
+func TestGPUHotAddRequestsOrder(t *testing.T) {
+	var gpus []GpuDevice
+	for i := 0; i < 12; i++ {
+		gpus = append(gpus, GpuDevice{InstanceID: fmt.Sprintf(`PCI\VEN_10DE&DEV_2204\4&%d`, i)})
+	}
+
+	// Run it a few times: map iteration order would make a wrong order flaky.
+	for run := 0; run < 5; run++ {
+		reqs := gpuHotAddRequests(nil, gpus)
+		if len(reqs) != len(gpus) {
+			t.Fatalf("got %d requests, want %d", len(reqs), len(gpus))
+		}
+		for i, req := range reqs {
+			wantPath := fmt.Sprintf("VirtualMachine/Devices/VirtualPci/gpu-%d", i)
+			dev, _ := req.Settings.(*VirtualPciDev)
+			if req.ResourcePath != wantPath || dev == nil || dev.DeviceInstancePath != gpus[i].InstanceID {
+				t.Fatalf("request %d = %s %+v, want %s for %s", i, req.ResourcePath, req.Settings, wantPath, gpus[i].InstanceID)
+			}
+		}
+	}
+}
+
+func TestParseEnumResult(t *testing.T) {
+	entry := `{"Id":"2f1d6c5e-0000-0000-0000-000000000001","SystemType":"VirtualMachine","State":"Running","Name":"web"}`
+	tests := []struct {
+		name    string
+		in      string
+		wantIDs int
+	}{
+		{"empty string", "", 0},
+		{"whitespace", " \r\n", 0},
+		{"null", "null", 0},
+		{"empty array", "[]", 0},
+		{"bare array", "[" + entry + "]", 1},
+		{"wrapped", `{"ComputeSystems":[` + entry + `,` + entry + `]}`, 2},
+		{"wrapped lowercase key", `{"value":[` + entry + `]}`, 1},
+		{"wrapped null", `{"ComputeSystems":null}`, 0},
+		{"single object", entry, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := parseEnumResult(tt.in)
+			if err != nil {
+				t.Fatalf("parseEnumResult: %v", err)
+			}
+			if len(entries) != tt.wantIDs {
+				t.Fatalf("got %d entries, want %d", len(entries), tt.wantIDs)
+			}
+			for _, e := range entries {
+				if e.Name != "web" || e.State != "Running" {
+					t.Errorf("entry = %+v", e)
+				}
+			}
+		})
+	}
+
+	for _, bad := range []string{"{", `{"Other":[]}`, `"text"`, `{"ComputeSystems":{}}`} {
+		if _, err := parseEnumResult(bad); err == nil {
+			t.Errorf("parseEnumResult(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestInspectDisks(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "boot.vhdx")
+	if err := os.WriteFile(present, make([]byte, 4096), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "gone.vhdx")
+
+	spec := &ComputeSystemSpec{
+		VirtualMachine: &VirtualMachineSpec{
+			Devices: &DevicesSpec{
+				Scsi: map[string]*ScsiController{
+					"Secondary": {Attachments: map[string]*ScsiAttachment{
+						"0": {Type: attachPassThru, Path: `\\.\PhysicalDrive2`},
+					}},
+					"Primary": {Attachments: map[string]*ScsiAttachment{
+						"10": {Type: attachVirtualDisk, Path: missing},
+						"2":  {Type: attachVirtualDisk, Path: present},
+					}},
+				},
+			},
+		},
+	}
+
+	want := []DiskInfo{
+		{Controller: "Primary", Slot: "2", Type: attachVirtualDisk, Path: present, SizeBytes: 4096},
+		{Controller: "Primary", Slot: "10", Type: attachVirtualDisk, Path: missing, Missing: true},
+		{Controller: "Secondary", Slot: "0", Type: attachPassThru, Path: `\\.\PhysicalDrive2`},
+	}
+	// inspect reads the disks from the spec saved at create.
+	useSavedSpecDir(t)
+	stubEnumeration(t, "[]")
+	const id = "11111111-2222-3333-4444-555555555555"
+	specJSON, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSpec(id, string(specJSON)); err != nil {
+		t.Fatal(err)
+	}
+	got := inspectDisks(configuredSpec(id))
+	if len(got) != len(want) {
+		t.Fatalf("got %d disks, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("disk %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if d := inspectDisks(configuredSpec("99999999-2222-3333-4444-555555555555")); d != nil {
+		t.Errorf("system without a saved spec gave %+v", d)
+	}
+	if d := inspectDisks(&ComputeSystemSpec{}); d != nil {
+		t.Errorf("spec without a VM gave %+v", d)
+	}
+}
+
+func TestOrderForBoot(t *testing.T) {
+	disk := &ScsiAttachment{Type: attachVirtualDisk, Path: "boot.vhdx"}
+	data := &ScsiAttachment{Type: attachVirtualDisk, Path: "data.vhdx"}
+	dvd := &ScsiAttachment{Type: attachIso, Path: "setup.iso"}
+	atts := []*ScsiAttachment{disk, data, dvd}
+
+	tests := []struct {
+		order []string
+		want  []*ScsiAttachment
+	}{
+		{nil, atts},
+		{[]string{"disk"}, atts},
+		{[]string{"dvd"}, []*ScsiAttachment{dvd, disk, data}},
+		{[]string{"DVD", "disk"}, []*ScsiAttachment{dvd, disk, data}},
+		{[]string{"disk", "dvd"}, atts},
+	}
+	for _, tt := range tests {
+		got, err := orderForBoot(atts, tt.order)
+		if err != nil {
+			t.Errorf("orderForBoot(%v): %v", tt.order, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("orderForBoot(%v) returned %d attachments, want %d", tt.order, len(got), len(tt.want))
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("orderForBoot(%v)[%d] = %s, want %s", tt.order, i, got[i].Path, tt.want[i].Path)
+			}
+		}
+	}
+
+	for _, bad := range [][]string{{"floppy"}, {"dvd", "dvd"}} {
+		if _, err := orderForBoot(atts, bad); err == nil {
+			t.Errorf("orderForBoot(%v) succeeded, want error", bad)
+		}
+	}
+	if _, err := orderForBoot([]*ScsiAttachment{disk}, []string{"dvd", "disk"}); err == nil {
+		t.Errorf("dvd without an ISO attached succeeded, want error")
+	}
+}
+
+func TestBuildMinimalSpec(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile("boot.vhdx", append([]byte(vhdxSignature), make([]byte, 512)...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bootPath, err := filepath.Abs("boot.vhdx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gpus := []GpuDevice{{InstanceID: `PCI\VEN_10DE&DEV_2204\4&1`}}
+
+	tests := []struct {
+		name     string
+		opts     quickSpecOptions
+		schema   SchemaVersion
+		gpus     []GpuDevice
+		wantPci  bool
+		wantMem  int
+		wantCPUs int
+	}{
+		{"minimal", quickSpecOptions{MemoryMB: 2048, CPUCount: 2}, baseSchemaVersion, nil, false, 2048, 2},
+		{"bigger with newer schema", quickSpecOptions{MemoryMB: 8192, CPUCount: 8}, SchemaVersion{Major: 2, Minor: 5}, nil, false, 8192, 8},
+		{"with gpu", quickSpecOptions{MemoryMB: 4096, CPUCount: 4}, baseSchemaVersion, gpus, true, 4096, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.VhdxPaths = []string{"boot.vhdx"}
+			specJSON, err := buildMinimalSpec(tt.opts, tt.schema, tt.gpus)
+			if err != nil {
+				t.Fatalf("buildMinimalSpec: %v", err)
+			}
+
+			var got struct {
+				SchemaVersion  SchemaVersion
+				VirtualMachine struct {
+					ComputeTopology computeTopology
+					Devices         DevicesSpec
+				}
+			}
+			if err := json.Unmarshal([]byte(specJSON), &got); err != nil {
+				t.Fatalf("spec is not valid JSON: %v\n%s", err, specJSON)
+			}
+			if got.SchemaVersion != tt.schema {
+				t.Errorf("SchemaVersion = %s, want %s", got.SchemaVersion, tt.schema)
+			}
+			topo := got.VirtualMachine.ComputeTopology
+			if topo.Memory.SizeInMB != tt.wantMem {
+				t.Errorf("Memory.SizeInMB = %d, want %d", topo.Memory.SizeInMB, tt.wantMem)
+			}
+			if topo.Processor.Count != tt.wantCPUs {
+				t.Errorf("Processor.Count = %d, want %d", topo.Processor.Count, tt.wantCPUs)
+			}
+			primary := got.VirtualMachine.Devices.Scsi["Primary"]
+			if primary == nil || primary.Attachments["0"] == nil {
+				t.Fatalf("no Primary slot 0 attachment in %s", specJSON)
+			}
+			if p := primary.Attachments["0"].Path; p != bootPath {
+				t.Errorf("boot disk path = %q, want %q", p, bootPath)
+			}
+			if hasPci := len(got.VirtualMachine.Devices.VirtualPci) > 0; hasPci != tt.wantPci {
+				t.Errorf("VirtualPci present = %v, want %v", hasPci, tt.wantPci)
+			}
+		})
+	}
+}
+
+func TestExpandSpecEnv(t *testing.T) {
+	t.Setenv("HCSTOOL_TEST_VHD_DIR", `C:\vms`)
+	t.Setenv("HCSTOOL_TEST_NAME", `say "hi"`)
+	os.Unsetenv("HCSTOOL_TEST_UNSET")
+
+	spec := `{"Path": "${HCSTOOL_TEST_VHD_DIR}\\boot.vhdx", "Alt": "%HCSTOOL_TEST_VHD_DIR%\\data.vhdx", "Name": "${HCSTOOL_TEST_NAME}", "Pct": "100%"}`
+	got, err := expandSpecEnv(spec, false)
+	if err != nil {
+		t.Fatalf("expandSpecEnv: %v", err)
+	}
+	var doc map[string]string
+	if err := json.Unmarshal([]byte(got), &doc); err != nil {
+		t.Fatalf("expanded spec is not valid JSON: %v\n%s", err, got)
+	}
+	want := map[string]string{
+		"Path": `C:\vms\boot.vhdx`,
+		"Alt":  `C:\vms\data.vhdx`,
+		"Name": `say "hi"`,
+		"Pct":  "100%",
+	}
+	for k, v := range want {
+		if doc[k] != v {
+			t.Errorf("%s = %q, want %q", k, doc[k], v)
+		}
+	}
+
+	missing := `{"Path": "${HCSTOOL_TEST_UNSET}\\boot.vhdx"}`
+	if _, err := expandSpecEnv(missing, false); err == nil || !strings.Contains(err.Error(), "HCSTOOL_TEST_UNSET") {
+		t.Errorf("undefined variable: err = %v, want one naming HCSTOOL_TEST_UNSET", err)
+	}
+	got, err = expandSpecEnv(missing, true)
+	if err != nil {
+		t.Fatalf("expandSpecEnv with allowEmpty: %v", err)
+	}
+	if want := `{"Path": "\\boot.vhdx"}`; got != want {
+		t.Errorf("allowEmpty expansion = %s, want %s", got, want)
+	}
+}
+
+func TestBuildMinimalSpecKernelDirect(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, f := range []string{"vmlinux", "initrd.img"} {
+		if err := os.WriteFile(f, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kernelPath, _ := filepath.Abs("vmlinux")
+	initrdPath, _ := filepath.Abs("initrd.img")
+
+	opts := quickSpecOptions{Kernel: "vmlinux", Initrd: "initrd.img", KernelCmdline: "console=ttyS0", MemoryMB: 1024, CPUCount: 1}
+	specJSON, err := buildMinimalSpec(opts, requiredSchemaVersion(opts), nil)
+	if err != nil {
+		t.Fatalf("buildMinimalSpec: %v", err)
+	}
+	var spec ComputeSystemSpec
+	if err := json.Unmarshal([]byte(specJSON), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if *spec.SchemaVersion != linuxKernelDirectSchemaVersion {
+		t.Errorf("SchemaVersion = %s, want %s", spec.SchemaVersion, linuxKernelDirectSchemaVersion)
+	}
+	var chipset uefiChipset
+	if err := json.Unmarshal(spec.VirtualMachine.Chipset, &chipset); err != nil {
+		t.Fatal(err)
+	}
+	if chipset.Uefi != nil {
+		t.Errorf("direct-boot spec has a Uefi section: %s", spec.VirtualMachine.Chipset)
+	}
+	want := linuxKernelDirect{KernelFilePath: kernelPath, InitRdPath: initrdPath, KernelCmdLine: "console=ttyS0"}
+	if chipset.LinuxKernelDirect == nil || *chipset.LinuxKernelDirect != want {
+		t.Errorf("LinuxKernelDirect = %+v, want %+v", chipset.LinuxKernelDirect, want)
+	}
+	if got := extractKernelPaths(&spec); len(got) != 2 || got[0] != kernelPath || got[1] != initrdPath {
+		t.Errorf("extractKernelPaths = %q", got)
+	}
+
+	for _, bad := range []quickSpecOptions{
+		{Kernel: "missing", MemoryMB: 1024, CPUCount: 1},
+		{Kernel: "vmlinux", SecureBoot: true, MemoryMB: 1024, CPUCount: 1},
+		{VhdxPaths: []string{"vmlinux"}, Initrd: "initrd.img", MemoryMB: 1024, CPUCount: 1},
+	} {
+		if _, err := buildMinimalSpec(bad, baseSchemaVersion, nil); err == nil {
+			t.Errorf("buildMinimalSpec(%+v) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestSpecDifferences(t *testing.T) {
+	vmSpec := func(owner string, memMB, cpus int, disks ...string) *ComputeSystemSpec {
+		atts := map[string]*ScsiAttachment{}
+		for i, d := range disks {
+			atts[strconv.Itoa(i)] = &ScsiAttachment{Type: attachVirtualDisk, Path: d}
+		}
+		topo, _ := json.Marshal(computeTopology{
+			Memory:    memoryTopology{SizeInMB: memMB},
+			Processor: processorTopology{Count: cpus},
+		})
+		return &ComputeSystemSpec{
+			Owner: owner,
+			VirtualMachine: &VirtualMachineSpec{
+				ComputeTopology: topo,
+				Devices:         &DevicesSpec{Scsi: map[string]*ScsiController{"Primary": {Attachments: atts}}},
+			},
+		}
+	}
+
+	want := vmSpec("hcstool", 2048, 2, `C:\vm\boot.vhdx`, `C:\vm\data.vhdx`)
+	if d := specDifferences(want, vmSpec("HCSTOOL", 2048, 2, `c:\vm\data.vhdx`, `C:\VM\boot.vhdx`)); len(d) != 0 {
+		t.Errorf("matching configuration reported differences: %q", d)
+	}
+	if d := specDifferences(want, vmSpec("other", 4096, 4, `C:\vm\boot.vhdx`)); len(d) != 4 {
+		t.Errorf("got %d differences, want owner, disks, memory and CPUs: %q", len(d), d)
+	}
+	if d := specDifferences(want, &ComputeSystemSpec{Owner: "hcstool"}); len(d) != 1 {
+		t.Errorf("system without a VM configuration: got %q, want one note", d)
+	}
+}
+
+func TestResolvePropertyBundles(t *testing.T) {
+	types, err := resolvePropertyBundles([]string{"stats", "Memory", "stats"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Statistics", "Memory", "GuestMemory", "SharedMemoryRegion"}; strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", types, want)
+	}
+
+	types, err = resolvePropertyBundles([]string{"basic"})
+	if err != nil || len(types) != 0 {
+		t.Errorf("basic: got %v, %v; want no property types", types, err)
+	}
+	if types, _ := resolvePropertyBundles([]string{"all"}); len(types) != len(allPropertyTypes) {
+		t.Errorf("all: got %d types, want %d", len(types), len(allPropertyTypes))
+	}
+	if _, err := resolvePropertyBundles([]string{"everything"}); err == nil {
+		t.Error("unknown bundle accepted")
+	}
+}
+
+func TestResolverCacheEnumeratesOnce(t *testing.T) {
+	origOnce := enumerateOnce
+	defer func() { enumerateOnce = origOnce }()
+	defer scopeResolverCache()()
+
+	var mu sync.Mutex
+	calls := 0
+	enumerateOnce = func(string) (string, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return `[{"Id":"0a1b2c3d-0000-0000-0000-000000000001","Name":"alpha"},{"Id":"9f8e7d6c-0000-0000-0000-000000000002","Name":"beta"}]`, nil
+	}
+
+	var wg sync.WaitGroup
+	for _, prefix := range []string{"0a1b", "9f8e", "0a1b"} {
+		wg.Add(1)
+		go func(prefix string) {
+			defer wg.Done()
+			if _, err := resolveVMID(prefix); err != nil {
+				t.Errorf("resolveVMID(%q): %v", prefix, err)
+			}
+		}(prefix)
+	}
+	wg.Wait()
+	if id, err := resolveVMName("beta"); err != nil || !strings.HasPrefix(id, "9f8e") {
+		t.Errorf("resolveVMName(beta) = %q, %v", id, err)
+	}
+	if calls != 1 {
+		t.Errorf("enumerated %d times within one scope, want 1", calls)
+	}
+
+	scopeResolverCache()
+	if _, err := resolveVMID("0a1b"); err != nil || calls != 2 {
+		t.Errorf("new scope: err = %v after %d enumerations, want a fresh enumeration", err, calls)
+	}
+}
+
+func TestWideStats(t *testing.T) {
+	if mem, uptime := wideStats(nil); mem != "-" || uptime != "-" {
+		t.Errorf("no statistics: got %q, %q; want -, -", mem, uptime)
+	}
+	st := &SystemStatistics{Uptime100ns: 90*10_000_000 + 5_000_000}
+	st.Memory.MemoryUsagePrivateWorkingSetBytes = 512 << 20
+	if mem, uptime := wideStats(st); mem != "512.0 MB" || uptime != "1m30s" {
+		t.Errorf("got %q, %q; want 512.0 MB, 1m30s", mem, uptime)
+	}
+}
+
+func TestSortEntries(t *testing.T) {
+	entries := []EnumEntry{
+		{Id: "c", Name: "web", State: "Running"},
+		{Id: "b", Name: "", State: "Stopped"},
+		{Id: "a", Name: "Web", State: "Running"},
+		{Id: "d", Name: "db", State: "Running"},
+	}
+	ids := func() string {
+		var s []string
+		for _, e := range entries {
+			s = append(s, e.Id)
+		}
+		return strings.Join(s, "")
+	}
+
+	if err := sortEntries(entries, ""); err != nil || ids() != "bdac" {
+		t.Errorf("default sort: got %s (%v), want bdac", ids(), err)
+	}
+	if err := sortEntries(entries, "state"); err != nil || ids() != "acdb" {
+		t.Errorf("state sort: got %s (%v), want acdb", ids(), err)
+	}
+	if err := sortEntries(entries, "uptime"); err == nil {
+		t.Error("unknown sort key accepted")
+	}
+}
+
+func TestListByType(t *testing.T) {
+	origOnce := enumerateOnce
+	defer func() { enumerateOnce = origOnce }()
+
+	var query string
+	enumerateOnce = func(q string) (string, error) {
+		query = q
+		// Simulate a host that ignores the query.
+		return `[{"Id":"a","SystemType":"VirtualMachine"},{"Id":"b","SystemType":"Container"},{"Id":"c","SystemType":"virtualmachine"}]`, nil
+	}
+
+	systemType, err := canonicalSystemType("virtualMACHINE")
+	if err != nil || systemType != "VirtualMachine" {
+		t.Fatalf("canonicalSystemType = %q, %v", systemType, err)
+	}
+	if _, err := canonicalSystemType("Process"); err == nil {
+		t.Error("unknown system type accepted")
+	}
+
+	entries, err := queryEnumEntries(systemTypeQuery(systemType))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != `{"Types":["VirtualMachine"]}` {
+		t.Errorf("query = %s", query)
+	}
+	entries = filterEntriesByType(entries, systemType)
+	if len(entries) != 2 || entries[0].Id != "a" || entries[1].Id != "c" {
+		t.Errorf("filtered entries = %+v, want a and c", entries)
+	}
+
+	if got := emptyListMessage(ListOptions{}); got != "No compute systems found." {
+		t.Errorf("unfiltered empty message = %q", got)
+	}
+	if got := emptyListMessage(ListOptions{Type: systemType}); got != "No compute systems match the given filters." {
+		t.Errorf("filtered empty message = %q", got)
+	}
+}
+
+func TestValidateMemoryTuning(t *testing.T) {
+	tests := []struct {
+		opts quickSpecOptions
+		ok   bool
+	}{
+		{quickSpecOptions{}, true},
+		{quickSpecOptions{Ballooning: true, MemoryBuffer: 5, MemoryPriority: 10000}, true},
+		{quickSpecOptions{Ballooning: true, MemoryBuffer: 2000}, true},
+		{quickSpecOptions{Ballooning: true, MemoryBuffer: 4}, false},
+		{quickSpecOptions{Ballooning: true, MemoryBuffer: 2001}, false},
+		{quickSpecOptions{Ballooning: true, MemoryPriority: -1}, false},
+		{quickSpecOptions{Ballooning: true, MemoryPriority: 10001}, false},
+		{quickSpecOptions{MemoryBuffer: 20}, false},
+		{quickSpecOptions{MemoryPriority: 5000}, false},
+	}
+	for _, tt := range tests {
+		if err := validateMemoryTuning(tt.opts); (err == nil) != tt.ok {
+			t.Errorf("validateMemoryTuning(%+v) = %v, want ok=%v", tt.opts, err, tt.ok)
+		}
+	}
+}
+
+func TestResolveCPUCount(t *testing.T) {
+	orig := hostProcessorCount
+	defer func() { hostProcessorCount = orig }()
+	hostProcessorCount = func() int { return 12 }
+
+	for _, tt := range []struct{ in, want int }{{0, 12}, {1, 1}, {4, 4}} {
+		if got, err := resolveCPUCount(tt.in); err != nil || got != tt.want {
+			t.Errorf("resolveCPUCount(%d) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := resolveCPUCount(-1); err == nil {
+		t.Error("negative count accepted")
+	}
+
+	hostProcessorCount = func() int { return 0 }
+	if _, err := resolveCPUCount(0); err == nil {
+		t.Error("unknown host processor count accepted")
+	}
+}
+
+func TestValidateFirmware(t *testing.T) {
+	apic, utc, err := validateFirmware(quickSpecOptions{})
+	if err != nil || apic != "" || utc {
+		t.Errorf("defaults: got %q, %v, %v", apic, utc, err)
+	}
+	apic, utc, err = validateFirmware(quickSpecOptions{Generation: 2, ApicMode: "Legacy", RTC: "utc"})
+	if err != nil || apic != "Legacy" || !utc {
+		t.Errorf("legacy APIC, UTC clock: got %q, %v, %v", apic, utc, err)
+	}
+	for _, opts := range []quickSpecOptions{
+		{Generation: 1},
+		{Generation: 1, SecureBoot: true},
+		{Generation: 3},
+		{ApicMode: "flat"},
+		{RTC: "gmt"},
+	} {
+		if _, _, err := validateFirmware(opts); err == nil {
+			t.Errorf("validateFirmware(%+v) accepted", opts)
+		}
+	}
+}
+
+func TestStripJSONComments(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", `{"a": 1}`, `{"a": 1}`},
+		{"line comment", "{\n  // memory\n  \"a\": 1\n}", "{\n  \n  \"a\": 1\n}"},
+		{"block comment", "{/* x\ny */\"a\": 1}", "{\n\"a\": 1}"},
+		{"trailing commas", `{"a": [1, 2,], "b": 3,}`, `{"a": [1, 2], "b": 3}`},
+		{"comma before comment", "{\"a\": 1, // last\n}", "{\"a\": 1 \n}"},
+		{"slashes in strings", `{"p": "C:\\vms\\//x", "q": "/* no */", "r": "a\",}"}`, `{"p": "C:\\vms\\//x", "q": "/* no */", "r": "a\",}"}`},
+	}
+	for _, tt := range tests {
+		got, err := stripJSONComments(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{`{"a": 1 /* open`, `{"a": "open`} {
+		if _, err := stripJSONComments(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestDiskAccessCachingMode(t *testing.T) {
+	tests := []struct {
+		access diskAccess
+		want   string
+		ok     bool
+	}{
+		{diskAccess{}, "", true},
+		{diskAccess{CacheMode: "Uncached"}, "Uncached", true},
+		{diskAccess{CacheMode: "cached"}, "Cached", true},
+		{diskAccess{ReadOnly: true}, "", true},
+		{diskAccess{ReadOnly: true, CacheMode: "readonlycached"}, "ReadOnlyCached", true},
+		{diskAccess{ReadOnly: true, CacheMode: "cached"}, "", false},
+		{diskAccess{CacheMode: "ReadOnlyCached"}, "", false},
+		{diskAccess{CacheMode: "writeback"}, "", false},
+	}
+	for _, tt := range tests {
+		got, err := tt.access.cachingMode()
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%+v: got %q, %v; want %q, ok=%v", tt.access, got, err, tt.want, tt.ok)
+		}
+	}
+
+	att, err := diskAccess{ReadOnly: true}.attachment(attachVirtualDisk, "base.vhdx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(att)
+	if want := `{"Type":"VirtualDisk","Path":"base.vhdx","ReadOnly":true}`; string(data) != want {
+		t.Errorf("attachment = %s, want %s", data, want)
+	}
+}
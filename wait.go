@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// waitPollInterval is how often wait re-reads the system's state; tests
+// shorten it.
+var waitPollInterval = 500 * time.Millisecond
+
+// exitWaitTimeout is the exit code of `wait` when the timeout expires, so
+// scripts can tell it apart from the system ending up in another state.
+const exitWaitTimeout = 2
+
+// stateGone is the pseudo-state of a system that no longer exists. A system
+// that was torn down counts as Stopped for matching purposes.
+const stateGone = "Stopped"
+
+// terminalStates can't change without outside action, so waiting for some
+// other state from one of them would never finish.
+var terminalStates = map[string]bool{"stopped": true}
+
+var errWaitTimeout = errors.New("timed out")
+
+// WaitForState polls a compute system until its State is one of states
+// (case-insensitive) and returns the matched state. It gives up with an error
+// if the system reaches a terminal state that isn't wanted, or with
+// errWaitTimeout once timeout has passed (0 waits forever).
+func WaitForState(id string, states []string, timeout time.Duration) (string, error) {
+	want := make(map[string]bool, len(states))
+	for _, s := range states {
+		want[strings.ToLower(s)] = true
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	last := ""
+	for {
+		state, err := probeState(id)
+		if err != nil {
+			return "", err
+		}
+		if state != last {
+			verbosef("%s is %s", id, state)
+			last = state
+		}
+		if want[strings.ToLower(state)] {
+			return state, nil
+		}
+		if terminalStates[strings.ToLower(state)] {
+			return "", fmt.Errorf("%s reached %s instead of %s", id, state, strings.Join(states, " or "))
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return "", fmt.Errorf("%s still %s after %s: %w", id, state, timeout, errWaitTimeout)
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
+
+// probeState reads a system's state for WaitForState; tests replace it.
+var probeState = currentState
+
+// currentState returns a system's State, mapping a system that no longer
+// exists to stateGone.
+func currentState(id string) (string, error) {
+	entry, err := findEnumEntry(id)
+	var hcsErr *HcsError
+	if errors.As(err, &hcsErr) && hcsErr.HR == hcsESystemNotFound {
+		return stateGone, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return entry.State, nil
+}
+
+// systemGone reports whether a compute system has been fully torn down: it
+// is no longer enumerated and can no longer be opened.
+func systemGone(id string) (bool, error) {
+	state, err := currentState(id)
+	if err != nil {
+		return false, err
+	}
+	if state != stateGone {
+		return false, nil
+	}
+	sys, err := openComputeSystem(id, accessRead)
+	if isHRESULT(err, hcsESystemNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	closeComputeSystem(sys)
+	return false, nil
+}
+
+// WaitForGone polls until a compute system no longer exists, so its disks
+// are released, or fails once timeout has passed (0 waits forever).
+func WaitForGone(id string, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		gone, err := systemGone(id)
+		if err != nil {
+			return err
+		}
+		if gone {
+			return nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("%s still present after %s: %w", id, timeout, errWaitTimeout)
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
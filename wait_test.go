@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitForState(t *testing.T) {
+	origProbe, origInterval := probeState, waitPollInterval
+	defer func() { probeState, waitPollInterval = origProbe, origInterval }()
+	waitPollInterval = time.Millisecond
+
+	probeErr := errors.New("enumeration failed")
+	for _, tc := range []struct {
+		name    string
+		states  []string // successive probe results; the last one repeats
+		probe   error
+		want    []string
+		timeout time.Duration
+		match   string
+		errIs   error
+		errHas  string
+	}{
+		{name: "match", states: []string{"Created", "Running"}, want: []string{"running"}, match: "Running"},
+		{name: "match gone", states: []string{"Running", stateGone}, want: []string{"Stopped"}, match: stateGone},
+		{name: "terminal", states: []string{"Running", "Stopped"}, want: []string{"Paused"}, errHas: "reached Stopped instead of Paused"},
+		{name: "timeout", states: []string{"Running"}, want: []string{"Paused"}, timeout: 20 * time.Millisecond, errIs: errWaitTimeout},
+		{name: "probe error", probe: probeErr, want: []string{"Running"}, errIs: probeErr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			probeState = func(id string) (string, error) {
+				if tc.probe != nil {
+					return "", tc.probe
+				}
+				state := tc.states[min(calls, len(tc.states)-1)]
+				calls++
+				return state, nil
+			}
+
+			got, err := WaitForState("vm1", tc.want, tc.timeout)
+			switch {
+			case tc.errIs != nil:
+				if !errors.Is(err, tc.errIs) {
+					t.Errorf("err = %v, want %v", err, tc.errIs)
+				}
+			case tc.errHas != "":
+				if err == nil || !strings.Contains(err.Error(), tc.errHas) {
+					t.Errorf("err = %v, want one containing %q", err, tc.errHas)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case got != tc.match:
+				t.Errorf("matched %q, want %q", got, tc.match)
+			}
+		})
+	}
+}